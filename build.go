@@ -0,0 +1,161 @@
+package boxcat
+
+import (
+	"fmt"
+	"go/build"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Environment variables we look at to find catbox. See BuildConfigFromEnv.
+const (
+	// EnvCatboxBinary is the path to a catbox binary that is already built.
+	EnvCatboxBinary = "BOXCAT_CATBOX_BINARY"
+
+	// EnvCatboxSource is the path to a catbox source directory to build.
+	EnvCatboxSource = "BOXCAT_CATBOX_SOURCE"
+
+	// EnvBuildFlags holds extra flags to pass to go build, separated by
+	// whitespace. For example "-race -cover".
+	EnvBuildFlags = "BOXCAT_BUILD_FLAGS"
+)
+
+// BuildConfig says where to find catbox and how to build it.
+type BuildConfig struct {
+	// Binary is the path to a catbox binary that is already built. If it is
+	// set we use it as is and ignore the other fields.
+	Binary string
+
+	// SourceDir is the catbox source directory to build from. If it is not
+	// set we use the catbox directory in the GOPATH.
+	SourceDir string
+
+	// BuildFlags are extra flags to pass to go build. For example -race or
+	// -cover. If you build with -cover, set GOCOVERDIR in the environment and
+	// catbox will write its coverage data there.
+	BuildFlags []string
+}
+
+// BuildConfigFromEnv creates a BuildConfig from the environment variables
+// EnvCatboxBinary, EnvCatboxSource, and EnvBuildFlags.
+func BuildConfigFromEnv() BuildConfig {
+	return BuildConfig{
+		Binary:     os.Getenv(EnvCatboxBinary),
+		SourceDir:  os.Getenv(EnvCatboxSource),
+		BuildFlags: strings.Fields(os.Getenv(EnvBuildFlags)),
+	}
+}
+
+// defaultSourceDir is where catbox is in the GOPATH.
+func defaultSourceDir() string {
+	gopath := os.Getenv("GOPATH")
+	if gopath == "" {
+		gopath = build.Default.GOPATH
+	}
+	dirs := filepath.SplitList(gopath)
+	if len(dirs) > 0 {
+		gopath = dirs[0]
+	}
+	return filepath.Join(gopath, "src", "github.com", "horgh", "catbox")
+}
+
+// catboxBuild is a build of catbox from a source directory with some flags.
+// If the build fails we remember the error rather than trying again.
+type catboxBuild struct {
+	once   *sync.Once
+	binary string
+	err    error
+
+	// dir is the temporary directory holding the binary.
+	dir string
+}
+
+// builds maps a build's source directory and flags to its build. We build
+// each only once per run, even if tests running in parallel ask for it at
+// the same time.
+var builds = map[string]*catboxBuild{}
+
+// buildsMutex protects builds.
+var buildsMutex = &sync.Mutex{}
+
+// catboxBinary finds the catbox binary to run, building it if necessary.
+func catboxBinary(config BuildConfig, logger Logger) (string, error) {
+	if config.Binary != "" {
+		binary, err := filepath.Abs(config.Binary)
+		if err != nil {
+			return "", fmt.Errorf("error determining path to binary: %s", err)
+		}
+		return binary, nil
+	}
+
+	sourceDir := config.SourceDir
+	if sourceDir == "" {
+		sourceDir = defaultSourceDir()
+	}
+
+	key := strings.Join(append([]string{sourceDir}, config.BuildFlags...), " ")
+
+	buildsMutex.Lock()
+	b, ok := builds[key]
+	if !ok {
+		b = &catboxBuild{once: &sync.Once{}}
+		builds[key] = b
+	}
+	buildsMutex.Unlock()
+
+	b.once.Do(func() {
+		b.binary, b.err = b.build(sourceDir, config.BuildFlags, logger)
+	})
+	return b.binary, b.err
+}
+
+// build builds catbox into a new temporary directory.
+func (b *catboxBuild) build(
+	sourceDir string,
+	flags []string,
+	logger Logger,
+) (string, error) {
+	buildDir, err := ioutil.TempDir("", "boxcat-build-")
+	if err != nil {
+		return "", fmt.Errorf("error creating build directory: %s", err)
+	}
+	b.dir = buildDir
+
+	binary := filepath.Join(buildDir, "catbox")
+
+	args := append([]string{"build", "-o", binary}, flags...)
+	cmd := exec.Command("go", args...)
+	cmd.Dir = sourceDir
+
+	logf(logger, LevelInfo, "build", "Running %s in [%s]...", cmd.Args, cmd.Dir)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("error building catbox: %s: %s", err, output)
+	}
+
+	return binary, nil
+}
+
+// CleanBuilds removes the catbox binaries we built. Call it once you are done
+// running catboxes, such as at the end of TestMain.
+func CleanBuilds() error {
+	buildsMutex.Lock()
+	defer buildsMutex.Unlock()
+
+	for _, b := range builds {
+		// Wait for the build if it is running.
+		b.once.Do(func() {})
+		if b.dir == "" {
+			continue
+		}
+		if err := os.RemoveAll(b.dir); err != nil {
+			return fmt.Errorf("error removing build directory: %s", err)
+		}
+	}
+	builds = map[string]*catboxBuild{}
+	return nil
+}
@@ -0,0 +1,51 @@
+package boxcat
+
+import (
+	"os"
+	"sync"
+	"testing"
+)
+
+// Test tests running in parallel build catbox only once.
+func TestCatboxBinaryParallel(t *testing.T) {
+	dir := fakeCatboxSource(t, "package main\n\nfunc main() {}\n")
+
+	mutex := &sync.Mutex{}
+	buildCount := 0
+	logger := LoggerFunc(func(e LogEntry) {
+		if e.Source == "build" {
+			mutex.Lock()
+			buildCount++
+			mutex.Unlock()
+		}
+	})
+
+	var wg sync.WaitGroup
+	binaries := make([]string, 8)
+	errs := make([]error, 8)
+	for i := range binaries {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			binaries[i], errs[i] = catboxBinary(BuildConfig{SourceDir: dir},
+				logger)
+		}(i)
+	}
+	wg.Wait()
+
+	for i := range binaries {
+		if errs[i] != nil {
+			t.Fatalf("error building: %s", errs[i])
+		}
+		if binaries[i] != binaries[0] {
+			t.Fatalf("got binaries %s and %s, wanted one", binaries[0],
+				binaries[i])
+		}
+	}
+	if buildCount != 1 {
+		t.Fatalf("built %d times, wanted once", buildCount)
+	}
+	if _, err := os.Stat(binaries[0]); err != nil {
+		t.Fatalf("error finding binary: %s", err)
+	}
+}
@@ -0,0 +1,281 @@
+package boxcat
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// capTimeout is how long we wait for capability negotiation to complete.
+const capTimeout = 10 * time.Second
+
+// NegotiateCaps makes the client negotiate IRCv3 capabilities when it
+// registers. Call it before Start.
+//
+// We send CAP LS 302 and then request those of the given capabilities the
+// server offers. You may request none in order to only see what the server
+// offers.
+//
+// If the server does not support capability negotiation, we register as
+// usual.
+func (c *Client) NegotiateCaps(caps ...string) {
+	c.negotiateCaps = true
+	c.requestedCaps = caps
+}
+
+// negotiateCapsOnConnect runs capability negotiation. We must have sent CAP LS
+// 302 already. We return once we have sent CAP END or once we see the server
+// does not support negotiation.
+//
+// We return the messages we read. The caller must pass them on.
+func (c *Client) negotiateCapsOnConnect() ([]TaggedMessage, error) {
+	var read []TaggedMessage
+	lsDone := false
+
+	for {
+		m, err := c.readRegistrationMessage(&read)
+		if err != nil {
+			return read, err
+		}
+
+		// The server ignored CAP and registered us.
+		if m.Command == irc.ReplyWelcome {
+			return read, nil
+		}
+
+		// The server does not know CAP.
+		if m.Command == "421" && len(m.Params) > 1 &&
+			strings.EqualFold(m.Params[1], "CAP") {
+			return read, nil
+		}
+
+		if m.Command != "CAP" || len(m.Params) < 3 {
+			continue
+		}
+
+		switch strings.ToUpper(m.Params[1]) {
+		case "LS":
+			c.addAvailableCaps(m)
+			// There are more lines to come if the third parameter is *.
+			if len(m.Params) > 3 && m.Params[2] == "*" {
+				continue
+			}
+			if lsDone {
+				continue
+			}
+			lsDone = true
+
+			wanted := c.wantedCaps()
+			if len(wanted) == 0 {
+				return read, c.endCaps()
+			}
+			if err := c.requestCaps(wanted); err != nil {
+				return read, err
+			}
+		case "ACK":
+			c.ackCaps(m)
+			if c.sasl != nil && c.HasCap("sasl") {
+				if err := c.authenticate(&read); err != nil {
+					return read, err
+				}
+			}
+			return read, c.endCaps()
+		case "NAK":
+			return read, c.endCaps()
+		}
+	}
+}
+
+// readRegistrationMessage reads a message while we register. We answer PINGs.
+// We add the messages we read to read so the caller can pass them on.
+func (c *Client) readRegistrationMessage(
+	read *[]TaggedMessage,
+) (TaggedMessage, error) {
+	for {
+		m, err := c.readMessage()
+		if err != nil {
+			if c.ctx.Err() != nil {
+				return TaggedMessage{}, fmt.Errorf("error registering: %s",
+					c.ctx.Err())
+			}
+			if isTimeout(err) {
+				return TaggedMessage{}, fmt.Errorf("timed out registering")
+			}
+			return TaggedMessage{}, fmt.Errorf("error reading message: %s", err)
+		}
+		*read = append(*read, m)
+
+		if err := c.handleRegistrationNick(m); err != nil {
+			return TaggedMessage{}, err
+		}
+
+		if m.Command == "PING" && len(m.Params) > 0 {
+			if err := c.writeMessage(irc.Message{
+				Command: "PONG",
+				Params:  []string{m.Params[0]},
+			}); err != nil {
+				return TaggedMessage{}, fmt.Errorf("error sending pong: %s", err)
+			}
+			continue
+		}
+
+		return m, nil
+	}
+}
+
+// handleCap deals with CAP messages after registration. Servers supporting
+// cap-notify tell us about capabilities coming and going.
+func (c *Client) handleCap(m TaggedMessage) error {
+	if len(m.Params) < 3 {
+		return nil
+	}
+
+	switch strings.ToUpper(m.Params[1]) {
+	case "NEW":
+		c.addAvailableCaps(m)
+		wanted := c.wantedCaps()
+		if len(wanted) == 0 {
+			return nil
+		}
+		return c.requestCaps(wanted)
+	case "DEL":
+		c.mutex.Lock()
+		for _, name := range strings.Fields(m.Params[len(m.Params)-1]) {
+			delete(c.availableCaps, name)
+			delete(c.enabledCaps, name)
+		}
+		c.mutex.Unlock()
+	case "ACK":
+		c.ackCaps(m)
+	}
+
+	return nil
+}
+
+// addAvailableCaps records the capabilities in a CAP LS or CAP NEW message.
+func (c *Client) addAvailableCaps(m TaggedMessage) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for name, value := range parseCaps(m.Params[len(m.Params)-1]) {
+		c.availableCaps[name] = value
+	}
+}
+
+// ackCaps records the capabilities in a CAP ACK message as enabled. A
+// capability prefixed with - is disabled.
+func (c *Client) ackCaps(m TaggedMessage) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, name := range strings.Fields(m.Params[len(m.Params)-1]) {
+		if strings.HasPrefix(name, "-") {
+			delete(c.enabledCaps, name[1:])
+			continue
+		}
+		c.enabledCaps[name] = struct{}{}
+	}
+}
+
+// wantedCaps returns the requested capabilities the server offers that are
+// not enabled. We want sasl if we authenticate.
+func (c *Client) wantedCaps() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	requested := c.requestedCaps
+	if c.sasl != nil {
+		requested = append([]string{"sasl"}, requested...)
+	}
+
+	var wanted []string
+	seen := map[string]struct{}{}
+	for _, name := range requested {
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+		if _, ok := c.availableCaps[name]; !ok {
+			continue
+		}
+		if _, ok := c.enabledCaps[name]; ok {
+			continue
+		}
+		wanted = append(wanted, name)
+	}
+	return wanted
+}
+
+func (c *Client) requestCaps(caps []string) error {
+	if err := c.writeMessage(irc.Message{
+		Command: "CAP",
+		Params:  []string{"REQ", strings.Join(caps, " ")},
+	}); err != nil {
+		return fmt.Errorf("error requesting capabilities: %s", err)
+	}
+	return nil
+}
+
+func (c *Client) endCaps() error {
+	if err := c.writeMessage(irc.Message{
+		Command: "CAP",
+		Params:  []string{"END"},
+	}); err != nil {
+		return fmt.Errorf("error ending capability negotiation: %s", err)
+	}
+	return nil
+}
+
+// parseCaps parses a list of capabilities such as "sasl=PLAIN,EXTERNAL
+// multi-prefix". We return a map of capability name to value. The value is
+// blank if the capability has none.
+func parseCaps(s string) map[string]string {
+	caps := map[string]string{}
+	for _, field := range strings.Fields(s) {
+		idx := strings.Index(field, "=")
+		if idx == -1 {
+			caps[field] = ""
+			continue
+		}
+		caps[field[:idx]] = field[idx+1:]
+	}
+	return caps
+}
+
+// GetCaps retrieves the capabilities enabled on the connection, sorted.
+func (c *Client) GetCaps() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var caps []string
+	for name := range c.enabledCaps {
+		caps = append(caps, name)
+	}
+	sort.Strings(caps)
+	return caps
+}
+
+// HasCap reports whether the capability is enabled on the connection.
+func (c *Client) HasCap(name string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	_, ok := c.enabledCaps[name]
+	return ok
+}
+
+// GetAvailableCaps retrieves the capabilities the server offers. The map's
+// values are the capabilities' values, such as the mechanisms for sasl.
+func (c *Client) GetAvailableCaps() map[string]string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	caps := map[string]string{}
+	for name, value := range c.availableCaps {
+		caps[name] = value
+	}
+	return caps
+}
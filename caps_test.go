@@ -0,0 +1,123 @@
+package boxcat
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+func TestParseCaps(t *testing.T) {
+	got := parseCaps("multi-prefix sasl=PLAIN,EXTERNAL  cap-notify")
+	want := map[string]string{
+		"multi-prefix": "",
+		"sasl":         "PLAIN,EXTERNAL",
+		"cap-notify":   "",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseCaps = %v, wanted %v", got, want)
+	}
+}
+
+func TestClientNegotiateCaps(t *testing.T) {
+	server := newTestServer(t)
+	defer server.close()
+
+	client := server.newClient("client1")
+	client.NegotiateCaps("multi-prefix", "away-notify", "echo-message")
+
+	server.serve(
+		server.accept,
+		server.expecting("CAP LS 302", "NICK client1", "USER client1 0 * client1"),
+		server.sending(
+			":irc.example.org CAP * LS * :multi-prefix sasl=PLAIN",
+			":irc.example.org CAP * LS :cap-notify away-notify",
+		),
+		server.expecting("CAP REQ :multi-prefix away-notify"),
+		server.sending(
+			":irc.example.org CAP client1 ACK :multi-prefix away-notify"),
+		server.expecting("CAP END"),
+		server.sending(":irc.example.org 001 client1 :Welcome"),
+	)
+
+	if _, _, _, err := client.Start(); err != nil {
+		t.Fatalf("error starting client: %s", err)
+	}
+	defer client.Stop()
+	server.wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// We see the messages from negotiation too.
+	if _, err := client.Expect(ctx, Sequence(
+		AllOf(Command("CAP"), Param(1, "ACK")),
+		Command(irc.ReplyWelcome),
+	)); err != nil {
+		t.Fatalf("error waiting for welcome: %s", err)
+	}
+
+	if caps := client.GetCaps(); !reflect.DeepEqual(caps,
+		[]string{"away-notify", "multi-prefix"}) {
+		t.Fatalf("caps = %v, wanted away-notify and multi-prefix", caps)
+	}
+	if client.GetAvailableCaps()["sasl"] != "PLAIN" {
+		t.Fatalf("available caps = %v, wanted sasl=PLAIN",
+			client.GetAvailableCaps())
+	}
+
+	// The server offers a new capability we want, and removes one.
+	if err := server.run(
+		server.sending(
+			":irc.example.org CAP client1 NEW :echo-message",
+			":irc.example.org CAP client1 DEL :away-notify",
+		),
+		server.expecting("CAP REQ echo-message"),
+		server.sending(":irc.example.org CAP client1 ACK :echo-message"),
+	); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if _, err := client.Expect(ctx, AllOf(Command("CAP"),
+		Param(1, "ACK"))); err != nil {
+		t.Fatalf("error waiting for ACK: %s", err)
+	}
+	if caps := client.GetCaps(); !reflect.DeepEqual(caps,
+		[]string{"echo-message", "multi-prefix"}) {
+		t.Fatalf("caps = %v, wanted echo-message and multi-prefix", caps)
+	}
+}
+
+// Test registration proceeds when the server does not know CAP.
+func TestClientNegotiateCapsUnsupported(t *testing.T) {
+	server := newTestServer(t)
+	defer server.close()
+
+	client := server.newClient("client1")
+	client.NegotiateCaps("multi-prefix")
+
+	server.serve(
+		server.accept,
+		server.expecting("CAP LS 302"),
+		server.sending(":irc.example.org 421 * CAP :Unknown command"),
+		server.expecting("NICK client1", "USER client1 0 * client1"),
+		server.sending(":irc.example.org 001 client1 :Welcome"),
+	)
+
+	if _, _, _, err := client.Start(); err != nil {
+		t.Fatalf("error starting client: %s", err)
+	}
+	defer client.Stop()
+	server.wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := client.Expect(ctx, Command(irc.ReplyWelcome)); err != nil {
+		t.Fatalf("error waiting for welcome: %s", err)
+	}
+	if len(client.GetCaps()) != 0 {
+		t.Fatalf("caps = %v, wanted none", client.GetCaps())
+	}
+}
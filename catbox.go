@@ -2,14 +2,13 @@ package boxcat
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net"
 	"os"
 	"os/exec"
-	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -22,104 +21,114 @@ import (
 type Catbox struct {
 	Name      string
 	Port      uint16
+	TLSPort   uint16
 	Stderr    io.ReadCloser
 	Stdout    io.ReadCloser
 	Command   *exec.Cmd
 	WaitGroup *sync.WaitGroup
 	ConfigDir string
-	LogChan   <-chan string
-}
+	Config    *CatboxConfig
+	Log       *LogRecorder
+
+	// logger receives catbox's output and problems running it.
+	logger Logger
 
-var catboxDir = filepath.Join(os.Getenv("GOPATH"), "src", "github.com", "horgh",
-	"catbox")
+	// done is closed once the process exits. exit then says how.
+	done chan struct{}
+	exit *CatboxExit
 
-func harnessCatbox(name string) (*Catbox, error) {
-	if err := buildCatbox(); err != nil {
-		return nil, fmt.Errorf("error building catbox: %s", err)
+	// stopping is true once Stop is called. The process exiting after that is
+	// expected.
+	stopping bool
+
+	mutex *sync.Mutex
+}
+
+// harnessCatbox starts a catbox with the given config and waits for it to be
+// ready. We find or build catbox as the build config says. Its output goes
+// to the logger as well as its LogRecorder.
+func harnessCatbox(
+	build BuildConfig,
+	config *CatboxConfig,
+	logger Logger,
+) (*Catbox, error) {
+	binary, err := catboxBinary(build, logger)
+	if err != nil {
+		return nil, fmt.Errorf("error finding catbox: %s", err)
 	}
 
-	catbox, err := startCatbox(name)
+	name := config.ServerName
+
+	catbox, err := startCatbox(binary, config)
 	if err != nil {
 		return nil, fmt.Errorf("error starting catbox: %s", err)
 	}
 
 	var wg sync.WaitGroup
 
-	logChan := make(chan string, 1024)
+	recorder := newLogRecorder(name)
 
-	wg.Add(1)
-	go logReader(&wg, fmt.Sprintf("%s stderr", name), catbox.Stderr, logChan)
+	catbox.logger = logger
+	catbox.WaitGroup = &wg
+	catbox.Log = recorder
 
-	wg.Add(1)
-	go logReader(&wg, fmt.Sprintf("%s stdout", name), catbox.Stdout, logChan)
+	var logWG sync.WaitGroup
 
+	logWG.Add(1)
+	go logReader(&logWG, name, "stderr", catbox.Stderr, recorder, logger)
+
+	logWG.Add(1)
+	go logReader(&logWG, name, "stdout", catbox.Stdout, recorder, logger)
+
+	// Wait closes the pipes, so we must only call it once we've read
+	// everything from them. Otherwise we could lose lines.
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		if err := catbox.Command.Wait(); err != nil {
-			log.Printf("catbox exited: %s", err)
-		}
+		logWG.Wait()
+		recorder.close()
+		catbox.exited(catbox.Command.Wait())
 	}()
 
-	catbox.WaitGroup = &wg
-	catbox.LogChan = logChan
-
 	// It is important to wait for catbox to fully start. If we don't, then
 	// certain things we do in tests will not work well. For example, trying to
 	// reload the conf by sending a SIGHUP will kill the process.
 	startedRE := regexp.MustCompile(
 		`^\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2} catbox started$`)
 
-	if !waitForLog(logChan, startedRE) {
-		catbox.stop()
+	if !waitForLog(recorder, startedRE, 0) {
+		// Stop cleans up even if the process exited. It doesn't change how it
+		// exited.
+		exit, exited := catbox.Exited()
+		catbox.Stop()
+		if exited {
+			return nil, fmt.Errorf("error waiting for catbox to start: %s", exit)
+		}
 		return nil, fmt.Errorf("error waiting for catbox to start")
 	}
 
 	return catbox, nil
 }
 
-var builtCatbox bool
-
-func buildCatbox() error {
-	if builtCatbox {
-		return nil
-	}
-
-	cmd := exec.Command("go", "build")
-	cmd.Dir = catboxDir
-
-	log.Printf("Running %s in [%s]...", cmd.Args, cmd.Dir)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("error building catbox: %s: %s", err, output)
-	}
-
-	builtCatbox = true
-	return nil
-}
-
-func startCatbox(name string) (*Catbox, error) {
+func startCatbox(binary string, config *CatboxConfig) (*Catbox, error) {
 	tmpDir, err := ioutil.TempDir("", "boxcat-")
 	if err != nil {
 		return nil, fmt.Errorf("error retrieving a temporary directory: %s", err)
 	}
 
-	catboxConf := filepath.Join(tmpDir, "catbox.conf")
-
 	listener, port, err := getRandomPort()
 	if err != nil {
 		_ = os.RemoveAll(tmpDir)
 		return nil, fmt.Errorf("error opening random port: %s", err)
 	}
 
-	catbox, err := runCatbox(catboxConf, listener, port, name)
+	catbox, err := runCatbox(binary, tmpDir, config, listener, port)
 	if err != nil {
 		_ = os.RemoveAll(tmpDir)
 		_ = listener.Close()
 		return nil, fmt.Errorf("error running catbox: %s", err)
 	}
 
-	catbox.ConfigDir = tmpDir
 	return catbox, nil
 }
 
@@ -142,21 +151,23 @@ func getRandomPort() (net.Listener, uint16, error) {
 }
 
 func runCatbox(
-	conf string,
+	binary string,
+	dir string,
+	config *CatboxConfig,
 	ln net.Listener,
 	port uint16,
-	name string,
 ) (*Catbox, error) {
-	if err := writeConf(conf, name, ""); err != nil {
+	conf, err := config.Render(dir)
+	if err != nil {
 		return nil, err
 	}
 
-	cmd := exec.Command("./catbox",
+	cmd := exec.Command(binary,
 		"-conf", conf,
 		"-listen-fd", "3",
 	)
 
-	cmd.Dir = catboxDir
+	cmd.Dir = dir
 
 	f, err := ln.(*net.TCPListener).File()
 	if err != nil {
@@ -181,88 +192,76 @@ func runCatbox(
 	}
 
 	return &Catbox{
-		Name:    name,
-		Port:    port,
-		Command: cmd,
-		Stderr:  stderr,
-		Stdout:  stdout,
+		Name:      config.ServerName,
+		Port:      port,
+		TLSPort:   config.ListenPortTLS,
+		Command:   cmd,
+		Stderr:    stderr,
+		Stdout:    stdout,
+		ConfigDir: dir,
+		Config:    config,
+		done:      make(chan struct{}),
+		mutex:     &sync.Mutex{},
 	}, nil
 }
 
-func writeConf(conf, name, extra string) error {
-	// -1 because we pass in fd.
-	buf := fmt.Sprintf(`
-listen-port = %d
-server-name = %s
-connect-attempt-time = 100ms
-%s
-`, -1, name, extra)
-
-	if err := ioutil.WriteFile(conf, []byte(buf), 0644); err != nil {
-		return fmt.Errorf("error writing conf: %s: %s", name, err)
-	}
-
-	return nil
-}
-
+// logReader reads lines from the reader and records them. We keep reading
+// until the reader ends.
 func logReader(
 	wg *sync.WaitGroup,
-	prefix string,
+	name string,
+	source string,
 	r io.Reader,
-	ch chan<- string,
+	recorder *LogRecorder,
+	logger Logger,
 ) {
 	defer wg.Done()
 
 	scanner := bufio.NewScanner(r)
 
 	for scanner.Scan() {
-		line := scanner.Text()
-		line = strings.TrimSpace(line)
-		if line == "" {
+		// Keep leading whitespace. Stack traces use it.
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if strings.TrimSpace(line) == "" {
 			continue
 		}
 
-		log.Printf("%s: %s", prefix, line)
+		logf(logger, LevelInfo, name+" "+source, "%s", line)
 
-		select {
-		case ch <- line:
-		default:
-		}
+		recorder.add(source, line)
 	}
 
 	if err := scanner.Err(); err != nil {
-		log.Fatalf("error scanning: %s", err)
+		logf(logger, LevelError, name+" "+source, "error scanning: %s", err)
 	}
 }
 
-func (c *Catbox) stop() {
-	if err := c.Command.Process.Kill(); err != nil {
-		log.Printf("error killing catbox: %s", err)
+// Stop kills catbox and cleans up.
+func (c *Catbox) Stop() {
+	c.mutex.Lock()
+	c.stopping = true
+	c.mutex.Unlock()
+
+	if _, exited := c.Exited(); !exited {
+		if err := c.Command.Process.Kill(); err != nil {
+			logf(c.logger, LevelError, c.Name, "error killing catbox: %s", err)
+		}
 	}
 	c.WaitGroup.Wait()
 
 	if err := os.RemoveAll(c.ConfigDir); err != nil {
-		log.Fatalf("error cleaning up temporary directory: %s", err)
+		logf(c.logger, LevelError, c.Name,
+			"error cleaning up temporary directory: %s", err)
 	}
 }
 
-func (c *Catbox) linkServer(other *Catbox) error {
-	conf := filepath.Join(c.ConfigDir, "catbox.conf")
-	serversConf := filepath.Join(c.ConfigDir, "servers.conf")
-	extra := fmt.Sprintf("servers-config = %s", serversConf)
-
-	if err := writeConf(conf, c.Name, extra); err != nil {
+// Rehash writes out the catbox's current config and tells catbox to reload
+// it.
+func (c *Catbox) Rehash() error {
+	if _, err := c.Config.Render(c.ConfigDir); err != nil {
 		return err
 	}
 
-	serversConfContent := fmt.Sprintf(`%s = %s,%d,%s,0`,
-		other.Name, "127.0.0.1", other.Port, "testing")
-
-	if err := ioutil.WriteFile(serversConf, []byte(serversConfContent),
-		0644); err != nil {
-		return fmt.Errorf("error writing server conf: %s: %s", serversConf, err)
-	}
-
 	if err := c.Command.Process.Signal(syscall.SIGHUP); err != nil {
 		return fmt.Errorf("error sending SIGHUP: %s", err)
 	}
@@ -270,17 +269,45 @@ func (c *Catbox) linkServer(other *Catbox) error {
 	return nil
 }
 
-func waitForLog(ch <-chan string, re *regexp.Regexp) bool {
-	timeoutChan := time.After(10 * time.Second)
-
-	for {
-		select {
-		case s := <-ch:
-			if re.MatchString(s) {
-				return true
-			}
-		case <-timeoutChan:
-			return false
-		}
+func (c *Catbox) linkServer(other *Catbox) error {
+	c.Config.AddServer(other.serverLink())
+	return c.Rehash()
+}
+
+// linkServerVia links to the other server by connecting to the given port
+// rather than to the other server directly. For example to go through a
+// proxy.
+func (c *Catbox) linkServerVia(other *Catbox, port uint16) error {
+	link := other.serverLink()
+	link.Port = port
+	c.Config.AddServer(link)
+	return c.Rehash()
+}
+
+// serverLink creates the servers.conf entry other servers use to link to this
+// one.
+func (c *Catbox) serverLink() ServerLink {
+	return ServerLink{
+		Name:     c.Name,
+		Host:     "127.0.0.1",
+		Port:     c.Port,
+		Password: "testing",
 	}
 }
+
+// ExpectNoLog checks that catbox logs no line matching the regexp during the
+// window. If it does, we return an error with the line. We also return an
+// error if catbox exits during the window.
+func (c *Catbox) ExpectNoLog(re *regexp.Regexp, window time.Duration) error {
+	return c.Log.ExpectNone(re, c.Log.Len(), window)
+}
+
+// waitForLog waits for a line matching the regexp at or after position from
+// in the log. It reports whether it saw one.
+func waitForLog(r *LogRecorder, re *regexp.Regexp, from int) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, _, err := r.Wait(ctx, re, from)
+	return err == nil
+}
@@ -0,0 +1,517 @@
+package boxcat
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ChannelState is what a client knows about a channel it is on.
+type ChannelState struct {
+	// Name is the channel's name as the server gave it when we joined.
+	Name string
+
+	// Members maps each member's nick to their prefixes, such as "@" for an
+	// operator. The prefixes are ordered highest rank first. A member with no
+	// status has blank prefixes.
+	Members map[string]string
+
+	Topic string
+
+	// TopicSetBy is who set the topic. It may be a nick or a full prefix.
+	TopicSetBy string
+
+	// TopicSetAt is when the topic was set. It is zero if we don't know.
+	TopicSetAt time.Time
+
+	// Modes maps each channel mode that is set to its parameter, if it has
+	// one. For example "n" to "" and "k" to the key. List modes such as bans
+	// and the prefix modes are not included.
+	Modes map[string]string
+
+	// Created is when the channel was created (its TS). It is zero until we
+	// see RPL_CREATIONTIME (329).
+	Created time.Time
+}
+
+// ModeString describes the channel's modes the way servers show them, such
+// as "+kn key". Modes are in alphabetical order.
+func (s ChannelState) ModeString() string {
+	var modes []string
+	for mode := range s.Modes {
+		modes = append(modes, mode)
+	}
+	sort.Strings(modes)
+
+	var params []string
+	for _, mode := range modes {
+		if s.Modes[mode] != "" {
+			params = append(params, s.Modes[mode])
+		}
+	}
+
+	return strings.Join(append([]string{"+" + strings.Join(modes, "")},
+		params...), " ")
+}
+
+// channelTracker follows the state of the channels a client is on.
+type channelTracker struct {
+	// channels holds channels by their case folded name.
+	channels map[string]*trackedChannel
+
+	// prefixModes and prefixSymbols come from ISUPPORT PREFIX. They are in
+	// rank order, highest first. The mode at an index has the symbol at the
+	// same index.
+	prefixModes   string
+	prefixSymbols string
+
+	// The modes in the first three groups of ISUPPORT CHANMODES. listModes
+	// (A) always have a parameter and we don't track them. paramModes (B)
+	// always have a parameter. setParamModes (C) have one only when set. The
+	// other modes never do.
+	listModes     string
+	paramModes    string
+	setParamModes string
+
+	// casemapping is the server's ISUPPORT CASEMAPPING.
+	casemapping string
+
+	mutex *sync.Mutex
+}
+
+// trackedChannel is a channel's state. Unlike ChannelState its members are
+// keyed by case folded nick.
+type trackedChannel struct {
+	state ChannelState
+
+	// members maps case folded nicks to members.
+	members map[string]*channelMember
+
+	// pendingNames holds members from RPL_NAMREPLY (353) until
+	// RPL_ENDOFNAMES (366). It is nil if we are not receiving names.
+	pendingNames map[string]*channelMember
+}
+
+type channelMember struct {
+	nick     string
+	prefixes string
+}
+
+func newChannelTracker() *channelTracker {
+	return &channelTracker{
+		channels: map[string]*trackedChannel{},
+
+		prefixModes:   "ov",
+		prefixSymbols: "@+",
+
+		listModes:     "beI",
+		paramModes:    "k",
+		setParamModes: "l",
+
+		casemapping: "rfc1459",
+
+		mutex: &sync.Mutex{},
+	}
+}
+
+// track updates the state from a message. nick is our nick.
+func (t *channelTracker) track(m TaggedMessage, nick string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	switch m.Command {
+	case "005":
+		t.isupport(m)
+	case "JOIN":
+		if len(m.Params) < 1 {
+			return
+		}
+		if t.isUs(m.SourceNick(), nick) {
+			t.channels[t.fold(m.Params[0])] = &trackedChannel{
+				state: ChannelState{
+					Name:  m.Params[0],
+					Modes: map[string]string{},
+				},
+				members: map[string]*channelMember{},
+			}
+		}
+		if c := t.channel(m.Params[0]); c != nil {
+			c.members[t.fold(m.SourceNick())] = &channelMember{
+				nick: m.SourceNick(),
+			}
+		}
+	case "PART":
+		if len(m.Params) < 1 {
+			return
+		}
+		t.removeMember(m.Params[0], m.SourceNick(), nick)
+	case "KICK":
+		if len(m.Params) < 2 {
+			return
+		}
+		t.removeMember(m.Params[0], m.Params[1], nick)
+	case "QUIT":
+		for _, c := range t.channels {
+			delete(c.members, t.fold(m.SourceNick()))
+		}
+	case "NICK":
+		if len(m.Params) < 1 {
+			return
+		}
+		for _, c := range t.channels {
+			member, ok := c.members[t.fold(m.SourceNick())]
+			if !ok {
+				continue
+			}
+			delete(c.members, t.fold(m.SourceNick()))
+			member.nick = m.Params[0]
+			c.members[t.fold(member.nick)] = member
+		}
+	case "MODE":
+		if len(m.Params) < 2 {
+			return
+		}
+		if c := t.channel(m.Params[0]); c != nil {
+			t.applyModes(c, m.Params[1], m.Params[2:])
+		}
+	case "TOPIC":
+		if len(m.Params) < 2 {
+			return
+		}
+		if c := t.channel(m.Params[0]); c != nil {
+			c.state.Topic = m.Params[1]
+			c.state.TopicSetBy = m.Prefix
+			c.state.TopicSetAt = messageTime(m)
+		}
+	case "332":
+		// RPL_TOPIC: <nick> <channel> :<topic>
+		if len(m.Params) < 3 {
+			return
+		}
+		if c := t.channel(m.Params[1]); c != nil {
+			c.state.Topic = m.Params[2]
+		}
+	case "333":
+		// RPL_TOPICWHOTIME: <nick> <channel> <setter> <time>
+		if len(m.Params) < 4 {
+			return
+		}
+		if c := t.channel(m.Params[1]); c != nil {
+			c.state.TopicSetBy = m.Params[2]
+			c.state.TopicSetAt = parseUnixTime(m.Params[3])
+		}
+	case "324":
+		// RPL_CHANNELMODEIS: <nick> <channel> <modes> [params]
+		if len(m.Params) < 3 {
+			return
+		}
+		if c := t.channel(m.Params[1]); c != nil {
+			c.state.Modes = map[string]string{}
+			t.applyModes(c, m.Params[2], m.Params[3:])
+		}
+	case "329":
+		// RPL_CREATIONTIME: <nick> <channel> <time>
+		if len(m.Params) < 3 {
+			return
+		}
+		if c := t.channel(m.Params[1]); c != nil {
+			c.state.Created = parseUnixTime(m.Params[2])
+		}
+	case "353":
+		// RPL_NAMREPLY: <nick> <type> <channel> :<names>
+		if len(m.Params) < 4 {
+			return
+		}
+		if c := t.channel(m.Params[2]); c != nil {
+			if c.pendingNames == nil {
+				c.pendingNames = map[string]*channelMember{}
+			}
+			for _, name := range strings.Fields(m.Params[3]) {
+				member := t.parseName(name)
+				c.pendingNames[t.fold(member.nick)] = member
+			}
+		}
+	case "366":
+		// RPL_ENDOFNAMES: <nick> <channel> :End of /NAMES list
+		if len(m.Params) < 2 {
+			return
+		}
+		if c := t.channel(m.Params[1]); c != nil && c.pendingNames != nil {
+			c.members = c.pendingNames
+			c.pendingNames = nil
+		}
+	}
+}
+
+// isupport takes the ISUPPORT tokens we care about from RPL_ISUPPORT (005).
+func (t *channelTracker) isupport(m TaggedMessage) {
+	// The first parameter is our nick and the last is human readable text.
+	if len(m.Params) < 3 {
+		return
+	}
+
+	for _, token := range m.Params[1 : len(m.Params)-1] {
+		idx := strings.Index(token, "=")
+		if idx == -1 {
+			continue
+		}
+		key, value := token[:idx], token[idx+1:]
+
+		switch key {
+		case "PREFIX":
+			// For example (ov)@+
+			end := strings.Index(value, ")")
+			if !strings.HasPrefix(value, "(") || end == -1 ||
+				len(value[1:end]) != len(value[end+1:]) {
+				continue
+			}
+			t.prefixModes = value[1:end]
+			t.prefixSymbols = value[end+1:]
+		case "CHANMODES":
+			groups := strings.Split(value, ",")
+			if len(groups) < 4 {
+				continue
+			}
+			t.listModes = groups[0]
+			t.paramModes = groups[1]
+			t.setParamModes = groups[2]
+		case "CASEMAPPING":
+			t.casemapping = value
+		}
+	}
+}
+
+// applyModes applies a mode change such as "+o-k nick key".
+func (t *channelTracker) applyModes(
+	c *trackedChannel,
+	modes string,
+	params []string,
+) {
+	adding := true
+	for _, mode := range modes {
+		if mode == '+' {
+			adding = true
+			continue
+		}
+		if mode == '-' {
+			adding = false
+			continue
+		}
+
+		var param string
+		takesParam := strings.ContainsRune(t.prefixModes, mode) ||
+			strings.ContainsRune(t.listModes, mode) ||
+			strings.ContainsRune(t.paramModes, mode) ||
+			(adding && strings.ContainsRune(t.setParamModes, mode))
+		if takesParam {
+			if len(params) == 0 {
+				continue
+			}
+			param = params[0]
+			params = params[1:]
+		}
+
+		if idx := strings.IndexRune(t.prefixModes, mode); idx != -1 {
+			t.setPrefix(c, param, t.prefixSymbols[idx], adding)
+			continue
+		}
+
+		if strings.ContainsRune(t.listModes, mode) {
+			continue
+		}
+
+		if adding {
+			c.state.Modes[string(mode)] = param
+			continue
+		}
+		delete(c.state.Modes, string(mode))
+	}
+}
+
+// setPrefix adds or removes a status prefix from a member.
+func (t *channelTracker) setPrefix(
+	c *trackedChannel,
+	nick string,
+	symbol byte,
+	adding bool,
+) {
+	member, ok := c.members[t.fold(nick)]
+	if !ok {
+		return
+	}
+
+	if !adding {
+		member.prefixes = strings.Replace(member.prefixes, string(symbol), "", -1)
+		return
+	}
+
+	if strings.IndexByte(member.prefixes, symbol) != -1 {
+		return
+	}
+
+	// Keep the prefixes in rank order.
+	var prefixes []byte
+	for i := 0; i < len(t.prefixSymbols); i++ {
+		s := t.prefixSymbols[i]
+		if s == symbol || strings.IndexByte(member.prefixes, s) != -1 {
+			prefixes = append(prefixes, s)
+		}
+	}
+	member.prefixes = string(prefixes)
+}
+
+// parseName parses a name from RPL_NAMREPLY. It may have several prefixes
+// (multi-prefix) and may be a full nick!user@host (userhost-in-names).
+func (t *channelTracker) parseName(name string) *channelMember {
+	i := 0
+	for i < len(name) && strings.IndexByte(t.prefixSymbols, name[i]) != -1 {
+		i++
+	}
+	prefixes, nick := name[:i], name[i:]
+
+	if idx := strings.Index(nick, "!"); idx != -1 {
+		nick = nick[:idx]
+	}
+
+	// Put them in rank order.
+	var ordered []byte
+	for i := 0; i < len(t.prefixSymbols); i++ {
+		if strings.IndexByte(prefixes, t.prefixSymbols[i]) != -1 {
+			ordered = append(ordered, t.prefixSymbols[i])
+		}
+	}
+	return &channelMember{nick: nick, prefixes: string(ordered)}
+}
+
+// observe starts tracking a channel we're not on. We can then take its state
+// from the replies to NAMES, MODE and TOPIC. If we're already tracking it, we
+// leave it alone.
+func (t *channelTracker) observe(name string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.channel(name) != nil {
+		return
+	}
+
+	t.channels[t.fold(name)] = &trackedChannel{
+		state: ChannelState{
+			Name:  name,
+			Modes: map[string]string{},
+		},
+		members: map[string]*channelMember{},
+	}
+}
+
+// removeMember removes a nick from a channel. If the nick is ours we forget
+// the channel.
+func (t *channelTracker) removeMember(channel, nick, ourNick string) {
+	if t.isUs(nick, ourNick) {
+		delete(t.channels, t.fold(channel))
+		return
+	}
+
+	if c := t.channel(channel); c != nil {
+		delete(c.members, t.fold(nick))
+	}
+}
+
+// channel finds a channel we are on. It returns nil if we're not on it.
+func (t *channelTracker) channel(name string) *trackedChannel {
+	return t.channels[t.fold(name)]
+}
+
+func (t *channelTracker) isUs(nick, ourNick string) bool {
+	return t.fold(nick) == t.fold(ourNick)
+}
+
+// fold case folds a nick or channel name using the server's case mapping.
+func (t *channelTracker) fold(s string) string {
+	return foldCase(s, t.casemapping)
+}
+
+// foldCase lowercases s using the casemapping. rfc1459 treats []\~ as the
+// uppercase forms of {}|^. strict-rfc1459 leaves out ~ and ^. ascii only
+// folds letters.
+func foldCase(s, casemapping string) string {
+	b := []byte(s)
+	for i, c := range b {
+		switch {
+		case c >= 'A' && c <= 'Z':
+			b[i] = c + 'a' - 'A'
+		case casemapping == "ascii":
+		case c == '[':
+			b[i] = '{'
+		case c == ']':
+			b[i] = '}'
+		case c == '\\':
+			b[i] = '|'
+		case c == '~' && casemapping != "strict-rfc1459":
+			b[i] = '^'
+		}
+	}
+	return string(b)
+}
+
+// reset forgets all channels. We do this when we disconnect.
+func (t *channelTracker) reset() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.channels = map[string]*trackedChannel{}
+}
+
+// get retrieves a copy of a channel's state.
+func (t *channelTracker) get(name string) (ChannelState, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	c := t.channel(name)
+	if c == nil {
+		return ChannelState{}, false
+	}
+
+	state := c.state
+	state.Members = map[string]string{}
+	for _, member := range c.members {
+		state.Members[member.nick] = member.prefixes
+	}
+	state.Modes = map[string]string{}
+	for mode, param := range c.state.Modes {
+		state.Modes[mode] = param
+	}
+	return state, true
+}
+
+// names retrieves the names of the channels we're on, sorted.
+func (t *channelTracker) names() []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var names []string
+	for _, c := range t.channels {
+		names = append(names, c.state.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// messageTime is when the server says it sent the message (server-time), or
+// now if it doesn't say.
+func messageTime(m TaggedMessage) time.Time {
+	if v, ok := m.Tag("time"); ok {
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return t
+		}
+	}
+	return time.Now()
+}
+
+func parseUnixTime(s string) time.Time {
+	secs, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(secs, 0)
+}
@@ -0,0 +1,117 @@
+package boxcat
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestChannelTracker(t *testing.T) {
+	tracker := newChannelTracker()
+
+	lines := []string{
+		":irc.example.org 005 client1 PREFIX=(qov)~@+ CHANMODES=beI,k,l,imnpst " +
+			"CASEMAPPING=rfc1459 :are supported by this server",
+		":client1!u@h JOIN #Test",
+		":irc.example.org 353 client1 = #test :@client1 +client2 ~@client[3]",
+		":irc.example.org 366 client1 #test :End of /NAMES list",
+		":irc.example.org 332 client1 #test :old topic",
+		":irc.example.org 333 client1 #test client2 1500000000",
+		":irc.example.org 324 client1 #test +ntkl key 10",
+		":irc.example.org 329 client1 #test 1400000000",
+		":client4!u@h JOIN #test",
+		":client1!u@h MODE #test +o-l+b client4 *!*@bad",
+		":client1!u@h MODE #test -v+q client2 client2",
+		":CLIENT{3}!u@h NICK client5",
+		":client2!u@h PART #test",
+		":client1!u@h KICK #test client5 :bye",
+		":client1!u@h JOIN #other",
+		":client4!u@h QUIT :gone",
+		":client1!u@h TOPIC #test :new topic",
+	}
+
+	for _, line := range lines {
+		m, err := ParseTaggedMessage(line + "\r\n")
+		if err != nil {
+			t.Fatalf("error parsing %q: %s", line, err)
+		}
+		tracker.track(m, "client1")
+	}
+
+	if names := tracker.names(); !reflect.DeepEqual(names,
+		[]string{"#Test", "#other"}) {
+		t.Fatalf("channels = %v", names)
+	}
+
+	state, ok := tracker.get("#TEST")
+	if !ok {
+		t.Fatalf("not on #test")
+	}
+
+	if !reflect.DeepEqual(state.Members, map[string]string{"client1": "@"}) {
+		t.Errorf("members = %v", state.Members)
+	}
+	if state.Topic != "new topic" || state.TopicSetBy != "client1!u@h" {
+		t.Errorf("topic = %q set by %q", state.Topic, state.TopicSetBy)
+	}
+	if !reflect.DeepEqual(state.Modes, map[string]string{"n": "", "t": "",
+		"k": "key"}) {
+		t.Errorf("modes = %v", state.Modes)
+	}
+	if state.ModeString() != "+knt key" {
+		t.Errorf("mode string = %q", state.ModeString())
+	}
+	if !state.Created.Equal(time.Unix(1400000000, 0)) {
+		t.Errorf("created = %s", state.Created)
+	}
+
+	// Check the members at a point where everyone is there.
+	tracker = newChannelTracker()
+	for _, line := range lines[:11] {
+		m, err := ParseTaggedMessage(line + "\r\n")
+		if err != nil {
+			t.Fatalf("error parsing %q: %s", line, err)
+		}
+		tracker.track(m, "client1")
+	}
+	state, _ = tracker.get("#test")
+	want := map[string]string{
+		"client1":   "@",
+		"client2":   "~",
+		"client[3]": "~@",
+		"client4":   "@",
+	}
+	if !reflect.DeepEqual(state.Members, want) {
+		t.Errorf("members = %v, wanted %v", state.Members, want)
+	}
+
+	// Parting forgets the channel, and so does disconnecting.
+	m, _ := ParseTaggedMessage(":client1!u@h PART #test\r\n")
+	tracker.track(m, "client1")
+	if _, ok := tracker.get("#test"); ok {
+		t.Errorf("still on #test after parting")
+	}
+	tracker.reset()
+	if len(tracker.names()) != 0 {
+		t.Errorf("still on channels after reset")
+	}
+}
+
+func TestFoldCase(t *testing.T) {
+	tests := []struct {
+		input       string
+		casemapping string
+		want        string
+	}{
+		{"Nick[]\\~", "rfc1459", "nick{}|^"},
+		{"Nick[]\\~", "strict-rfc1459", "nick{}|~"},
+		{"Nick[]\\~", "ascii", "nick[]\\~"},
+	}
+
+	for _, test := range tests {
+		if got := foldCase(test.input, test.casemapping); got != test.want {
+			t.Errorf("foldCase(%q, %s) = %q, wanted %q", test.input,
+				test.casemapping, got, test.want)
+		}
+	}
+}
@@ -2,9 +2,11 @@ package boxcat
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"fmt"
-	"log"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -19,19 +21,61 @@ type Client struct {
 	serverPort uint16
 
 	writeTimeout time.Duration
-	readTimeout  time.Duration
+
+	// tlsConfig is set if we connect using TLS.
+	tlsConfig *tls.Config
 
 	conn net.Conn
 	rw   *bufio.ReadWriter
 
-	recvChan chan irc.Message
+	recvChan chan TaggedMessage
 	sendChan chan irc.Message
 	errChan  chan error
-	doneChan chan struct{}
 	wg       *sync.WaitGroup
 
-	channels map[string]struct{}
-	mutex    *sync.Mutex
+	// ctx is done when the client stops. cancel stops it.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	inbox *inbox
+
+	// negotiateCaps is true if we negotiate capabilities when registering.
+	negotiateCaps bool
+	requestedCaps []string
+	availableCaps map[string]string
+	enabledCaps   map[string]struct{}
+
+	// nickFallback is how we pick another nick if ours is in use when we
+	// register.
+	nickFallback  NickFallback
+	maxNickLength int
+	nickAttempts  int
+	registered    bool
+
+	// err is set if the connection failed, such as if we could not register.
+	err error
+
+	// sasl is set if we authenticate when registering.
+	sasl       *SASLConfig
+	saslResult *SASLResult
+
+	// channels tracks the channels we're on.
+	channels *channelTracker
+
+	// logger receives the lines we send and receive.
+	logger Logger
+
+	// server is set if a Harness made us. We watch it for crashes.
+	server *Catbox
+
+	// transcript is set if we record the lines we send and receive.
+	transcript     *Transcript
+	transcriptName string
+
+	mutex *sync.Mutex
+
+	// writeMutex serialises writes to the connection.
+	writeMutex *sync.Mutex
 }
 
 // NewClient creates a Client.
@@ -42,18 +86,42 @@ func NewClient(nick, serverHost string, serverPort uint16) *Client {
 		serverPort: serverPort,
 
 		writeTimeout: 30 * time.Second,
-		readTimeout:  100 * time.Millisecond,
 
-		channels: map[string]struct{}{},
-		mutex:    &sync.Mutex{},
+		maxNickLength: defaultMaxNickLength,
+
+		availableCaps: map[string]string{},
+		enabledCaps:   map[string]struct{}{},
+
+		channels:   newChannelTracker(),
+		logger:     StdLogger(),
+		mutex:      &sync.Mutex{},
+		writeMutex: &sync.Mutex{},
 	}
 }
 
+// UseTLS makes the client connect using TLS. Call it before Start.
+//
+// The config controls how we verify the server (RootCAs, InsecureSkipVerify,
+// ServerName for SNI), and whether we present a client certificate
+// (Certificates). If ServerName is not set we use the server's host.
+func (c *Client) UseTLS(config *tls.Config) {
+	c.tlsConfig = config
+}
+
+// SetLogger sets where the client logs the lines it sends and receives. By
+// default we use the standard log package. Call it before Start.
+func (c *Client) SetLogger(l Logger) {
+	c.logger = l
+}
+
 // Start starts a client's connection and registers.
 //
 // The client responds to PING commands.
 //
 // All messages received from the server will be sent on the receive channel.
+// Alternatively, use Expect to wait for particular messages. The messages
+// include their tags. This channel used to carry irc.Message. Use the
+// embedded Message field where you need one.
 //
 // Messages you send to the send channel will be sent to the server.
 //
@@ -62,37 +130,50 @@ func NewClient(nick, serverHost string, serverPort uint16) *Client {
 //
 // The caller must call Stop() to clean up the client.
 func (c *Client) Start() (
-	<-chan irc.Message,
+	<-chan TaggedMessage,
+	chan<- irc.Message,
+	<-chan error,
+	error,
+) {
+	return c.StartContext(context.Background())
+}
+
+// StartContext is like Start except the client's connection lasts only as
+// long as the context. When the context is done we close the connection and
+// the receive channel. If that happens while we register, we give up and
+// return an error.
+//
+// The caller must still call Stop() to clean up the client.
+func (c *Client) StartContext(ctx context.Context) (
+	<-chan TaggedMessage,
 	chan<- irc.Message,
 	<-chan error,
 	error,
 ) {
+	c.ctx, c.cancel = context.WithCancel(ctx)
+	c.wg = &sync.WaitGroup{}
+
 	if err := c.connect(); err != nil {
+		c.cancel()
 		return nil, nil, nil, fmt.Errorf("error connecting: %s", err)
 	}
 
-	if err := c.writeMessage(irc.Message{
-		Command: "NICK",
-		Params:  []string{c.nick},
-	}); err != nil {
-		_ = c.conn.Close()
-		return nil, nil, nil, err
-	}
-
-	if err := c.writeMessage(irc.Message{
-		Command: "USER",
-		Params:  []string{c.nick, "0", "*", c.nick},
-	}); err != nil {
-		_ = c.conn.Close()
+	read, err := c.register()
+	if err != nil {
+		c.cancel()
+		c.wg.Wait()
 		return nil, nil, nil, err
 	}
 
-	c.recvChan = make(chan irc.Message, 512)
+	c.recvChan = make(chan TaggedMessage, 512)
 	c.sendChan = make(chan irc.Message, 512)
 	c.errChan = make(chan error, 512)
-	c.doneChan = make(chan struct{})
 
-	c.wg = &sync.WaitGroup{}
+	for _, m := range read {
+		c.recvChan <- m
+	}
+
+	c.inbox = newInbox(c.recvChan)
 
 	c.wg.Add(1)
 	go c.reader(c.recvChan)
@@ -104,103 +185,232 @@ func (c *Client) Start() (
 }
 
 // connect opens a new connection to the server.
+//
+// Once we're connected we close the connection when the client's context is
+// done. This is how we unblock reads and writes when stopping.
 func (c *Client) connect() error {
 	dialer := &net.Dialer{
 		Timeout:   30 * time.Second,
 		KeepAlive: 30 * time.Second,
 	}
 
-	conn, err := dialer.Dial("tcp", fmt.Sprintf("%s:%d", c.serverHost,
-		c.serverPort))
+	addr := net.JoinHostPort(c.serverHost,
+		strconv.FormatUint(uint64(c.serverPort), 10))
+
+	conn, err := dialer.DialContext(c.ctx, "tcp", addr)
 	if err != nil {
 		return fmt.Errorf("error dialing: %s", err)
 	}
 
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		<-c.ctx.Done()
+		_ = conn.Close()
+	}()
+
+	if c.tlsConfig != nil {
+		config := c.tlsConfig.Clone()
+		if config.ServerName == "" {
+			config.ServerName = c.serverHost
+		}
+
+		tlsConn := tls.Client(conn, config)
+		if err := c.handshake(tlsConn, dialer.Timeout); err != nil {
+			c.cancel()
+			c.wg.Wait()
+			return err
+		}
+		conn = tlsConn
+	}
+
 	c.conn = conn
 	c.rw = bufio.NewReadWriter(bufio.NewReader(c.conn), bufio.NewWriter(c.conn))
 	return nil
 }
 
-func (c Client) reader(recvChan chan<- irc.Message) {
-	defer c.wg.Done()
+// handshake performs the TLS handshake, giving up after the timeout.
+func (c *Client) handshake(conn *tls.Conn, timeout time.Duration) error {
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return fmt.Errorf("unable to set deadline: %s", err)
+	}
 
-	for {
-		select {
-		case <-c.doneChan:
-			close(recvChan)
-			return
-		default:
+	if err := conn.Handshake(); err != nil {
+		return fmt.Errorf("error performing TLS handshake: %s", err)
+	}
+
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return fmt.Errorf("unable to clear deadline: %s", err)
+	}
+	return nil
+}
+
+// register sends the registration commands. If we negotiate capabilities we
+// wait until that's done.
+//
+// We return the messages we read. The caller must pass them on.
+func (c *Client) register() ([]TaggedMessage, error) {
+	if c.negotiateCaps {
+		if err := c.writeMessage(irc.Message{
+			Command: "CAP",
+			Params:  []string{"LS", "302"},
+		}); err != nil {
+			return nil, err
 		}
+	}
 
+	if err := c.writeMessage(irc.Message{
+		Command: "NICK",
+		Params:  []string{c.GetNick()},
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := c.writeMessage(irc.Message{
+		Command: "USER",
+		Params:  []string{c.GetNick(), "0", "*", c.GetNick()},
+	}); err != nil {
+		return nil, err
+	}
+
+	if !c.negotiateCaps {
+		return nil, nil
+	}
+
+	// Reads time out if negotiation takes too long. Afterwards we block until
+	// there is something to read or the connection closes.
+	if err := c.conn.SetReadDeadline(time.Now().Add(capTimeout)); err != nil {
+		return nil, fmt.Errorf("unable to set deadline: %s", err)
+	}
+
+	read, err := c.negotiateCapsOnConnect()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, fmt.Errorf("unable to clear deadline: %s", err)
+	}
+
+	return read, nil
+}
+
+// reader reads messages from the server and sends them on the receive
+// channel. We block on reads with no deadline so that we never abandon a
+// partially read line. When the client stops we close the connection which
+// unblocks us.
+func (c *Client) reader(recvChan chan<- TaggedMessage) {
+	defer c.wg.Done()
+	defer close(recvChan)
+	defer c.channels.reset()
+
+	for {
 		m, err := c.readMessage()
 		if err != nil {
-			// If we time out waiting for a read to succeed, just ignore it and try
-			// again. We want a short timeout on that so we frequently check whether
-			// we should end.
-			//
-			// There's no accessible error variable to compare with
-			if strings.Contains(err.Error(), "i/o timeout") {
-				continue
+			// The read failing because we're stopping is not an error.
+			if c.ctx.Err() == nil {
+				c.errChan <- fmt.Errorf("error reading message: %s", err)
 			}
-
-			c.errChan <- fmt.Errorf("error reading message: %s", err)
-			close(recvChan)
 			return
 		}
 
-		if m.Command == "PING" {
+		if m.Command == "PING" && len(m.Params) > 0 {
 			if err := c.writeMessage(irc.Message{
 				Command: "PONG",
 				Params:  []string{m.Params[0]},
 			}); err != nil {
 				c.errChan <- fmt.Errorf("error sending pong: %s", err)
-				close(recvChan)
 				return
 			}
 		}
 
-		if m.Command == "JOIN" {
-			if m.SourceNick() == c.nick {
-				c.mutex.Lock()
-				c.channels[m.Params[0]] = struct{}{}
-				c.mutex.Unlock()
+		if m.Command == "CAP" {
+			if err := c.handleCap(m); err != nil {
+				c.errChan <- err
+				return
 			}
 		}
 
-		recvChan <- m
+		if err := c.handleRegistrationNick(m); err != nil {
+			c.deliver(recvChan, m)
+			c.fail(fmt.Errorf("error registering: %s", err))
+			return
+		}
+
+		// Track channels before our nick. If our nick changes, the tracker
+		// needs to know our old one.
+		c.channels.track(m, c.GetNick())
+		c.trackNick(m)
+
+		if !c.deliver(recvChan, m) {
+			return
+		}
+	}
+}
+
+// deliver sends the message on the receive channel. It returns false if the
+// client stopped before the message could be sent.
+func (c *Client) deliver(recvChan chan<- TaggedMessage, m TaggedMessage) bool {
+	select {
+	case recvChan <- m:
+		return true
+	case <-c.ctx.Done():
+		return false
 	}
 }
 
-func (c Client) writer(sendChan <-chan irc.Message) {
+func (c *Client) writer(sendChan <-chan irc.Message) {
 	defer c.wg.Done()
 
 LOOP:
 	for {
 		select {
-		case <-c.doneChan:
+		case <-c.ctx.Done():
 			break LOOP
 		case m, ok := <-sendChan:
 			if !ok {
-				break
+				return
 			}
 			if err := c.writeMessage(m); err != nil {
-				c.errChan <- fmt.Errorf("error writing message: %s", err)
-				break
+				if c.ctx.Err() == nil {
+					c.errChan <- fmt.Errorf("error writing message: %s", err)
+				}
+				break LOOP
 			}
 		}
 	}
 
+	// Discard anything else sent so senders don't block. Stop closes the
+	// channel.
 	for range sendChan {
 	}
 }
 
 // writeMessage writes an IRC message to the connection.
-func (c Client) writeMessage(m irc.Message) error {
+func (c *Client) writeMessage(m irc.Message) error {
+	buf, err := m.Encode()
+	if err != nil && err != irc.ErrTruncated {
+		return fmt.Errorf("unable to encode message: %s", err)
+	}
+
+	return c.writeLine(buf)
+}
+
+// writeTaggedMessage writes an IRC message with tags to the connection.
+func (c *Client) writeTaggedMessage(m TaggedMessage) error {
 	buf, err := m.Encode()
 	if err != nil && err != irc.ErrTruncated {
 		return fmt.Errorf("unable to encode message: %s", err)
 	}
 
+	return c.writeLine(buf)
+}
+
+// writeLine writes an encoded message to the connection.
+func (c *Client) writeLine(buf string) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
 	if err := c.conn.SetWriteDeadline(time.Now().Add(
 		c.writeTimeout)); err != nil {
 		return fmt.Errorf("unable to set deadline: %s", err)
@@ -219,39 +429,59 @@ func (c Client) writeMessage(m irc.Message) error {
 		return fmt.Errorf("flush error: %s", err)
 	}
 
-	log.Printf("client %s: sent: %s", c.nick, strings.TrimRight(buf, "\r\n"))
+	logf(c.logger, LevelDebug, "client "+c.GetNick(), "sent: %s",
+		strings.TrimRight(buf, "\r\n"))
+	c.recordLine(Sent, buf)
 	return nil
 }
 
-// readMessage reads a line from the connection and parses it as an IRC message.
-func (c Client) readMessage() (irc.Message, error) {
-	if err := c.conn.SetReadDeadline(time.Now().Add(c.readTimeout)); err != nil {
-		return irc.Message{}, fmt.Errorf("unable to set deadline: %s", err)
-	}
+// isTimeout reports whether the error is due to a read or write deadline
+// passing.
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
 
+// readMessage reads a line from the connection and parses it as an IRC
+// message. The message may have tags.
+func (c *Client) readMessage() (TaggedMessage, error) {
 	line, err := c.rw.ReadString('\n')
 	if err != nil {
-		return irc.Message{}, err
+		return TaggedMessage{}, err
 	}
 
-	log.Printf("client %s: read: %s", c.nick, strings.TrimRight(line, "\r\n"))
+	logf(c.logger, LevelDebug, "client "+c.GetNick(), "read: %s",
+		strings.TrimRight(line, "\r\n"))
+	c.recordLine(Received, line)
 
-	m, err := irc.ParseMessage(line)
+	m, err := ParseTaggedMessage(line)
 	if err != nil && err != irc.ErrTruncated {
-		return irc.Message{}, fmt.Errorf("unable to parse message: %s: %s", line,
+		return TaggedMessage{}, fmt.Errorf("unable to parse message: %s: %s", line,
 			err)
 	}
 
 	return m, nil
 }
 
+// Send sends a message that may have tags to the server. Unlike the send
+// channel, we write the message before returning and report any error.
+//
+// Messages sent this way are not ordered with respect to those on the send
+// channel.
+func (c *Client) Send(m TaggedMessage) error {
+	if c.conn == nil {
+		return fmt.Errorf("client is not started")
+	}
+	return c.writeTaggedMessage(m)
+}
+
 // Stop shuts down the client and cleans up.
 //
 // You must not send any messages on the send channel after calling this
 // function.
 func (c *Client) Stop() {
-	// Tell reader and writer to end.
-	close(c.doneChan)
+	// Tell reader and writer to end. This closes the connection.
+	c.cancel()
 
 	// We won't be sending anything further to writer. Let it clean up.
 	close(c.sendChan)
@@ -263,33 +493,67 @@ func (c *Client) Stop() {
 	// more.
 	close(c.errChan)
 
-	_ = c.conn.Close()
-
 	for range c.recvChan {
 	}
 	for range c.errChan {
 	}
 }
 
-// GetNick retrieves the client's nick.
-func (c Client) GetNick() string { return c.nick }
+// GetNick retrieves the client's nick. If we had to pick another nick when
+// registering, or our nick changed, this is the nick we have now.
+func (c *Client) GetNick() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.nick
+}
+
+// fail records why the connection failed and reports it on the error
+// channel.
+func (c *Client) fail(err error) {
+	c.mutex.Lock()
+	c.err = err
+	c.mutex.Unlock()
+	c.errChan <- err
+}
+
+// Err retrieves the reason the connection failed, if it did. For example, if
+// we could not register.
+func (c *Client) Err() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.err
+}
 
 // GetReceiveChannel retrieves the receive channel.
-func (c Client) GetReceiveChannel() <-chan irc.Message { return c.recvChan }
+func (c *Client) GetReceiveChannel() <-chan TaggedMessage { return c.recvChan }
 
 // GetSendChannel retrieves the send channel.
-func (c Client) GetSendChannel() chan<- irc.Message { return c.sendChan }
+func (c *Client) GetSendChannel() chan<- irc.Message { return c.sendChan }
 
 // GetErrorChannel retrieves the error channel.
-func (c Client) GetErrorChannel() <-chan error { return c.errChan }
-
-// GetChannels retrieves the IRC channels the client is on.
-func (c Client) GetChannels() []string {
-	var channels []string
-	c.mutex.Lock()
-	for k := range c.channels {
-		channels = append(channels, k)
+func (c *Client) GetErrorChannel() <-chan error { return c.errChan }
+
+// GetTLSConnectionState retrieves details about the TLS connection. It
+// returns false if the client is not connected using TLS.
+func (c *Client) GetTLSConnectionState() (tls.ConnectionState, bool) {
+	conn, ok := c.conn.(*tls.Conn)
+	if !ok {
+		return tls.ConnectionState{}, false
 	}
-	c.mutex.Unlock()
-	return channels
+	return conn.ConnectionState(), true
+}
+
+// GetChannels retrieves the IRC channels the client is on, sorted.
+func (c *Client) GetChannels() []string {
+	return c.channels.names()
+}
+
+// GetChannel retrieves the state of a channel the client is on. It returns
+// false if the client is not on it.
+//
+// We follow the channel from JOIN, PART, KICK, QUIT, NICK, MODE and TOPIC
+// messages, as well as the NAMES, TOPIC and MODE replies. To be sure of the
+// members and modes, send NAMES and MODE and wait for the replies first.
+func (c *Client) GetChannel(name string) (ChannelState, bool) {
+	return c.channels.get(name)
 }
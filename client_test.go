@@ -0,0 +1,137 @@
+package boxcat
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Test a line arriving in pieces with a pause between them reaches us whole.
+func TestClientPartialLine(t *testing.T) {
+	server := newTestServer(t)
+	defer server.close()
+
+	client := server.newClient("client1")
+
+	server.serve(
+		server.accept,
+		server.expecting("NICK client1", "USER client1 0 * client1"),
+	)
+
+	if _, _, _, err := client.Start(); err != nil {
+		t.Fatalf("error starting client: %s", err)
+	}
+	defer client.Stop()
+	server.wait()
+
+	_, err := server.conn.Write([]byte(":irc.example.org NOTICE "))
+	if err != nil {
+		t.Fatalf("error writing: %s", err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if err := server.send("client1 :hi there"); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := client.Expect(ctx, AllOf(Command("NOTICE"),
+		Params("client1", "hi there"))); err != nil {
+		t.Fatalf("error waiting for NOTICE: %s", err)
+	}
+}
+
+// Test the client answers PINGs, and that a PING without a parameter doesn't
+// upset it.
+func TestClientPING(t *testing.T) {
+	server := newTestServer(t)
+	defer server.close()
+
+	client := server.newClient("client1")
+
+	server.serve(
+		server.accept,
+		server.expecting("NICK client1", "USER client1 0 * client1"),
+	)
+
+	if _, _, _, err := client.Start(); err != nil {
+		t.Fatalf("error starting client: %s", err)
+	}
+	defer client.Stop()
+	server.wait()
+
+	if err := server.send("PING", "PING :irc.example.org"); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := server.expect("PONG irc.example.org"); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if err := client.Err(); err != nil {
+		t.Fatalf("client failed: %s", err)
+	}
+}
+
+// Test the client's connection ends when its context is done.
+func TestClientStartContext(t *testing.T) {
+	server := newTestServer(t)
+	defer server.close()
+
+	client := server.newClient("client1")
+
+	server.serve(
+		server.accept,
+		server.expecting("NICK client1", "USER client1 0 * client1"),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	recvChan, _, errChan, err := client.StartContext(ctx)
+	if err != nil {
+		t.Fatalf("error starting client: %s", err)
+	}
+	defer client.Stop()
+	server.wait()
+
+	cancel()
+
+	select {
+	case _, ok := <-recvChan:
+		if ok {
+			t.Fatalf("received a message, wanted the channel to close")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the receive channel to close")
+	}
+
+	// Stopping due to the context is not an error.
+	select {
+	case err := <-errChan:
+		t.Fatalf("unexpected error: %s", err)
+	default:
+	}
+}
+
+// Test registration gives up when the context is done.
+func TestClientStartContextRegistering(t *testing.T) {
+	server := newTestServer(t)
+	defer server.close()
+
+	client := server.newClient("client1")
+	client.NegotiateCaps("multi-prefix")
+
+	server.serve(server.accept)
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, _, _, err := client.StartContext(ctx); err == nil {
+		client.Stop()
+		t.Fatalf("expected error registering")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatalf("took too long to give up")
+	}
+	server.wait()
+}
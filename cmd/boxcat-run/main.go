@@ -0,0 +1,82 @@
+// This program runs boxcat scenarios. Each scenario is a script describing
+// catbox servers, links between them, clients, what the clients send and
+// expect, and faults to inject. See boxcat.Scenario for the format.
+//
+// We start fresh servers for each scenario and report whether it passed.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/horgh/boxcat"
+)
+
+func main() {
+	verbose := flag.Bool("verbose", false,
+		"Log IRC traffic, and show server logs and goroutines for scenarios "+
+			"that fail.")
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] <scenario file>...\n",
+			os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if !*verbose {
+		log.SetOutput(ioutil.Discard)
+	}
+
+	passed := 0
+	failed := 0
+	for _, path := range flag.Args() {
+		if err := runScenario(path, *verbose); err != nil {
+			fmt.Printf("FAIL %s\n%s\n", path, err)
+			failed++
+			continue
+		}
+		fmt.Printf("PASS %s\n", path)
+		passed++
+	}
+
+	if err := boxcat.CleanBuilds(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+	}
+
+	fmt.Printf("%d passed, %d failed\n", passed, failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+func runScenario(path string, verbose bool) error {
+	scenario, err := boxcat.ParseScenarioFile(path)
+	if err != nil {
+		return err
+	}
+
+	h := boxcat.NewHarness(nil)
+	defer h.Stop()
+
+	if err := scenario.Run(h); err != nil {
+		if verbose {
+			h.DumpGoroutines(os.Stdout)
+			for _, server := range h.Servers() {
+				fmt.Printf("Log of %s:\n", server.Name)
+				_ = server.Log.Dump(os.Stdout)
+			}
+		}
+		return err
+	}
+
+	return nil
+}
@@ -1,211 +1,151 @@
 // This program is to test behaviour when clients connect and try to use the
 // same nickname at the "same time".
 //
-// I'm writing this because I suspect there is a bug in catbox related to that
+// I wrote this because I suspected there was a bug in catbox related to that
 // as I saw a client connect to 2 servers at once, apparently try the same
-// nick, and then one server exited. Unfortunately I have no logs to see
-// exactly what happened.
+// nick, and then one server exited.
 //
-// What this program will do is repeatedly try to connect to two different
-// servers that are linked together, and try to use the same nick. One will
-// fall back to an alternate one. Repeat until an issue occurs (or doesn't).
+// We start two linked catbox servers and repeatedly connect clients to both
+// that try to use the same nick. Those that lose fall back to an alternate
+// one. We keep this up for a while, then check both servers are still
+// running and that they closed every client's socket.
+//
+// nickcollision_test.go has a shorter version of this as a test.
 package main
 
 import (
-	"bufio"
+	"context"
+	"flag"
 	"fmt"
-	"log"
 	"math/rand"
-	"net"
+	"os"
 	"sync"
 	"time"
 
+	"github.com/horgh/boxcat"
 	"github.com/horgh/irc"
 )
 
 func main() {
-	var wg sync.WaitGroup
-
-	ports := []int{6667, 6668}
-	countPerPort := 50
-	for _, port := range ports {
-		for i := 0; i < countPerPort; i++ {
-			wg.Add(1)
-			go func(port int) {
-				for {
-					if err := client("a", "127.0.0.1", port); err != nil {
-						// If you see this a lot then you may need to bump the
-						// MaxAllowedPreRegisterMessageCount value.
-						log.Printf("client failed: %s", err)
-					}
-				}
-			}(port)
-		}
-	}
+	clients := flag.Int("clients", 50,
+		"Number of clients to keep connecting to each server.")
+	duration := flag.Duration("duration", time.Minute, "How long to run for.")
+	verbose := flag.Bool("verbose", false, "Log IRC traffic.")
 
-	wg.Wait()
-}
+	flag.Parse()
 
-func client(nick, host string, port int) error {
-	conn, rw, err := connect(host, port)
-	if err != nil {
-		return fmt.Errorf("error connecting: %s", err)
+	if err := run(*clients, *duration, *verbose); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
 	}
+	fmt.Printf("OK\n")
+}
 
-	if err := writeMessage(conn, rw, irc.Message{
-		Command: "NICK",
-		Params:  []string{nick},
-	}); err != nil {
-		_ = conn.Close()
-		return fmt.Errorf("error writing NICK: %s", err)
-	}
+func run(clients int, duration time.Duration, verbose bool) error {
+	h := boxcat.NewHarness(nil)
+	defer h.Stop()
+	defer func() {
+		_ = boxcat.CleanBuilds()
+	}()
 
-	if err := writeMessage(conn, rw, irc.Message{
-		Command: "USER",
-		Params:  []string{nick, nick, "0", nick},
-	}); err != nil {
-		_ = conn.Close()
-		return fmt.Errorf("error writing USER: %s", err)
+	if !verbose {
+		h.Logger = boxcat.FilterLogger(h.Logger, boxcat.LevelError)
 	}
 
-	for {
-		m, err := readMessage(conn, rw)
+	var servers []*boxcat.Catbox
+	for _, name := range []string{"irc1.example.org", "irc2.example.org"} {
+		server, err := h.StartServer(boxcat.ServerOptions{Name: name})
 		if err != nil {
-			_ = conn.Close()
-			return fmt.Errorf("error reading: %s", err)
-		}
-
-		if m.Command == "001" {
-			// Stick around for a moment to give other connection a chance to
-			// collide.
-			ms := rand.Int() % 1000
-			sleepTime := time.Duration(ms) * time.Millisecond
-			log.Printf("welcomed with nick %s, waiting %s", nick, sleepTime)
-			time.Sleep(sleepTime)
-			if err := writeMessage(conn, rw, irc.Message{
-				Command: "QUIT",
-				Params:  []string{"bye"},
-			}); err != nil {
-				_ = conn.Close()
-				return fmt.Errorf("error sending QUIT: %s", err)
-			}
-			break
-		}
-
-		if m.Command == "433" {
-			log.Printf("nick %s in use", nick)
-			nick2, err := newNick(nick)
-			if err != nil {
-				return err
-			}
-			nick = nick2
-			if err := writeMessage(conn, rw, irc.Message{
-				Command: "NICK",
-				Params:  []string{nick},
-			}); err != nil {
-				_ = conn.Close()
-				return fmt.Errorf("error writing NICK: %s", err)
-			}
-			continue
-		}
-
-		// A command I hacked into catbox while testing to ensure we hit the case
-		// where we see nick in use during registerUser().
-		if m.Command == "444" {
-			log.Printf("got 444 command")
-			continue
-		}
-
-		if m.Command == "ERROR" {
-			log.Printf("Got error: %s", m)
-			continue
+			return fmt.Errorf("error starting %s: %s", name, err)
 		}
+		servers = append(servers, server)
 	}
 
-	return nil
-}
-
-func connect(host string, port int) (net.Conn, *bufio.ReadWriter, error) {
-	dialer := &net.Dialer{
-		Timeout:   30 * time.Second,
-		KeepAlive: 30 * time.Second,
+	if err := h.Link(servers[0], servers[1]); err != nil {
+		return err
 	}
 
-	conn, err := dialer.Dial("tcp", fmt.Sprintf("%s:%d", host, port))
-	if err != nil {
-		return nil, nil, fmt.Errorf("error dialing: %s", err)
+	var monitors []*boxcat.ResourceMonitor
+	for _, server := range servers {
+		m, err := server.Monitor(time.Second)
+		if err != nil {
+			return fmt.Errorf("error monitoring %s: %s", server.Name, err)
+		}
+		defer m.Stop()
+		monitors = append(monitors, m)
 	}
 
-	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
-
-	return conn, rw, nil
-}
-
-var writeTimeout = 2 * time.Second
-
-func writeMessage(conn net.Conn, rw *bufio.ReadWriter, m irc.Message) error {
-	buf, err := m.Encode()
-	if err != nil && err != irc.ErrTruncated {
-		return fmt.Errorf("unable to encode message: %s", err)
-	}
+	ctx, cancel := context.WithTimeout(context.Background(), duration)
+	defer cancel()
 
-	if err := conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
-		return fmt.Errorf("unable to set deadline: %s", err)
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		for i := 0; i < clients; i++ {
+			wg.Add(1)
+			go func(server *boxcat.Catbox) {
+				defer wg.Done()
+				for ctx.Err() == nil {
+					if err := client(ctx, h, server, "a"); err != nil &&
+						ctx.Err() == nil {
+						fmt.Printf("%s: client failed: %s\n", server.Name, err)
+					}
+				}
+			}(server)
+		}
 	}
+	wg.Wait()
 
-	sz, err := rw.WriteString(buf)
-	if err != nil {
-		return err
+	if exit, ok := h.Crashed(); ok {
+		return fmt.Errorf("%s", exit)
 	}
 
-	if sz != len(buf) {
-		return fmt.Errorf("short write")
-	}
+	// Every client is gone, so the servers should be back to the sockets they
+	// started with.
+	waitCtx, waitCancel := context.WithTimeout(context.Background(),
+		10*time.Second)
+	defer waitCancel()
 
-	if err := rw.Flush(); err != nil {
-		return fmt.Errorf("flush error: %s", err)
+	for i, m := range monitors {
+		fmt.Printf("%s: baseline %s, peak %s\n", servers[i].Name, m.Baseline(),
+			m.Peak())
+		if err := m.WaitForBaselineFDs(waitCtx); err != nil {
+			return fmt.Errorf("%s: %s", servers[i].Name, err)
+		}
 	}
 
 	return nil
 }
 
-var readTimeout = 2 * time.Second
-
-func readMessage(conn net.Conn, rw *bufio.ReadWriter) (irc.Message, error) {
-	if err := conn.SetReadDeadline(time.Now().Add(readTimeout)); err != nil {
-		return irc.Message{}, fmt.Errorf("unable to set deadline: %s", err)
-	}
+// client connects, registers, stays a moment to give clients on the other
+// server a chance to collide, and quits.
+func client(
+	ctx context.Context,
+	h *boxcat.Harness,
+	server *boxcat.Catbox,
+	nick string,
+) error {
+	c := h.NewClient(nick, server)
+	c.SetNickFallback(boxcat.NickIncrement, 0)
 
-	line, err := rw.ReadString('\n')
-	if err != nil {
-		return irc.Message{}, err
-	}
+	startCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
 
-	m, err := irc.ParseMessage(line)
-	if err != nil && err != irc.ErrTruncated {
-		return irc.Message{}, fmt.Errorf("unable to parse message: %s: %s", line,
-			err)
+	if _, _, _, err := c.StartContext(startCtx); err != nil {
+		return fmt.Errorf("error starting client: %s", err)
 	}
+	defer c.Stop()
 
-	return m, nil
-}
-
-const maxNickLen = 15
-
-func newNick(oldNick string) (string, error) {
-	if len(oldNick) < maxNickLen {
-		return oldNick + "a", nil
+	if _, err := c.Expect(startCtx,
+		boxcat.Command(irc.ReplyWelcome)); err != nil {
+		return err
 	}
 
-	for i := 0; i < maxNickLen; i++ {
-		if oldNick[i] < 'z' {
-			newNick := oldNick[0:i] + string(oldNick[i]+1)
-			if i < maxNickLen-1 {
-				newNick += oldNick[i+1:]
-			}
-			return newNick, nil
-		}
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Duration(rand.Intn(1000)) * time.Millisecond):
 	}
 
-	return "", fmt.Errorf("exhausted nicks")
+	return c.Send(boxcat.TaggedMessage{
+		Message: irc.Message{Command: "QUIT", Params: []string{"bye"}},
+	})
 }
@@ -0,0 +1,299 @@
+package boxcat
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CatboxConfig holds a catbox's configuration.
+//
+// We render it into catbox.conf along with opers.conf, users.conf, and
+// servers.conf. Fields left at their zero value are not written, so catbox
+// uses its default for them.
+//
+// You may change a running catbox's config and call Catbox.Rehash to apply
+// it.
+type CatboxConfig struct {
+	// ServerName is the server's name. For example irc.example.org.
+	ServerName string
+
+	// ServerInfo is the server's description.
+	ServerInfo string
+
+	// ListenHost is the address to listen on. The harness passes the
+	// listener for the plaintext port, so this only affects the TLS port.
+	ListenHost string
+
+	// ListenPortTLS is the port to listen for TLS connections on.
+	ListenPortTLS uint16
+
+	// CertificateFile and KeyFile are the TLS certificate and key. They are
+	// needed if ListenPortTLS is set.
+	CertificateFile string
+	KeyFile         string
+
+	// CertificatePEM and KeyPEM hold a TLS certificate and key. If they are
+	// set, we write them into the config directory and use them instead of
+	// CertificateFile and KeyFile.
+	CertificatePEM []byte
+	KeyPEM         []byte
+
+	Version     string
+	CreatedDate string
+	AdminEmail  string
+
+	// MOTD is the message of the day.
+	MOTD string
+
+	MaxNickLength int
+
+	// PingTime is how long a connection may be idle before we ping it.
+	PingTime time.Duration
+
+	// DeadTime is how long a connection may be idle before we drop it.
+	DeadTime time.Duration
+
+	// ConnectAttemptTime is how often to try to connect to servers we should
+	// be linked to.
+	ConnectAttemptTime time.Duration
+
+	// TS6SID is the server's TS6 ID.
+	TS6SID string
+
+	// Opers maps an operator name to their password. It becomes opers.conf.
+	Opers map[string]string
+
+	// Users holds per user settings. It becomes users.conf.
+	Users []UserConfig
+
+	// Servers are the servers we link to. It becomes servers.conf.
+	Servers []ServerLink
+
+	// Extra holds catbox.conf options not covered by other fields. Keys are
+	// option names.
+	Extra map[string]string
+}
+
+// UserConfig holds settings for users matching a mask.
+type UserConfig struct {
+	// Mask is a user@host mask. It may contain wildcards.
+	Mask string
+
+	// SpoofHost is a hostname to show instead of the real one.
+	SpoofHost string
+
+	// FloodExempt means catbox does not apply flood control to the user.
+	// This is the only flood setting catbox has. Its limits are built in.
+	FloodExempt bool
+}
+
+// ServerLink describes a server to link with.
+type ServerLink struct {
+	Name     string
+	Host     string
+	Port     uint16
+	Password string
+	TLS      bool
+}
+
+// NewCatboxConfig creates the default config we use for a server with the
+// given name.
+func NewCatboxConfig(name string) *CatboxConfig {
+	return &CatboxConfig{
+		ServerName:         name,
+		ConnectAttemptTime: 100 * time.Millisecond,
+	}
+}
+
+// Render writes catbox.conf, opers.conf, users.conf, and servers.conf into the
+// directory. It returns the path to catbox.conf.
+func (c *CatboxConfig) Render(dir string) (string, error) {
+	opersConf := filepath.Join(dir, "opers.conf")
+	if err := writeConfigFile(opersConf, c.opersConf()); err != nil {
+		return "", err
+	}
+
+	usersConf := filepath.Join(dir, "users.conf")
+	if err := writeConfigFile(usersConf, c.usersConf()); err != nil {
+		return "", err
+	}
+
+	serversConf := filepath.Join(dir, "servers.conf")
+	if err := writeConfigFile(serversConf, c.serversConf()); err != nil {
+		return "", err
+	}
+
+	certificateFile, keyFile := c.CertificateFile, c.KeyFile
+	if len(c.CertificatePEM) > 0 {
+		certificateFile = filepath.Join(dir, "certificate.pem")
+		if err := writeConfigFile(certificateFile,
+			string(c.CertificatePEM)); err != nil {
+			return "", err
+		}
+	}
+	if len(c.KeyPEM) > 0 {
+		keyFile = filepath.Join(dir, "key.pem")
+		if err := writeConfigFile(keyFile, string(c.KeyPEM)); err != nil {
+			return "", err
+		}
+	}
+
+	conf := filepath.Join(dir, "catbox.conf")
+	if err := writeConfigFile(conf, c.catboxConf(certificateFile, keyFile,
+		opersConf, usersConf, serversConf)); err != nil {
+		return "", err
+	}
+
+	return conf, nil
+}
+
+// catboxConf renders catbox.conf.
+func (c *CatboxConfig) catboxConf(certificateFile, keyFile, opersConf,
+	usersConf, serversConf string) string {
+	var lines []string
+	add := func(key, value string) {
+		if value == "" {
+			return
+		}
+		lines = append(lines, fmt.Sprintf("%s = %s", key, value))
+	}
+	addInt := func(key string, value int) {
+		if value == 0 {
+			return
+		}
+		add(key, fmt.Sprintf("%d", value))
+	}
+	addDuration := func(key string, value time.Duration) {
+		if value == 0 {
+			return
+		}
+		add(key, value.String())
+	}
+
+	// -1 because we pass in the listener's fd.
+	add("listen-port", "-1")
+	add("listen-host", c.ListenHost)
+	addInt("listen-port-tls", int(c.ListenPortTLS))
+	add("certificate-file", certificateFile)
+	add("key-file", keyFile)
+	add("server-name", c.ServerName)
+	add("server-info", c.ServerInfo)
+	add("version", c.Version)
+	add("created-date", c.CreatedDate)
+	add("admin-email", c.AdminEmail)
+	add("motd", c.MOTD)
+	addInt("max-nick-length", c.MaxNickLength)
+	addDuration("ping-time", c.PingTime)
+	addDuration("dead-time", c.DeadTime)
+	addDuration("connect-attempt-time", c.ConnectAttemptTime)
+	add("ts6-sid", c.TS6SID)
+	add("opers-config", opersConf)
+	add("users-config", usersConf)
+	add("servers-config", serversConf)
+
+	for _, key := range sortedKeys(c.Extra) {
+		add(key, c.Extra[key])
+	}
+
+	return joinLines(lines)
+}
+
+// opersConf renders opers.conf. Each line is: name = password
+func (c *CatboxConfig) opersConf() string {
+	var lines []string
+	for _, name := range sortedKeys(c.Opers) {
+		lines = append(lines, fmt.Sprintf("%s = %s", name, c.Opers[name]))
+	}
+	return joinLines(lines)
+}
+
+// usersConf renders users.conf. Each line is:
+// mask = spoof host,flood exempt (0 or 1)
+func (c *CatboxConfig) usersConf() string {
+	var lines []string
+	for _, u := range c.Users {
+		lines = append(lines, fmt.Sprintf("%s = %s,%s", u.Mask, u.SpoofHost,
+			boolFlag(u.FloodExempt)))
+	}
+	return joinLines(lines)
+}
+
+// serversConf renders servers.conf. Each line is:
+// name = host,port,password,tls (0 or 1)
+func (c *CatboxConfig) serversConf() string {
+	var lines []string
+	for _, s := range c.Servers {
+		lines = append(lines, fmt.Sprintf("%s = %s,%d,%s,%s", s.Name, s.Host,
+			s.Port, s.Password, boolFlag(s.TLS)))
+	}
+	return joinLines(lines)
+}
+
+// AddServer adds a server to link with. If there is already one with the same
+// name, we replace it.
+func (c *CatboxConfig) AddServer(link ServerLink) {
+	for i := range c.Servers {
+		if c.Servers[i].Name == link.Name {
+			c.Servers[i] = link
+			return
+		}
+	}
+	c.Servers = append(c.Servers, link)
+}
+
+// Clone creates a deep copy of the config.
+func (c *CatboxConfig) Clone() *CatboxConfig {
+	clone := *c
+
+	clone.Opers = map[string]string{}
+	for k, v := range c.Opers {
+		clone.Opers[k] = v
+	}
+
+	clone.CertificatePEM = append([]byte(nil), c.CertificatePEM...)
+	clone.KeyPEM = append([]byte(nil), c.KeyPEM...)
+	clone.Users = append([]UserConfig(nil), c.Users...)
+	clone.Servers = append([]ServerLink(nil), c.Servers...)
+
+	clone.Extra = map[string]string{}
+	for k, v := range c.Extra {
+		clone.Extra[k] = v
+	}
+
+	return &clone
+}
+
+// joinLines joins lines into a file's content.
+func joinLines(lines []string) string {
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func writeConfigFile(file, content string) error {
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		return fmt.Errorf("error writing config: %s: %s", file, err)
+	}
+	return nil
+}
+
+func boolFlag(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
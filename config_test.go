@@ -0,0 +1,178 @@
+package boxcat
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+func TestCatboxConfigRender(t *testing.T) {
+	dir := tempDir(t)
+
+	config := NewCatboxConfig("irc.example.org")
+	config.MOTD = "hello there"
+	config.MaxNickLength = 12
+	config.PingTime = 30 * time.Second
+	config.Opers = map[string]string{"will": "secret", "alice": "hunter2"}
+	config.Users = []UserConfig{
+		{Mask: "*@127.0.0.1", FloodExempt: true},
+		{Mask: "alice@*", SpoofHost: "alice.example.org"},
+	}
+	config.AddServer(ServerLink{Name: "irc2.example.org", Host: "127.0.0.1",
+		Port: 7000, Password: "testing"})
+	config.AddServer(ServerLink{Name: "irc2.example.org", Host: "127.0.0.1",
+		Port: 7001, Password: "testing"})
+	config.Extra = map[string]string{"wakeup-time": "1s"}
+
+	conf, err := config.Render(dir)
+	if err != nil {
+		t.Fatalf("error rendering: %s", err)
+	}
+
+	// testdata holds users.conf and servers.conf in the formats catbox reads.
+	// TestConfigUsers checks catbox accepts our users.conf.
+	knownGood := func(name string) string {
+		buf, err := ioutil.ReadFile(filepath.Join("testdata", "config", name))
+		if err != nil {
+			t.Fatalf("error reading %s: %s", name, err)
+		}
+		return string(buf)
+	}
+
+	tests := []struct {
+		file string
+		want string
+	}{
+		{
+			filepath.Join(dir, "catbox.conf"),
+			`listen-port = -1
+server-name = irc.example.org
+motd = hello there
+max-nick-length = 12
+ping-time = 30s
+connect-attempt-time = 100ms
+opers-config = ` + filepath.Join(dir, "opers.conf") + `
+users-config = ` + filepath.Join(dir, "users.conf") + `
+servers-config = ` + filepath.Join(dir, "servers.conf") + `
+wakeup-time = 1s
+`,
+		},
+		{
+			filepath.Join(dir, "opers.conf"),
+			"alice = hunter2\nwill = secret\n",
+		},
+		{
+			filepath.Join(dir, "users.conf"),
+			knownGood("users.conf"),
+		},
+		{
+			filepath.Join(dir, "servers.conf"),
+			knownGood("servers.conf"),
+		},
+	}
+
+	if conf != tests[0].file {
+		t.Errorf("conf = %s, wanted %s", conf, tests[0].file)
+	}
+
+	for _, test := range tests {
+		buf, err := ioutil.ReadFile(test.file)
+		if err != nil {
+			t.Fatalf("error reading %s: %s", test.file, err)
+		}
+		if string(buf) != test.want {
+			t.Errorf("%s = %q, wanted %q", test.file, buf, test.want)
+		}
+	}
+
+	// Changing a clone leaves the original alone.
+	clone := config.Clone()
+	clone.Opers["bob"] = "pass"
+	clone.Servers[0].Port = 7002
+	if _, ok := config.Opers["bob"]; ok || config.Servers[0].Port != 7001 {
+		t.Errorf("changing clone changed original")
+	}
+}
+
+// Test a server uses a MOTD from its config.
+func TestConfigMOTD(t *testing.T) {
+	t.Parallel()
+
+	h := NewHarness(t)
+
+	config := NewCatboxConfig("irc.example.org")
+	config.MOTD = "welcome to the boxcat test server"
+
+	catbox, err := h.StartServer(ServerOptions{
+		Name:   "irc.example.org",
+		Config: config,
+	})
+	if err != nil {
+		t.Fatalf("error harnessing catbox: %s", err)
+	}
+
+	client := h.NewClient("client1", catbox)
+	if _, _, _, err := client.Start(); err != nil {
+		t.Fatalf("error starting client: %s", err)
+	}
+	defer client.Stop()
+
+	expect(t, client, Command(irc.ReplyWelcome))
+	expect(t, client, AllOf(
+		Command("372"),
+		ParamRE(1, regexp.MustCompile(`welcome to the boxcat test server`)),
+	))
+}
+
+// Test catbox accepts the users.conf we write: a matching user gets its spoof
+// and is exempt from flood control.
+func TestConfigUsers(t *testing.T) {
+	t.Parallel()
+
+	h := NewHarness(t)
+
+	config := NewCatboxConfig("irc.example.org")
+	config.Users = []UserConfig{{
+		Mask:        "*@127.0.0.1",
+		SpoofHost:   "spoofed.example.org",
+		FloodExempt: true,
+	}}
+
+	catbox, err := h.StartServer(ServerOptions{
+		Name:   "irc.example.org",
+		Config: config,
+	})
+	if err != nil {
+		t.Fatalf("error harnessing catbox: %s", err)
+	}
+
+	client := h.NewClient("client1", catbox)
+	if _, _, _, err := client.Start(); err != nil {
+		t.Fatalf("error starting client: %s", err)
+	}
+	defer client.Stop()
+
+	expect(t, client, Command(irc.ReplyWelcome))
+
+	if err := client.Send(msg("JOIN", "#test")); err != nil {
+		t.Fatalf("error sending: %s", err)
+	}
+	expect(t, client, AllOf(
+		Command("JOIN"),
+		Prefix("client1!*@spoofed.example.org"),
+	))
+
+	// Without the exemption, a burst like this trips flood control.
+	for i := 0; i < 100; i++ {
+		if err := client.Send(msg("PRIVMSG", "client1",
+			fmt.Sprintf("%d", i))); err != nil {
+			t.Fatalf("error sending: %s", err)
+		}
+	}
+	expect(t, client, AllOf(Command("PRIVMSG"), Param(1, "99")))
+}
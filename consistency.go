@@ -0,0 +1,390 @@
+package boxcat
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// ServerSnapshot is what an observer connected to a server saw.
+type ServerSnapshot struct {
+	// Server is the server's name.
+	Server string
+
+	// Channels holds the state of each channel we looked at. Channels that
+	// don't exist have no members.
+	Channels map[string]ChannelState
+
+	// Users holds the nicks WHO told us about, sorted.
+	Users []string
+
+	// UserCount and ServerCount come from LUSERS (251).
+	UserCount   int
+	ServerCount int
+}
+
+// Divergence is a way the servers disagree.
+type Divergence struct {
+	// Channel is the channel they disagree about. It is blank if they
+	// disagree about the network, such as the number of users.
+	Channel string
+
+	// Field is what they disagree about, such as "members" or "modes".
+	Field string
+
+	// Values maps each server's name to what it says.
+	Values map[string]string
+}
+
+func (d Divergence) String() string {
+	subject := d.Field
+	if d.Channel != "" {
+		subject = d.Channel + " " + d.Field
+	}
+
+	var servers []string
+	for server := range d.Values {
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+
+	lines := []string{subject + ":"}
+	for _, server := range servers {
+		lines = append(lines, fmt.Sprintf("  %s: %s", server, d.Values[server]))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ConsistencyReport is the result of checking servers agree on the state of
+// the network.
+type ConsistencyReport struct {
+	Snapshots   []ServerSnapshot
+	Divergences []Divergence
+}
+
+// OK reports whether every server agrees.
+func (r *ConsistencyReport) OK() bool {
+	return len(r.Divergences) == 0
+}
+
+func (r *ConsistencyReport) String() string {
+	if r.OK() {
+		return fmt.Sprintf("%d servers agree", len(r.Snapshots))
+	}
+
+	var diffs []string
+	for _, d := range r.Divergences {
+		diffs = append(diffs, d.String())
+	}
+	return fmt.Sprintf("%d servers disagree:\n%s", len(r.Snapshots),
+		strings.Join(diffs, "\n"))
+}
+
+// CheckConsistency checks the servers agree on the state of the network.
+//
+// We connect an observer client to each server and ask about each of the
+// channels (NAMES, MODE, TOPIC) and about users (LUSERS, WHO). We then
+// compare what each server told us. The observers don't join the channels.
+// This means we can't see into secret channels, and some servers hide
+// channel keys from non-members.
+//
+// We return an error if we could not gather the state. Disagreement is in
+// the report.
+func CheckConsistency(
+	ctx context.Context,
+	servers []*Catbox,
+	channels ...string,
+) (*ConsistencyReport, error) {
+	return consistencyReport(ctx, servers,
+		func(nick string, server *Catbox) *Client {
+			return NewClient(nick, "127.0.0.1", server.Port)
+		}, channels)
+}
+
+// consistencyReport checks the servers agree. We create the observers with
+// newClient.
+func consistencyReport(
+	ctx context.Context,
+	servers []*Catbox,
+	newClient func(nick string, server *Catbox) *Client,
+	channels []string,
+) (*ConsistencyReport, error) {
+	// Connect every observer before asking anything. Otherwise the observers
+	// would count differently as users.
+	//
+	// Once the first observer is connected we ask how many users there are.
+	// The other observers add to that.
+	var observers []*Client
+	baseline := 0
+	defer func() {
+		for _, o := range observers {
+			o.Stop()
+		}
+	}()
+
+	for i, server := range servers {
+		o := newClient(fmt.Sprintf("obs%d", i), server)
+		o.SetNickFallback(NickIncrement, 0)
+		if _, _, _, err := o.StartContext(ctx); err != nil {
+			return nil, fmt.Errorf("error connecting observer to %s: %s",
+				server.Name, err)
+		}
+		observers = append(observers, o)
+
+		// Wait for the end of the MOTD so we know we have seen ISUPPORT.
+		if _, err := o.Expect(ctx, AnyOf(Command("376"),
+			Command("422"))); err != nil {
+			return nil, fmt.Errorf("error waiting for observer on %s: %s",
+				server.Name, err)
+		}
+
+		if i == 0 {
+			users, _, err := lusers(ctx, o)
+			if err != nil {
+				return nil, fmt.Errorf("error counting users on %s: %s",
+					server.Name, err)
+			}
+			baseline = users
+		}
+	}
+
+	// Wait for each server to see every observer. This way they all count the
+	// same users. Waiting for only as many users as observers would not be
+	// enough if there are other users.
+	for i, o := range observers {
+		if err := waitForUsers(ctx, o,
+			baseline+len(observers)-1); err != nil {
+			return nil, fmt.Errorf("error waiting for users on %s: %s",
+				servers[i].Name, err)
+		}
+	}
+
+	report := &ConsistencyReport{}
+	for i, o := range observers {
+		snapshot, err := snapshotServer(ctx, o, channels)
+		if err != nil {
+			return nil, fmt.Errorf("error observing %s: %s", servers[i].Name, err)
+		}
+		snapshot.Server = servers[i].Name
+		report.Snapshots = append(report.Snapshots, snapshot)
+	}
+
+	report.Divergences = compareSnapshots(report.Snapshots, channels)
+	return report, nil
+}
+
+// CheckConsistency checks the Harness's servers agree on the state of the
+// network. See CheckConsistency. The observers come from NewClient, so we
+// give up as soon as one of their servers crashes.
+func (h *Harness) CheckConsistency(
+	ctx context.Context,
+	channels ...string,
+) (*ConsistencyReport, error) {
+	return consistencyReport(ctx, h.Servers(), h.NewClient, channels)
+}
+
+// lusersRE matches RPL_LUSERCLIENT (251). catbox uses the RFC 2812 form,
+// "There are <n> users and <n> services on <n> servers". The RFC 1459 form
+// has invisible users in place of services and does not count them as users.
+var lusersRE = regexp.MustCompile(
+	`^There are (\d+) users and (\d+) (services|invisible) on (\d+) servers\.?$`)
+
+// lusers asks for LUSERS and returns the number of users and servers.
+func lusers(ctx context.Context, o *Client) (int, int, error) {
+	if err := o.Send(TaggedMessage{
+		Message: irc.Message{Command: "LUSERS"},
+	}); err != nil {
+		return 0, 0, err
+	}
+
+	m, err := o.Expect(ctx, Command("251"))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	users, servers, err := parseLusers(lastParam(m))
+	if err != nil {
+		return 0, 0, fmt.Errorf("unexpected LUSERS reply: %s", m)
+	}
+	return users, servers, nil
+}
+
+// parseLusers parses the text of RPL_LUSERCLIENT. It returns the number of
+// users and servers. Services are not users, but invisible users are.
+func parseLusers(text string) (int, int, error) {
+	matches := lusersRE.FindStringSubmatch(text)
+	if matches == nil {
+		return 0, 0, fmt.Errorf("malformed RPL_LUSERCLIENT: %s", text)
+	}
+
+	users, _ := strconv.Atoi(matches[1])
+	if matches[3] == "invisible" {
+		invisible, _ := strconv.Atoi(matches[2])
+		users += invisible
+	}
+	servers, _ := strconv.Atoi(matches[4])
+	return users, servers, nil
+}
+
+// waitForUsers waits until the server counts at least n users.
+func waitForUsers(ctx context.Context, o *Client, n int) error {
+	for {
+		users, _, err := lusers(ctx, o)
+		if err != nil {
+			return err
+		}
+		if users >= n {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("server counts %d users, wanted %d: %s", users, n,
+				ctx.Err())
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// snapshotServer gathers the state the observer's server knows.
+func snapshotServer(
+	ctx context.Context,
+	o *Client,
+	channels []string,
+) (ServerSnapshot, error) {
+	snapshot := ServerSnapshot{Channels: map[string]ChannelState{}}
+
+	for _, channel := range channels {
+		o.channels.observe(channel)
+
+		// The replies arrive in order. Once we see the end of NAMES, the
+		// tracker has seen the MODE and TOPIC replies too.
+		for _, command := range []string{"MODE", "TOPIC", "NAMES"} {
+			if err := o.Send(TaggedMessage{Message: irc.Message{
+				Command: command,
+				Params:  []string{channel},
+			}}); err != nil {
+				return ServerSnapshot{}, err
+			}
+		}
+
+		if _, err := o.Expect(ctx, AllOf(Command("366"),
+			Param(1, channel))); err != nil {
+			return ServerSnapshot{}, err
+		}
+
+		state, _ := o.GetChannel(channel)
+		snapshot.Channels[channel] = state
+	}
+
+	users, servers, err := lusers(ctx, o)
+	if err != nil {
+		return ServerSnapshot{}, err
+	}
+	snapshot.UserCount = users
+	snapshot.ServerCount = servers
+
+	if err := o.Send(TaggedMessage{Message: irc.Message{
+		Command: "WHO",
+		Params:  []string{"*"},
+	}}); err != nil {
+		return ServerSnapshot{}, err
+	}
+
+	for {
+		// RPL_WHOREPLY: <nick> <channel> <user> <host> <server> <nick> ...
+		m, err := o.Expect(ctx, AnyOf(Command("352"), Command("315"),
+			AllOf(Command("421"), Param(1, "WHO"))))
+		if err != nil {
+			return ServerSnapshot{}, err
+		}
+		if m.Command != "352" {
+			break
+		}
+		if len(m.Params) > 5 {
+			snapshot.Users = append(snapshot.Users, m.Params[5])
+		}
+	}
+	sort.Strings(snapshot.Users)
+
+	return snapshot, nil
+}
+
+// compareSnapshots finds where the snapshots differ.
+func compareSnapshots(
+	snapshots []ServerSnapshot,
+	channels []string,
+) []Divergence {
+	var divergences []Divergence
+
+	compare := func(channel, field string, value func(ServerSnapshot) string) {
+		values := map[string]string{}
+		differ := false
+		for _, s := range snapshots {
+			values[s.Server] = value(s)
+			if values[s.Server] != values[snapshots[0].Server] {
+				differ = true
+			}
+		}
+		if differ {
+			divergences = append(divergences, Divergence{
+				Channel: channel,
+				Field:   field,
+				Values:  values,
+			})
+		}
+	}
+
+	for _, channel := range channels {
+		state := func(s ServerSnapshot) ChannelState { return s.Channels[channel] }
+
+		compare(channel, "members", func(s ServerSnapshot) string {
+			return describeMembers(state(s).Members)
+		})
+		compare(channel, "modes", func(s ServerSnapshot) string {
+			return state(s).ModeString()
+		})
+		compare(channel, "topic", func(s ServerSnapshot) string {
+			return state(s).Topic
+		})
+		compare(channel, "created", func(s ServerSnapshot) string {
+			if state(s).Created.IsZero() {
+				return "unknown"
+			}
+			return strconv.FormatInt(state(s).Created.Unix(), 10)
+		})
+	}
+
+	compare("", "users", func(s ServerSnapshot) string {
+		return strings.Join(s.Users, " ")
+	})
+	compare("", "user count", func(s ServerSnapshot) string {
+		return strconv.Itoa(s.UserCount)
+	})
+	compare("", "server count", func(s ServerSnapshot) string {
+		return strconv.Itoa(s.ServerCount)
+	})
+
+	return divergences
+}
+
+// describeMembers lists the members with their prefixes, sorted by nick.
+func describeMembers(members map[string]string) string {
+	var nicks []string
+	for nick := range members {
+		nicks = append(nicks, nick)
+	}
+	sort.Strings(nicks)
+
+	var names []string
+	for _, nick := range nicks {
+		names = append(names, members[nick]+nick)
+	}
+	return strings.Join(names, " ")
+}
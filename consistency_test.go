@@ -0,0 +1,104 @@
+package boxcat
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCompareSnapshots(t *testing.T) {
+	snapshot := func(server, topic string, members map[string]string,
+		users []string) ServerSnapshot {
+		return ServerSnapshot{
+			Server: server,
+			Channels: map[string]ChannelState{
+				"#test": {
+					Name:    "#test",
+					Members: members,
+					Topic:   topic,
+					Modes:   map[string]string{"n": "", "t": ""},
+					Created: time.Unix(1500000000, 0),
+				},
+			},
+			Users:       users,
+			UserCount:   len(users),
+			ServerCount: 2,
+		}
+	}
+
+	agree := []ServerSnapshot{
+		snapshot("irc1.example.org", "hi", map[string]string{"a": "@", "b": ""},
+			[]string{"a", "b"}),
+		snapshot("irc2.example.org", "hi", map[string]string{"b": "", "a": "@"},
+			[]string{"a", "b"}),
+	}
+	if d := compareSnapshots(agree, []string{"#test"}); len(d) != 0 {
+		t.Fatalf("unexpected divergences: %v", d)
+	}
+
+	disagree := []ServerSnapshot{
+		snapshot("irc1.example.org", "hi", map[string]string{"a": "@", "b": ""},
+			[]string{"a", "b"}),
+		snapshot("irc2.example.org", "bye", map[string]string{"a": ""},
+			[]string{"a"}),
+	}
+	divergences := compareSnapshots(disagree, []string{"#test"})
+
+	fields := map[string]Divergence{}
+	for _, d := range divergences {
+		fields[d.Channel+" "+d.Field] = d
+	}
+	for _, field := range []string{"#test members", "#test topic", " users",
+		" user count"} {
+		if _, ok := fields[field]; !ok {
+			t.Errorf("missing divergence %q in %v", field, divergences)
+		}
+	}
+	if len(divergences) != 4 {
+		t.Errorf("got %d divergences, wanted 4: %v", len(divergences),
+			divergences)
+	}
+
+	d := fields["#test members"]
+	if d.Values["irc1.example.org"] != "@a b" ||
+		d.Values["irc2.example.org"] != "a" {
+		t.Errorf("unexpected members divergence: %v", d.Values)
+	}
+
+	report := &ConsistencyReport{Snapshots: disagree, Divergences: divergences}
+	if report.OK() {
+		t.Errorf("report with divergences is OK")
+	}
+	want := "#test members:\n  irc1.example.org: @a b\n  irc2.example.org: a"
+	if d.String() != want {
+		t.Errorf("divergence = %q, wanted %q", d.String(), want)
+	}
+}
+
+func TestParseLusers(t *testing.T) {
+	tests := []struct {
+		text    string
+		users   int
+		servers int
+	}{
+		{"There are 3 users and 0 services on 2 servers.", 3, 2},
+		// Services are not users.
+		{"There are 3 users and 2 services on 1 servers", 3, 1},
+		// Invisible users are.
+		{"There are 3 users and 2 invisible on 1 servers", 5, 1},
+	}
+	for _, test := range tests {
+		users, servers, err := parseLusers(test.text)
+		if err != nil {
+			t.Errorf("parseLusers(%q) failed: %s", test.text, err)
+			continue
+		}
+		if users != test.users || servers != test.servers {
+			t.Errorf("parseLusers(%q) = %d users, %d servers, wanted %d, %d",
+				test.text, users, servers, test.users, test.servers)
+		}
+	}
+
+	if _, _, err := parseLusers("There are 3 users on 1 servers"); err == nil {
+		t.Errorf("expected error parsing malformed reply")
+	}
+}
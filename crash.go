@@ -0,0 +1,225 @@
+package boxcat
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// exitLogLines is how many of its last log lines we keep when catbox exits.
+const exitLogLines = 20
+
+// CatboxExit describes how a catbox process exited.
+type CatboxExit struct {
+	// Server is the server's name.
+	Server string
+
+	Time time.Time
+
+	// Code is the exit status. It is -1 if a signal killed the process.
+	Code int
+
+	// Signal is the signal that killed the process, if one did.
+	Signal os.Signal
+
+	// Expected is true if the process exited because we stopped it.
+	Expected bool
+
+	// LastLines are the last lines the process logged.
+	LastLines []LogLine
+
+	// Panic holds the Go panic or fatal error and its stack trace, if the
+	// process logged one.
+	Panic string
+}
+
+func (e *CatboxExit) String() string {
+	how := fmt.Sprintf("with status %d", e.Code)
+	if e.Signal != nil {
+		how = fmt.Sprintf("due to signal %s", e.Signal)
+	}
+	s := fmt.Sprintf("catbox %s exited %s at %s", e.Server, how,
+		e.Time.Format("15:04:05.000"))
+
+	if e.Panic != "" {
+		return s + "\n" + e.Panic
+	}
+
+	if len(e.LastLines) > 0 {
+		var lines []string
+		for _, line := range e.LastLines {
+			lines = append(lines, line.String())
+		}
+		s += "\nlast lines:\n" + strings.Join(lines, "\n")
+	}
+	return s
+}
+
+// exited records that the process exited and how. err is what waiting for
+// it returned.
+func (c *Catbox) exited(err error) {
+	exit := &CatboxExit{
+		Server: c.Name,
+		Time:   time.Now(),
+		Code:   -1,
+	}
+
+	if state := c.Command.ProcessState; state != nil {
+		exit.Code = state.ExitCode()
+		if status, ok := state.Sys().(syscall.WaitStatus); ok &&
+			status.Signaled() {
+			exit.Signal = status.Signal()
+		}
+	}
+
+	lines := c.Log.Lines()
+	exit.Panic = scrapePanic(lines)
+	if len(lines) > exitLogLines {
+		lines = lines[len(lines)-exitLogLines:]
+	}
+	exit.LastLines = lines
+
+	c.mutex.Lock()
+	exit.Expected = c.stopping
+	c.exit = exit
+	c.mutex.Unlock()
+	close(c.done)
+
+	if !exit.Expected {
+		logf(c.logger, LevelError, c.Name, "%s (%v)", exit, err)
+	}
+}
+
+// scrapePanic finds a Go panic or fatal error in the lines and returns it
+// with the stack trace that follows. We return a blank string if there is
+// none.
+func scrapePanic(lines []LogLine) string {
+	for i, line := range lines {
+		if line.Source != "stderr" {
+			continue
+		}
+		if !strings.HasPrefix(line.Text, "panic: ") &&
+			!strings.HasPrefix(line.Text, "fatal error: ") {
+			continue
+		}
+
+		var trace []string
+		for _, l := range lines[i:] {
+			if l.Source == "stderr" {
+				trace = append(trace, l.Text)
+			}
+		}
+		return strings.Join(trace, "\n")
+	}
+	return ""
+}
+
+// Exited tells whether the process exited, and if so how.
+func (c *Catbox) Exited() (*CatboxExit, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.exit, c.exit != nil
+}
+
+// Done returns a channel that is closed when the process exits, whether we
+// stopped it or not.
+func (c *Catbox) Done() <-chan struct{} {
+	return c.done
+}
+
+// crashGrace is how long we wait to hear that a server crashed after a
+// client's connection closes. The client may notice before we do.
+const crashGrace = time.Second
+
+// watchServer waits for the server to exit. If it exits without us stopping
+// it, and it is the first to, we record the crash.
+func (h *Harness) watchServer(server *Catbox) {
+	<-server.Done()
+
+	exit, _ := server.Exited()
+	if exit.Expected {
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.crash != nil {
+		return
+	}
+	h.crash = exit
+}
+
+// Crashed tells whether any of the Harness's servers exited without us
+// stopping it, and if so how the first one did.
+func (h *Harness) Crashed() (*CatboxExit, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.crash, h.crash != nil
+}
+
+// reportCrashes fails the test for each server that exited without us
+// stopping it.
+func (h *Harness) reportCrashes() {
+	h.mutex.Lock()
+	servers := h.servers
+	h.mutex.Unlock()
+
+	for _, server := range servers {
+		if exit, ok := server.Exited(); ok && !exit.Expected {
+			h.tb.Errorf("%s", exit)
+		}
+	}
+}
+
+// crashContext returns a context that is done when ctx is or when the
+// server crashes. server may be nil.
+//
+// Only the server a connection is to can end its expectations early. Other
+// servers crashing may not affect it.
+func crashContext(
+	ctx context.Context,
+	server *Catbox,
+) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	if server == nil {
+		return ctx, cancel
+	}
+
+	go func() {
+		select {
+		case <-server.Done():
+			if exit, _ := server.Exited(); !exit.Expected {
+				cancel()
+			}
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, cancel
+}
+
+// crashError adds the details of the server crashing to an error from
+// waiting on the inbox. server may be nil.
+//
+// If the inbox's connection closed, the server probably crashed but we may
+// not have heard yet, so we wait a little.
+func crashError(err error, server *Catbox, b *inbox) error {
+	if server == nil {
+		return err
+	}
+
+	if b.hasEnded() {
+		select {
+		case <-server.Done():
+		case <-time.After(crashGrace):
+		}
+	}
+
+	if exit, ok := server.Exited(); ok && !exit.Expected {
+		return fmt.Errorf("%s: %s", err, exit)
+	}
+	return err
+}
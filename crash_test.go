@@ -0,0 +1,208 @@
+package boxcat
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScrapePanic(t *testing.T) {
+	lines := []LogLine{
+		{Source: "stderr", Text: "2020/01/02 03:04:05 catbox started"},
+		{Source: "stdout", Text: "unrelated"},
+		{Source: "stderr", Text: "panic: runtime error: index out of range"},
+		{Source: "stderr", Text: ""},
+		{Source: "stderr", Text: "goroutine 1 [running]:"},
+		{Source: "stdout", Text: "unrelated"},
+		{Source: "stderr", Text: "main.main()"},
+	}
+
+	want := "panic: runtime error: index out of range\n\n" +
+		"goroutine 1 [running]:\nmain.main()"
+	if got := scrapePanic(lines); got != want {
+		t.Errorf("scrapePanic() = %q, wanted %q", got, want)
+	}
+
+	if got := scrapePanic(lines[:2]); got != "" {
+		t.Errorf("scrapePanic() = %q, wanted none", got)
+	}
+}
+
+// fakeCrashingCatbox writes a script that pretends to be catbox. It panics a
+// moment after it starts. If started is false, it panics before it says it
+// started.
+func fakeCrashingCatbox(t *testing.T, started bool) string {
+	script := "#!/bin/sh\n"
+	if started {
+		script += `echo "$(date +'%Y/%m/%d %H:%M:%S') catbox started" >&2
+`
+	}
+	script += `sleep 1
+echo "panic: something went wrong" >&2
+echo "" >&2
+echo "goroutine 1 [running]:" >&2
+echo "main.main()" >&2
+exit 2
+`
+	return fakeCatboxScript(t, script)
+}
+
+// Test that a server crashing makes a pending expectation fail right away
+// and say why.
+func TestCrashFailsExpect(t *testing.T) {
+	// We don't want the crash to fail this test, so we don't give the Harness
+	// the test.
+	h := NewHarness(nil)
+	defer h.Stop()
+	h.Logger = TBLogger(t)
+	h.Build = BuildConfig{Binary: fakeCrashingCatbox(t, true)}
+
+	catbox, err := h.StartServer(ServerOptions{Name: "irc.example.org"})
+	if err != nil {
+		t.Fatalf("error starting catbox: %s", err)
+	}
+
+	// catbox can't take clients, so talk to our own server.
+	server := newTestServer(t)
+	defer server.close()
+
+	server.serve(
+		server.accept,
+		server.expecting("NICK client1", "USER client1 0 * client1"),
+		server.sending(":irc.example.org 001 client1 :Welcome"),
+	)
+
+	client := server.newClient("client1")
+	client.server = catbox
+	if _, _, _, err := client.Start(); err != nil {
+		t.Fatalf("error starting client: %s", err)
+	}
+	defer client.Stop()
+	server.wait()
+
+	start := time.Now()
+	_, err = client.Expect(context.Background(), Command("376"))
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if elapsed := time.Since(start); elapsed > expectTimeout/2 {
+		t.Errorf("took %s to notice the crash", elapsed)
+	}
+	if !strings.Contains(err.Error(), "panic: something went wrong") {
+		t.Errorf("error does not include the panic: %s", err)
+	}
+
+	exit, ok := catbox.Exited()
+	if !ok {
+		t.Fatalf("catbox has not exited")
+	}
+	if exit.Code != 2 || exit.Expected {
+		t.Errorf("exit = %+v, wanted unexpected exit with status 2", exit)
+	}
+	if crash, ok := h.Crashed(); !ok || crash != exit {
+		t.Errorf("Crashed() = %v, %t, wanted %v", crash, ok, exit)
+	}
+
+	// ExpectNone fails too rather than waiting out its window.
+	if err := client.ExpectNone(Command("PRIVMSG"), time.Second); err == nil ||
+		!strings.Contains(err.Error(), "exited with status 2") {
+		t.Errorf("ExpectNone() = %v, wanted crash details", err)
+	}
+}
+
+// Test a server crashing while it starts gives the crash details and leaves
+// nothing behind.
+func TestCrashDuringStart(t *testing.T) {
+	h := NewHarness(nil)
+	defer h.Stop()
+	h.Logger = TBLogger(t)
+	h.Build = BuildConfig{Binary: fakeCrashingCatbox(t, false)}
+
+	// Each server has a temporary directory. Nothing else makes them while
+	// this test runs since it is not parallel.
+	pattern := filepath.Join(os.TempDir(), "boxcat-*")
+	before, err := filepath.Glob(pattern)
+	if err != nil {
+		t.Fatalf("error listing temporary directories: %s", err)
+	}
+
+	_, err = h.StartServer(ServerOptions{Name: "irc.example.org"})
+	if err == nil {
+		t.Fatalf("expected error starting catbox")
+	}
+	if !strings.Contains(err.Error(), "panic: something went wrong") {
+		t.Errorf("error does not include the panic: %s", err)
+	}
+
+	after, err := filepath.Glob(pattern)
+	if err != nil {
+		t.Fatalf("error listing temporary directories: %s", err)
+	}
+	if len(after) != len(before) {
+		t.Errorf("temporary directories before: %v, after: %v", before, after)
+	}
+}
+
+// Test a server crashing doesn't fail expectations of clients of other
+// servers.
+func TestCrashOtherServer(t *testing.T) {
+	h := NewHarness(nil)
+	defer h.Stop()
+	h.Logger = TBLogger(t)
+
+	// Only irc1 crashes.
+	h.Build = BuildConfig{Binary: fakeCatboxScript(t, `#!/bin/sh
+echo "$(date +'%Y/%m/%d %H:%M:%S') catbox started" >&2
+if grep -q "server-name = irc1" "$2"; then
+	echo "panic: something went wrong" >&2
+	exit 2
+fi
+exec sleep 60
+`)}
+
+	crashing, err := h.StartServer(ServerOptions{Name: "irc1.example.org"})
+	if err != nil {
+		t.Fatalf("error starting catbox: %s", err)
+	}
+	healthy, err := h.StartServer(ServerOptions{Name: "irc2.example.org"})
+	if err != nil {
+		t.Fatalf("error starting catbox: %s", err)
+	}
+
+	// catbox can't take clients, so talk to our own server.
+	server := newTestServer(t)
+	defer server.close()
+
+	server.serve(
+		server.accept,
+		server.expecting("NICK client1", "USER client1 0 * client1"),
+		server.sending(":irc.example.org 001 client1 :Welcome"),
+	)
+
+	client := server.newClient("client1")
+	client.server = healthy
+	if _, _, _, err := client.Start(); err != nil {
+		t.Fatalf("error starting client: %s", err)
+	}
+	defer client.Stop()
+	server.wait()
+
+	select {
+	case <-crashing.Done():
+	case <-time.After(expectTimeout):
+		t.Fatalf("irc1 did not crash")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = client.Expect(ctx, Command("376"))
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if ctx.Err() == nil || strings.Contains(err.Error(), "exited") {
+		t.Errorf("expectation failed early: %s", err)
+	}
+}
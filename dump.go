@@ -0,0 +1,142 @@
+package boxcat
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// dumpTimeout is how long we wait for catbox to write its goroutine dump and
+// exit.
+const dumpTimeout = 5 * time.Second
+
+// dumpBeforeDeadline is how long before a test's deadline we dump the
+// goroutines of its servers. We need to be done before the test binary
+// panics.
+const dumpBeforeDeadline = 10 * time.Second
+
+// DumpGoroutines has catbox write out the stack of each of its goroutines by
+// sending it SIGQUIT. We return what it wrote. It stays in the server's Log
+// as well.
+//
+// The Go runtime exits after writing the dump, so this stops the server. We
+// don't count that as a crash.
+func (c *Catbox) DumpGoroutines() (string, error) {
+	c.mutex.Lock()
+	if c.exit != nil {
+		c.mutex.Unlock()
+		return "", fmt.Errorf("catbox %s has exited", c.Name)
+	}
+	c.stopping = true
+	c.mutex.Unlock()
+
+	from := c.Log.Len()
+
+	if err := c.Command.Process.Signal(syscall.SIGQUIT); err != nil {
+		return "", fmt.Errorf("error sending SIGQUIT: %s", err)
+	}
+
+	// We record the exit after reading all of the output, so once we're done
+	// we have the whole dump.
+	select {
+	case <-c.Done():
+	case <-time.After(dumpTimeout):
+		return "", fmt.Errorf("timed out waiting for catbox %s to dump", c.Name)
+	}
+
+	var dump []string
+	for _, line := range c.Log.Lines()[from:] {
+		if line.Source == "stderr" {
+			dump = append(dump, line.Text)
+		}
+	}
+	return strings.Join(dump, "\n"), nil
+}
+
+// DumpGoroutines dumps the goroutines of each of the Harness's servers that
+// is running and writes them to the writer. This stops the servers. See
+// Catbox.DumpGoroutines.
+//
+// NewHarness arranges for this to happen when a test fails or is about to
+// time out.
+func (h *Harness) DumpGoroutines(w io.Writer) {
+	servers := h.Servers()
+
+	// Dump them at the same time so a hung server doesn't hold up the rest.
+	dumps := make([]string, len(servers))
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		if _, exited := server.Exited(); exited {
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, server *Catbox) {
+			defer wg.Done()
+			dump, err := server.DumpGoroutines()
+			if err != nil {
+				dumps[i] = fmt.Sprintf("error dumping goroutines of %s: %s\n",
+					server.Name, err)
+				return
+			}
+			dumps[i] = fmt.Sprintf("goroutines of %s:\n%s\n", server.Name, dump)
+		}(i, server)
+	}
+	wg.Wait()
+
+	for _, dump := range dumps {
+		_, _ = io.WriteString(w, dump)
+	}
+}
+
+// dumpOnFailure attaches the goroutine dumps of the Harness's servers to the
+// test's output if it failed.
+func (h *Harness) dumpOnFailure() {
+	if !h.tb.Failed() {
+		return
+	}
+
+	var b strings.Builder
+	h.DumpGoroutines(&b)
+	if b.Len() > 0 {
+		h.tb.Logf("%s", b.String())
+	}
+}
+
+// dumpBeforeTimeout arranges to dump the goroutines of the Harness's servers
+// shortly before the test times out. We return a function that cancels
+// this.
+//
+// When a test times out the test binary panics without showing the test's
+// log, so we write the dumps to stderr.
+func (h *Harness) dumpBeforeTimeout() func() {
+	// Deadline is new in Go 1.15.
+	tb, ok := h.tb.(interface {
+		Deadline() (time.Time, bool)
+	})
+	if !ok {
+		return func() {}
+	}
+
+	deadline, ok := tb.Deadline()
+	if !ok {
+		return func() {}
+	}
+
+	wait := time.Until(deadline) - dumpBeforeDeadline
+	if wait <= 0 {
+		return func() {}
+	}
+
+	timer := time.AfterFunc(wait, func() {
+		fmt.Fprintf(os.Stderr, "%s is about to time out\n", h.tb.Name())
+		h.DumpGoroutines(os.Stderr)
+	})
+	return func() {
+		timer.Stop()
+	}
+}
@@ -0,0 +1,75 @@
+package boxcat
+
+import (
+	"strings"
+	"testing"
+)
+
+// Test dumping the goroutines of a server that is stuck.
+func TestDumpGoroutines(t *testing.T) {
+	// A stand in for catbox that starts and then hangs.
+	dir := fakeCatboxSource(t, `package main
+
+import (
+	"log"
+	"time"
+)
+
+func main() {
+	log.Print("catbox started")
+	hang()
+}
+
+func hang() {
+	time.Sleep(time.Hour)
+}
+`)
+
+	// We dump the servers ourselves, so we don't give the Harness the test.
+	h := NewHarness(nil)
+	defer h.Stop()
+	h.Logger = TBLogger(t)
+	h.Build = BuildConfig{SourceDir: dir}
+
+	catbox1, err := h.StartServer(ServerOptions{Name: "irc1.example.org"})
+	if err != nil {
+		t.Fatalf("error starting catbox: %s", err)
+	}
+	catbox2, err := h.StartServer(ServerOptions{Name: "irc2.example.org"})
+	if err != nil {
+		t.Fatalf("error starting catbox: %s", err)
+	}
+
+	dump, err := catbox1.DumpGoroutines()
+	if err != nil {
+		t.Fatalf("error dumping goroutines: %s", err)
+	}
+	if !strings.Contains(dump, "goroutine 1 ") ||
+		!strings.Contains(dump, "main.hang(") {
+		t.Errorf("dump is missing the hanging goroutine:\n%s", dump)
+	}
+
+	exit, ok := catbox1.Exited()
+	if !ok {
+		t.Fatalf("catbox has not exited")
+	}
+	if !exit.Expected {
+		t.Errorf("dumping goroutines counted as a crash: %s", exit)
+	}
+	if _, err := catbox1.DumpGoroutines(); err == nil {
+		t.Errorf("expected error dumping goroutines of an exited server")
+	}
+
+	// The Harness only dumps servers that are running.
+	var b strings.Builder
+	h.DumpGoroutines(&b)
+	if strings.Contains(b.String(), catbox1.Name) ||
+		!strings.Contains(b.String(), "goroutines of "+catbox2.Name) ||
+		!strings.Contains(b.String(), "main.hang(") {
+		t.Errorf("unexpected dump:\n%s", b.String())
+	}
+
+	if crash, ok := h.Crashed(); ok {
+		t.Errorf("dumping goroutines counted as a crash: %s", crash)
+	}
+}
@@ -0,0 +1,238 @@
+package boxcat
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// inbox holds messages received on a connection until an expectation consumes
+// them.
+type inbox struct {
+	recvChan <-chan TaggedMessage
+
+	// history holds messages we've received but that no expectation matched
+	// yet. Oldest first.
+	history []TaggedMessage
+
+	// ended is true once recvChan is closed.
+	ended bool
+
+	mutex *sync.Mutex
+}
+
+func newInbox(recvChan <-chan TaggedMessage) *inbox {
+	return &inbox{
+		recvChan: recvChan,
+		mutex:    &sync.Mutex{},
+	}
+}
+
+// expect waits for messages matching each step of the matcher. See
+// Client.Expect.
+func (b *inbox) expect(ctx context.Context, m Matcher) (TaggedMessage, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	matchers := steps(m)
+	if len(matchers) == 0 {
+		return TaggedMessage{}, fmt.Errorf("%s has nothing to match", m)
+	}
+
+	var indexes []int
+	from := 0
+	for _, step := range matchers {
+		idx, err := b.find(ctx, step, from)
+		if err != nil {
+			return TaggedMessage{}, fmt.Errorf("error waiting for %s: %s", m, err)
+		}
+		indexes = append(indexes, idx)
+		from = idx + 1
+	}
+
+	found := b.history[indexes[len(indexes)-1]]
+	b.remove(indexes)
+	return found, nil
+}
+
+// find returns the index in the history of the first message at or after from
+// that matches. If there is none yet, we wait for one to arrive.
+func (b *inbox) find(ctx context.Context, m Matcher, from int) (int, error) {
+	for {
+		for i := from; i < len(b.history); i++ {
+			if m.Match(b.history[i]) {
+				return i, nil
+			}
+		}
+		from = len(b.history)
+
+		select {
+		case <-ctx.Done():
+			return -1, fmt.Errorf("%s (%d unmatched messages in history)",
+				ctx.Err(), len(b.history))
+		case msg, ok := <-b.recvChan:
+			if !ok {
+				b.ended = true
+				return -1, fmt.Errorf("client is no longer receiving messages")
+			}
+			b.history = append(b.history, msg)
+		}
+	}
+}
+
+// expectNone waits for the window to pass and fails if a message matching
+// arrives. We also fail if the context is done first. See Client.ExpectNone.
+func (b *inbox) expectNone(
+	ctx context.Context,
+	m Matcher,
+	window time.Duration,
+) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for _, msg := range b.history {
+		if m.Match(msg) {
+			return fmt.Errorf("received %s matching %s", msg, m)
+		}
+	}
+
+	timer := time.NewTimer(window)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			return nil
+		case <-ctx.Done():
+			return fmt.Errorf("error checking for %s: %s", m, ctx.Err())
+		case msg, ok := <-b.recvChan:
+			if !ok {
+				b.ended = true
+				return fmt.Errorf(
+					"client stopped receiving messages while checking for %s", m)
+			}
+			b.history = append(b.history, msg)
+			if m.Match(msg) {
+				return fmt.Errorf("received %s matching %s", msg, m)
+			}
+		}
+	}
+}
+
+// remove removes the messages at the given indexes from the history. The
+// indexes must be in increasing order.
+func (b *inbox) remove(indexes []int) {
+	var history []TaggedMessage
+	next := 0
+	for i, m := range b.history {
+		if next < len(indexes) && indexes[next] == i {
+			next++
+			continue
+		}
+		history = append(history, m)
+	}
+	b.history = history
+}
+
+// hasEnded tells whether we found recvChan closed.
+func (b *inbox) hasEnded() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.ended
+}
+
+// messages retrieves a copy of the history. We include any messages that
+// have arrived but that we have not looked at yet.
+func (b *inbox) messages() []TaggedMessage {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+LOOP:
+	for {
+		select {
+		case msg, ok := <-b.recvChan:
+			if !ok {
+				b.ended = true
+				break LOOP
+			}
+			b.history = append(b.history, msg)
+		default:
+			break LOOP
+		}
+	}
+
+	history := make([]TaggedMessage, len(b.history))
+	copy(history, b.history)
+	return history
+}
+
+// Expect waits for a message matching the matcher and returns it.
+//
+// We look at messages that arrived earlier but that no expectation matched
+// first. Messages that do not match stay in the client's history so later
+// expectations can still see them. The message that matches is removed from
+// the history.
+//
+// If the matcher is a Sequence, we wait for a message matching each step in
+// order and return the one matching the last step.
+//
+// We give up when the context is done. If the client came from a Harness, we
+// also give up as soon as its server crashes, and say how it did.
+//
+// If you use Expect you must not read from the receive channel yourself.
+func (c *Client) Expect(ctx context.Context, m Matcher) (TaggedMessage, error) {
+	if c.inbox == nil {
+		return TaggedMessage{}, fmt.Errorf("client is not started")
+	}
+
+	ctx, cancel := crashContext(ctx, c.server)
+	defer cancel()
+
+	msg, err := c.inbox.expect(ctx, m)
+	if err != nil {
+		err = crashError(err, c.server, c.inbox)
+		if c.Err() != nil {
+			return TaggedMessage{}, fmt.Errorf("%s: %s", err, c.Err())
+		}
+	}
+	return msg, err
+}
+
+// ExpectNone checks that no message matching the matcher arrives during the
+// window. If one does, we return an error describing it.
+//
+// Messages in the client's history that no expectation matched yet count as
+// well. Messages we see stay in the history.
+//
+// The matcher should match a single message. For a Sequence we only look at
+// the first step.
+//
+// Like Expect, we give up early if the server of a client from a Harness
+// crashes.
+func (c *Client) ExpectNone(m Matcher, window time.Duration) error {
+	if c.inbox == nil {
+		return fmt.Errorf("client is not started")
+	}
+
+	ctx, cancel := crashContext(context.Background(), c.server)
+	defer cancel()
+
+	if err := c.inbox.expectNone(ctx, m, window); err != nil {
+		err = crashError(err, c.server, c.inbox)
+		if c.Err() != nil {
+			return fmt.Errorf("%s: %s", err, c.Err())
+		}
+		return err
+	}
+	return nil
+}
+
+// History retrieves the messages the client received that no expectation
+// has matched yet. Oldest first.
+func (c *Client) History() []TaggedMessage {
+	if c.inbox == nil {
+		return nil
+	}
+	return c.inbox.messages()
+}
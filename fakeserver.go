@@ -0,0 +1,606 @@
+package boxcat
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// FakeServerOptions describe a FakeServer.
+type FakeServerOptions struct {
+	// Name is the server's name. It is required.
+	Name string
+
+	// SID is the server's TS6 ID. If it is blank we use 9ZZ.
+	SID string
+
+	// Description is the server's description.
+	Description string
+
+	// Password is the link password. We send it and require the peer to send
+	// it too. If it is blank we use the password the harness gives catboxes.
+	Password string
+
+	// Capabs are the capabilities we send in CAPAB. If there are none we send
+	// QS and ENCAP.
+	Capabs []string
+}
+
+// FakeServer is a scripted TS6 server. It links to one peer, such as a
+// catbox, and lets you send it exactly what you want and expect what it
+// sends back, the way Client does for clients.
+//
+// We answer PINGs. Everything else is up to you, including the burst.
+type FakeServer struct {
+	Name        string
+	SID         string
+	Description string
+	Password    string
+	Capabs      []string
+
+	// PeerName, PeerSID, and PeerCapabs are what the peer told us during the
+	// handshake.
+	PeerName   string
+	PeerSID    string
+	PeerCapabs []string
+
+	listener net.Listener
+	conn     net.Conn
+	rw       *bufio.ReadWriter
+
+	inbox  *inbox
+	logger Logger
+
+	// catbox is set if a Harness linked us to it. We watch it for crashes.
+	catbox *Catbox
+
+	// nextUID is the number we use in the next UID we make.
+	nextUID int
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     *sync.WaitGroup
+
+	mutex      *sync.Mutex
+	writeMutex *sync.Mutex
+}
+
+// FakeUser is a user a FakeServer introduces with UID or EUID.
+type FakeUser struct {
+	Nick string
+
+	// UID is the user's TS6 ID. If it is blank we make one starting with our
+	// SID.
+	UID string
+
+	// TS is the nick's timestamp. If it is zero we use the current time.
+	TS int64
+
+	// Modes are the user's modes. If blank we use +i.
+	Modes string
+
+	// Username, Host, IP and RealName default to the nick, fake.example.org,
+	// 0, and the nick.
+	Username string
+	Host     string
+	IP       string
+	RealName string
+
+	// RealHost and Account are only sent with EUID. They default to * (none).
+	RealHost string
+	Account  string
+}
+
+// NewFakeServer creates a FakeServer. It does nothing until you Connect or
+// Listen and Accept.
+func NewFakeServer(opts FakeServerOptions) *FakeServer {
+	f := &FakeServer{
+		Name:        opts.Name,
+		SID:         opts.SID,
+		Description: opts.Description,
+		Password:    opts.Password,
+		Capabs:      opts.Capabs,
+		logger:      StdLogger(),
+		wg:          &sync.WaitGroup{},
+		mutex:       &sync.Mutex{},
+		writeMutex:  &sync.Mutex{},
+	}
+	if f.SID == "" {
+		f.SID = "9ZZ"
+	}
+	if f.Description == "" {
+		f.Description = "boxcat fake server"
+	}
+	if f.Password == "" {
+		f.Password = "testing"
+	}
+	if len(f.Capabs) == 0 {
+		f.Capabs = []string{"QS", "ENCAP"}
+	}
+	f.ctx, f.cancel = context.WithCancel(context.Background())
+	return f
+}
+
+// SetLogger sets where we log the lines we send and receive. Call it before
+// linking.
+func (f *FakeServer) SetLogger(l Logger) {
+	f.logger = l
+}
+
+// Listen starts listening for the peer to connect to us on 127.0.0.1. It
+// returns the port. Call Accept to wait for the connection.
+func (f *FakeServer) Listen() (uint16, error) {
+	ln, port, err := getRandomPort()
+	if err != nil {
+		return 0, err
+	}
+	f.listener = ln
+	return port, nil
+}
+
+// Accept waits for the peer to connect and completes the handshake. The peer
+// sends PASS, CAPAB, and SERVER first, and we reply with ours and SVINFO. If
+// the handshake fails we close the connection.
+//
+// We stop listening once the peer connects.
+func (f *FakeServer) Accept(ctx context.Context) error {
+	if f.listener == nil {
+		return fmt.Errorf("fake server is not listening")
+	}
+
+	// Accept doesn't take a context. Closing the listener interrupts it.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = f.listener.Close()
+		case <-done:
+		}
+	}()
+
+	conn, err := f.listener.Accept()
+	_ = f.listener.Close()
+	if err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("error accepting: %s", ctx.Err())
+		}
+		return fmt.Errorf("error accepting: %s", err)
+	}
+
+	f.start(conn)
+
+	if err := f.readHandshake(ctx); err != nil {
+		f.cancel()
+		return err
+	}
+	if err := f.sendHandshake(); err != nil {
+		f.cancel()
+		return err
+	}
+	return f.sendSVINFO()
+}
+
+// Connect connects to the peer and completes the handshake. We send PASS,
+// CAPAB, and SERVER first, then wait for the peer's, then send SVINFO. If the
+// handshake fails we close the connection.
+func (f *FakeServer) Connect(ctx context.Context, host string,
+	port uint16) error {
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp",
+		net.JoinHostPort(host, strconv.FormatUint(uint64(port), 10)))
+	if err != nil {
+		return fmt.Errorf("error dialing: %s", err)
+	}
+
+	f.start(conn)
+
+	if err := f.sendHandshake(); err != nil {
+		f.cancel()
+		return err
+	}
+	if err := f.readHandshake(ctx); err != nil {
+		f.cancel()
+		return err
+	}
+	return f.sendSVINFO()
+}
+
+// start begins reading from the connection.
+func (f *FakeServer) start(conn net.Conn) {
+	f.conn = conn
+	f.rw = bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+
+	recvChan := make(chan TaggedMessage, 512)
+	f.inbox = newInbox(recvChan)
+
+	f.wg.Add(2)
+	go func() {
+		defer f.wg.Done()
+		<-f.ctx.Done()
+		_ = conn.Close()
+	}()
+	go f.reader(recvChan)
+}
+
+// sendHandshake sends PASS, CAPAB, and SERVER.
+func (f *FakeServer) sendHandshake() error {
+	for _, m := range []irc.Message{
+		{Command: "PASS", Params: []string{f.Password, "TS", "6", f.SID}},
+		{Command: "CAPAB", Params: []string{strings.Join(f.Capabs, " ")}},
+		{Command: "SERVER", Params: []string{f.Name, "1", f.Description}},
+	} {
+		if err := f.Send(TaggedMessage{Message: m}); err != nil {
+			return fmt.Errorf("error sending %s: %s", m.Command, err)
+		}
+	}
+	return nil
+}
+
+// readHandshake waits for the peer's PASS, CAPAB, and SERVER.
+func (f *FakeServer) readHandshake(ctx context.Context) error {
+	pass, err := f.Expect(ctx, Command("PASS"))
+	if err != nil {
+		return err
+	}
+	// PASS <password> TS 6 <SID>
+	if len(pass.Params) < 4 || pass.Params[1] != "TS" {
+		return fmt.Errorf("malformed PASS: %s", pass)
+	}
+	if pass.Params[0] != f.Password {
+		return fmt.Errorf("peer sent the wrong password: %s", pass.Params[0])
+	}
+
+	capab, err := f.Expect(ctx, Command("CAPAB"))
+	if err != nil {
+		return err
+	}
+
+	server, err := f.Expect(ctx, Command("SERVER"))
+	if err != nil {
+		return err
+	}
+	if len(server.Params) < 1 {
+		return fmt.Errorf("malformed SERVER: %s", server)
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.PeerSID = pass.Params[3]
+	f.PeerCapabs = strings.Fields(lastParam(capab))
+	f.PeerName = server.Params[0]
+	return nil
+}
+
+// sendSVINFO tells the peer which TS versions we support and our time.
+func (f *FakeServer) sendSVINFO() error {
+	return f.Send(TaggedMessage{Message: irc.Message{
+		Command: "SVINFO",
+		Params:  []string{"6", "6", "0", strconv.FormatInt(time.Now().Unix(), 10)},
+	}})
+}
+
+func (f *FakeServer) reader(recvChan chan<- TaggedMessage) {
+	defer f.wg.Done()
+	defer close(recvChan)
+
+	for {
+		line, err := f.rw.ReadString('\n')
+		if err != nil {
+			if f.ctx.Err() == nil {
+				logf(f.logger, LevelError, "fake "+f.Name, "error reading: %s", err)
+			}
+			return
+		}
+		logf(f.logger, LevelDebug, "fake "+f.Name, "read: %s",
+			strings.TrimRight(line, "\r\n"))
+
+		m, err := ParseTaggedMessage(line)
+		if err != nil && err != irc.ErrTruncated {
+			logf(f.logger, LevelError, "fake "+f.Name,
+				"unable to parse message: %s: %s", line, err)
+			continue
+		}
+
+		// PING <origin> [<destination>]
+		if m.Command == "PING" && len(m.Params) > 0 {
+			if err := f.Send(TaggedMessage{Message: irc.Message{
+				Prefix:  f.SID,
+				Command: "PONG",
+				Params:  []string{f.Name, m.Params[0]},
+			}}); err != nil {
+				logf(f.logger, LevelError, "fake "+f.Name,
+					"error sending pong: %s", err)
+				return
+			}
+		}
+
+		select {
+		case recvChan <- m:
+		case <-f.ctx.Done():
+			return
+		}
+	}
+}
+
+// Send sends a message to the peer.
+func (f *FakeServer) Send(m TaggedMessage) error {
+	buf, err := m.Encode()
+	if err != nil && err != irc.ErrTruncated {
+		return fmt.Errorf("unable to encode message: %s", err)
+	}
+	return f.writeLine(buf)
+}
+
+// SendLine sends a line to the peer exactly as given. We add CRLF. Use it to
+// send lines Send would not encode, such as malformed ones.
+func (f *FakeServer) SendLine(line string) error {
+	return f.writeLine(line + "\r\n")
+}
+
+func (f *FakeServer) writeLine(buf string) error {
+	if f.conn == nil {
+		return fmt.Errorf("fake server is not linked")
+	}
+
+	f.writeMutex.Lock()
+	defer f.writeMutex.Unlock()
+
+	if err := f.conn.SetWriteDeadline(time.Now().Add(
+		30 * time.Second)); err != nil {
+		return fmt.Errorf("unable to set deadline: %s", err)
+	}
+	if _, err := f.rw.WriteString(buf); err != nil {
+		return err
+	}
+	if err := f.rw.Flush(); err != nil {
+		return fmt.Errorf("flush error: %s", err)
+	}
+
+	logf(f.logger, LevelDebug, "fake "+f.Name, "sent: %s",
+		strings.TrimRight(buf, "\r\n"))
+	return nil
+}
+
+// Expect waits for a message from the peer matching the matcher. It works
+// like Client.Expect.
+func (f *FakeServer) Expect(
+	ctx context.Context,
+	m Matcher,
+) (TaggedMessage, error) {
+	if f.inbox == nil {
+		return TaggedMessage{}, fmt.Errorf("fake server is not linked")
+	}
+
+	ctx, cancel := crashContext(ctx, f.catbox)
+	defer cancel()
+
+	msg, err := f.inbox.expect(ctx, m)
+	if err != nil {
+		return TaggedMessage{}, crashError(err, f.catbox, f.inbox)
+	}
+	return msg, nil
+}
+
+// ExpectNone checks no message matching the matcher arrives from the peer
+// during the window. It works like Client.ExpectNone.
+func (f *FakeServer) ExpectNone(m Matcher, window time.Duration) error {
+	if f.inbox == nil {
+		return fmt.Errorf("fake server is not linked")
+	}
+
+	ctx, cancel := crashContext(context.Background(), f.catbox)
+	defer cancel()
+
+	if err := f.inbox.expectNone(ctx, m, window); err != nil {
+		return crashError(err, f.catbox, f.inbox)
+	}
+	return nil
+}
+
+// History retrieves the messages from the peer that no expectation has
+// matched yet. Oldest first.
+func (f *FakeServer) History() []TaggedMessage {
+	if f.inbox == nil {
+		return nil
+	}
+	return f.inbox.messages()
+}
+
+// UID introduces a user with UID. We return the user's UID.
+//
+// :<SID> UID <nick> <hops> <TS> <modes> <username> <host> <IP> <UID>
+// :<real name>
+func (f *FakeServer) UID(u FakeUser) (string, error) {
+	u = f.fillUser(u)
+	return u.UID, f.Send(TaggedMessage{Message: irc.Message{
+		Prefix:  f.SID,
+		Command: "UID",
+		Params: []string{u.Nick, "1", strconv.FormatInt(u.TS, 10), u.Modes,
+			u.Username, u.Host, u.IP, u.UID, u.RealName},
+	}})
+}
+
+// EUID introduces a user with EUID. We return the user's UID. The peer must
+// support EUID, so include it in Capabs.
+//
+// :<SID> EUID <nick> <hops> <TS> <modes> <username> <host> <IP> <UID>
+// <real host> <account> :<real name>
+func (f *FakeServer) EUID(u FakeUser) (string, error) {
+	u = f.fillUser(u)
+	return u.UID, f.Send(TaggedMessage{Message: irc.Message{
+		Prefix:  f.SID,
+		Command: "EUID",
+		Params: []string{u.Nick, "1", strconv.FormatInt(u.TS, 10), u.Modes,
+			u.Username, u.Host, u.IP, u.UID, u.RealHost, u.Account, u.RealName},
+	}})
+}
+
+// fillUser sets defaults for fields the user left blank.
+func (f *FakeServer) fillUser(u FakeUser) FakeUser {
+	if u.UID == "" {
+		f.mutex.Lock()
+		f.nextUID++
+		u.UID = fmt.Sprintf("%sA%05d", f.SID, f.nextUID)
+		f.mutex.Unlock()
+	}
+	if u.TS == 0 {
+		u.TS = time.Now().Unix()
+	}
+	defaults := []struct {
+		field *string
+		value string
+	}{
+		{&u.Modes, "+i"},
+		{&u.Username, u.Nick},
+		{&u.Host, "fake.example.org"},
+		{&u.IP, "0"},
+		{&u.RealName, u.Nick},
+		{&u.RealHost, "*"},
+		{&u.Account, "*"},
+	}
+	for _, d := range defaults {
+		if *d.field == "" {
+			*d.field = d.value
+		}
+	}
+	return u
+}
+
+// SJoin sends an SJOIN, creating the channel or adding members to it. modes
+// holds the modes and their parameters, such as "+nt" or "+lk 10 key".
+// Members are UIDs, each prefixed by their status, such as @ for ops.
+//
+// :<SID> SJOIN <TS> <channel> <modes> [mode params...] :<members>
+func (f *FakeServer) SJoin(ts int64, channel, modes string,
+	members ...string) error {
+	params := []string{strconv.FormatInt(ts, 10), channel}
+	params = append(params, strings.Fields(modes)...)
+	if len(params) == 2 {
+		params = append(params, "+")
+	}
+	params = append(params, strings.Join(members, " "))
+
+	return f.Send(TaggedMessage{Message: irc.Message{
+		Prefix:  f.SID,
+		Command: "SJOIN",
+		Params:  params,
+	}})
+}
+
+// TMode changes a channel's modes. source is who sets them, such as one of
+// our UIDs. If it is blank we use our SID.
+//
+// :<source> TMODE <TS> <channel> <modes> [mode params...]
+func (f *FakeServer) TMode(source string, ts int64, channel, modes string,
+	params ...string) error {
+	if source == "" {
+		source = f.SID
+	}
+	return f.Send(TaggedMessage{Message: irc.Message{
+		Prefix:  source,
+		Command: "TMODE",
+		Params: append([]string{strconv.FormatInt(ts, 10), channel, modes},
+			params...),
+	}})
+}
+
+// ConnectFakeServer links a FakeServer to the server. The FakeServer
+// connects to it. We wait for the server to see the link established.
+//
+// The FakeServer logs to the Harness's Logger and is closed when the Harness
+// stops.
+func (h *Harness) ConnectFakeServer(
+	server *Catbox,
+	opts FakeServerOptions,
+) (*FakeServer, error) {
+	return h.linkFakeServer(server, opts, false)
+}
+
+// AcceptFakeServer links a FakeServer to the server. The server connects to
+// the FakeServer. We wait for the server to see the link established.
+//
+// The FakeServer logs to the Harness's Logger and is closed when the Harness
+// stops.
+func (h *Harness) AcceptFakeServer(
+	server *Catbox,
+	opts FakeServerOptions,
+) (*FakeServer, error) {
+	return h.linkFakeServer(server, opts, true)
+}
+
+func (h *Harness) linkFakeServer(
+	server *Catbox,
+	opts FakeServerOptions,
+	accept bool,
+) (*FakeServer, error) {
+	f := NewFakeServer(opts)
+	f.SetLogger(h.Logger)
+	f.catbox = server
+
+	h.mutex.Lock()
+	h.fakeServers = append(h.fakeServers, f)
+	h.mutex.Unlock()
+
+	// The server needs to know about us to accept our link. If we are not
+	// accepting, give it a port nothing listens on so it doesn't connect to
+	// us as well.
+	port, err := f.Listen()
+	if err != nil {
+		return nil, err
+	}
+	if !accept {
+		_ = f.listener.Close()
+	}
+
+	linkRE := regexp.MustCompile(
+		fmt.Sprintf(`Established link to %s\b`, regexp.QuoteMeta(f.Name)))
+	from := server.Log.Len()
+
+	server.Config.AddServer(ServerLink{
+		Name:     f.Name,
+		Host:     "127.0.0.1",
+		Port:     port,
+		Password: f.Password,
+	})
+	if err := server.Rehash(); err != nil {
+		return nil, fmt.Errorf("error linking %s to %s: %s", server.Name, f.Name,
+			err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if accept {
+		err = f.Accept(ctx)
+	} else {
+		err = f.Connect(ctx, "127.0.0.1", server.Port)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error linking %s to %s: %s", f.Name, server.Name,
+			err)
+	}
+
+	if !waitForLog(server.Log, linkRE, from) {
+		return nil, fmt.Errorf("failed to see %s link to %s", server.Name, f.Name)
+	}
+
+	return f, nil
+}
+
+// Close closes the link.
+func (f *FakeServer) Close() {
+	f.cancel()
+	if f.listener != nil {
+		_ = f.listener.Close()
+	}
+	f.wg.Wait()
+}
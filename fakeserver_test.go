@@ -0,0 +1,186 @@
+package boxcat
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// linkFakeServers links two fake servers to each other. b connects to a.
+func linkFakeServers(t *testing.T, a, b *FakeServer) error {
+	a.SetLogger(TBLogger(t))
+	b.SetLogger(TBLogger(t))
+
+	port, err := a.Listen()
+	if err != nil {
+		t.Fatalf("error listening: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	acceptErr := make(chan error, 1)
+	go func() {
+		acceptErr <- a.Accept(ctx)
+	}()
+
+	if err := b.Connect(ctx, "127.0.0.1", port); err != nil {
+		return err
+	}
+	return <-acceptErr
+}
+
+func TestFakeServerLink(t *testing.T) {
+	a := NewFakeServer(FakeServerOptions{Name: "a.example.org", SID: "1AA"})
+	defer a.Close()
+	b := NewFakeServer(FakeServerOptions{
+		Name:   "b.example.org",
+		SID:    "2BB",
+		Capabs: []string{"QS", "ENCAP", "EUID"},
+	})
+	defer b.Close()
+
+	if err := linkFakeServers(t, a, b); err != nil {
+		t.Fatalf("error linking: %s", err)
+	}
+
+	if a.PeerName != "b.example.org" || a.PeerSID != "2BB" ||
+		len(a.PeerCapabs) != 3 {
+		t.Fatalf("a saw peer %s %s %v", a.PeerName, a.PeerSID, a.PeerCapabs)
+	}
+	if b.PeerName != "a.example.org" || b.PeerSID != "1AA" {
+		t.Fatalf("b saw peer %s %s", b.PeerName, b.PeerSID)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, f := range []*FakeServer{a, b} {
+		if _, err := f.Expect(ctx, Command("SVINFO")); err != nil {
+			t.Fatalf("%s: %s", f.Name, err)
+		}
+	}
+
+	uid, err := b.UID(FakeUser{Nick: "alice", TS: 100})
+	if err != nil {
+		t.Fatalf("error sending UID: %s", err)
+	}
+	if uid != "2BBA00001" {
+		t.Fatalf("UID = %s, wanted 2BBA00001", uid)
+	}
+	if _, err := a.Expect(ctx, Message(irc.Message{
+		Prefix:  "2BB",
+		Command: "UID",
+		Params: []string{"alice", "1", "100", "+i", "alice", "fake.example.org",
+			"0", "2BBA00001", "alice"},
+	})); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if err := b.SJoin(100, "#test", "+nt", "@"+uid); err != nil {
+		t.Fatalf("error sending SJOIN: %s", err)
+	}
+	if _, err := a.Expect(ctx, Message(irc.Message{
+		Prefix:  "2BB",
+		Command: "SJOIN",
+		Params:  []string{"100", "#test", "+nt", "@2BBA00001"},
+	})); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if err := b.TMode(uid, 100, "#test", "+k", "key"); err != nil {
+		t.Fatalf("error sending TMODE: %s", err)
+	}
+	if _, err := a.Expect(ctx, Message(irc.Message{
+		Prefix:  "2BBA00001",
+		Command: "TMODE",
+		Params:  []string{"100", "#test", "+k", "key"},
+	})); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	// b answers our PING.
+	if err := a.SendLine(":1AA PING a.example.org :2BB"); err != nil {
+		t.Fatalf("error sending PING: %s", err)
+	}
+	if _, err := a.Expect(ctx, Message(irc.Message{
+		Prefix:  "2BB",
+		Command: "PONG",
+		Params:  []string{"b.example.org", "a.example.org"},
+	})); err != nil {
+		t.Fatalf("%s", err)
+	}
+}
+
+func TestFakeServerWrongPassword(t *testing.T) {
+	a := NewFakeServer(FakeServerOptions{Name: "a.example.org", SID: "1AA"})
+	defer a.Close()
+	b := NewFakeServer(FakeServerOptions{
+		Name:     "b.example.org",
+		SID:      "2BB",
+		Password: "wrong",
+	})
+	defer b.Close()
+
+	if err := linkFakeServers(t, a, b); err == nil {
+		t.Fatalf("expected error linking with the wrong password")
+	}
+}
+
+// Test catbox takes a user and channel from a fake server's burst, and tells
+// it about its own users.
+func TestFakeServerBurst(t *testing.T) {
+	t.Parallel()
+
+	h := NewHarness(t)
+
+	catbox, err := h.StartServer(ServerOptions{Name: "irc.example.org"})
+	if err != nil {
+		t.Fatalf("error starting catbox: %s", err)
+	}
+
+	fake, err := h.ConnectFakeServer(catbox, FakeServerOptions{
+		Name: "fake.example.org",
+	})
+	if err != nil {
+		t.Fatalf("error linking fake server: %s", err)
+	}
+
+	uid, err := fake.UID(FakeUser{Nick: "alice"})
+	if err != nil {
+		t.Fatalf("error sending UID: %s", err)
+	}
+	if err := fake.SJoin(time.Now().Unix(), "#test", "+nt",
+		"@"+uid); err != nil {
+		t.Fatalf("error sending SJOIN: %s", err)
+	}
+
+	client := h.NewClient("client1", catbox)
+	if _, _, _, err := client.Start(); err != nil {
+		t.Fatalf("error starting client: %s", err)
+	}
+	defer client.Stop()
+	expect(t, client, Command(irc.ReplyWelcome))
+
+	ctx, cancel := context.WithTimeout(context.Background(), expectTimeout)
+	defer cancel()
+	if _, err := fake.Expect(ctx, AllOf(Command("UID"),
+		Param(0, client.GetNick()))); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if err := client.Send(msg("JOIN", "#test")); err != nil {
+		t.Fatalf("error sending JOIN: %s", err)
+	}
+	expect(t, client, AllOf(Command("366"), Param(1, "#test")))
+	if state, _ := client.GetChannel("#test"); state.Members["alice"] != "@" {
+		t.Fatalf("alice is not an op on #test: %v", state.Members)
+	}
+
+	if _, err := fake.Expect(ctx, AllOf(Command("JOIN"),
+		Param(1, "#test"))); err != nil {
+		t.Fatalf("%s", err)
+	}
+}
@@ -0,0 +1,305 @@
+package boxcat
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Harness runs catbox servers for tests.
+//
+// You can use it from any package's tests. For example:
+//
+//	h := boxcat.NewHarness(t)
+//	server, err := h.StartServer(boxcat.ServerOptions{Name: "irc.example.org"})
+//
+// The Harness stops its servers when the test completes.
+type Harness struct {
+	// Build says where to find catbox. NewHarness sets it from the
+	// environment. See BuildConfigFromEnv.
+	Build BuildConfig
+
+	// Logger receives output from the servers and proxies the Harness starts
+	// and from clients made with NewClient. NewHarness sets it to log to the
+	// test, or to the standard log package if there is no test.
+	Logger Logger
+
+	// DumpLogsOnFailure makes us log each server's full log to the test if it
+	// fails. Set this if Logger does not send server output to the test, such
+	// as when you filter it out.
+	DumpLogsOnFailure bool
+
+	tb          testing.TB
+	servers     []*Catbox
+	faultLinks  []*FaultLink
+	fakeServers []*FakeServer
+	ca          *CertificateAuthority
+
+	// crash describes how the first server to exit without us stopping it
+	// did.
+	crash *CatboxExit
+
+	mutex *sync.Mutex
+}
+
+// ServerOptions control how we start a server.
+type ServerOptions struct {
+	// Name is the server's name. It is required.
+	Name string
+
+	// TLS makes the server listen for TLS connections as well. We issue it a
+	// certificate from the Harness's CertificateAuthority. Its port is in
+	// Catbox.TLSPort.
+	TLS bool
+
+	// Config is the server's config. If it is nil we use NewCatboxConfig. The
+	// server gets a copy with its ServerName set to Name. Change the copy in
+	// Catbox.Config and call Catbox.Rehash to alter a running server.
+	Config *CatboxConfig
+}
+
+// NewHarness creates a Harness.
+//
+// If tb is not nil, we stop every server once the test and its subtests
+// complete. The servers' output goes to the test's log, so it shows if the
+// test fails. The test fails if any server exited without us stopping it.
+// If the test fails or is about to time out, we dump the goroutines of the
+// servers still running. See DumpGoroutines.
+//
+// tb may be nil. For example if you want to run servers outside of a test.
+// In that case you must call Stop yourself.
+func NewHarness(tb testing.TB) *Harness {
+	h := &Harness{
+		Build:  BuildConfigFromEnv(),
+		Logger: StdLogger(),
+		tb:     tb,
+		mutex:  &sync.Mutex{},
+	}
+
+	if tb != nil {
+		// Make the logger first so it is still logging while we stop the
+		// servers.
+		h.Logger = TBLogger(tb)
+
+		stopTimeoutDump := h.dumpBeforeTimeout()
+
+		tb.Cleanup(func() {
+			stopTimeoutDump()
+			h.reportCrashes()
+			if h.DumpLogsOnFailure {
+				for _, server := range h.Servers() {
+					server.Log.DumpOnFailure(tb)
+				}
+			}
+			h.dumpOnFailure()
+			h.Stop()
+		})
+	}
+
+	return h
+}
+
+// tlsPortAttempts is how many times we try to start a server with TLS when
+// its TLS port turns out to be in use.
+const tlsPortAttempts = 5
+
+// StartServer starts a catbox and waits for it to be ready.
+func (h *Harness) StartServer(opts ServerOptions) (*Catbox, error) {
+	if opts.Name == "" {
+		return nil, fmt.Errorf("server name is required")
+	}
+
+	config := NewCatboxConfig(opts.Name)
+	if opts.Config != nil {
+		config = opts.Config.Clone()
+	}
+	config.ServerName = opts.Name
+
+	var server *Catbox
+	for attempt := 1; ; attempt++ {
+		if opts.TLS {
+			if err := h.configureTLS(config); err != nil {
+				return nil, err
+			}
+		}
+
+		var err error
+		server, err = harnessCatbox(h.Build, config, h.Logger)
+		if err == nil {
+			break
+		}
+
+		// We choose the TLS port before catbox listens on it, so something
+		// else may take it first. If so, try another.
+		if !opts.TLS || attempt == tlsPortAttempts ||
+			!strings.Contains(err.Error(), "address already in use") {
+			return nil, err
+		}
+		logf(h.Logger, LevelInfo, opts.Name,
+			"TLS port %d is in use, trying another", config.ListenPortTLS)
+	}
+
+	h.mutex.Lock()
+	h.servers = append(h.servers, server)
+	h.mutex.Unlock()
+
+	go h.watchServer(server)
+
+	return server, nil
+}
+
+// CertificateAuthority retrieves the Harness's certificate authority. We
+// create it the first time you ask for it.
+//
+// Servers started with TLS use certificates from it. Give clients a config
+// from its ClientTLSConfig to have them trust those servers.
+func (h *Harness) CertificateAuthority() (*CertificateAuthority, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.ca != nil {
+		return h.ca, nil
+	}
+
+	ca, err := NewCertificateAuthority()
+	if err != nil {
+		return nil, fmt.Errorf("error creating certificate authority: %s", err)
+	}
+	h.ca = ca
+	return ca, nil
+}
+
+// configureTLS sets up the config to listen for TLS connections on a random
+// port using a certificate from our certificate authority.
+func (h *Harness) configureTLS(config *CatboxConfig) error {
+	ca, err := h.CertificateAuthority()
+	if err != nil {
+		return err
+	}
+
+	cert, err := ca.IssueServerCertificate(config.ServerName, "localhost",
+		"127.0.0.1")
+	if err != nil {
+		return fmt.Errorf("error issuing server certificate: %s", err)
+	}
+
+	// catbox opens the TLS port itself. Find one that is free. Unlike the
+	// plaintext port, we can't hand catbox the listener, so another process
+	// could take the port before catbox does. StartServer retries if so.
+	ln, port, err := getRandomPort()
+	if err != nil {
+		return err
+	}
+	if err := ln.Close(); err != nil {
+		return fmt.Errorf("error closing listener: %s", err)
+	}
+
+	config.ListenHost = "127.0.0.1"
+	config.ListenPortTLS = port
+	config.CertificatePEM = cert.CertificatePEM
+	config.KeyPEM = cert.KeyPEM
+	return nil
+}
+
+// NewClient creates a client for the server that logs to the Harness's
+// Logger. Its expectations fail as soon as the server crashes.
+func (h *Harness) NewClient(nick string, server *Catbox) *Client {
+	c := NewClient(nick, "127.0.0.1", server.Port)
+	c.SetLogger(h.Logger)
+	c.server = server
+	return c
+}
+
+// Servers retrieves the servers the Harness started that are not stopped.
+func (h *Harness) Servers() []*Catbox {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	servers := make([]*Catbox, len(h.servers))
+	copy(servers, h.servers)
+	return servers
+}
+
+// Link links two servers together and waits for the link to be established.
+func (h *Harness) Link(a, b *Catbox) error {
+	linkRE := regexp.MustCompile(
+		fmt.Sprintf(`Established link to %s\b`, regexp.QuoteMeta(b.Name)))
+	from := a.Log.Len()
+
+	if err := a.linkServer(b); err != nil {
+		return fmt.Errorf("error linking %s to %s: %s", a.Name, b.Name, err)
+	}
+	if err := b.linkServer(a); err != nil {
+		return fmt.Errorf("error linking %s to %s: %s", b.Name, a.Name, err)
+	}
+
+	if !waitForLog(a.Log, linkRE, from) {
+		return fmt.Errorf("failed to see %s link to %s", a.Name, b.Name)
+	}
+
+	return nil
+}
+
+// LinkWithFaults links two servers together through proxies and waits for
+// the link to be established. You can use the FaultLink to inject faults
+// into the link.
+func (h *Harness) LinkWithFaults(a, b *Catbox) (*FaultLink, error) {
+	toB, err := newProxy(fmt.Sprintf("127.0.0.1:%d", b.Port), h.Logger)
+	if err != nil {
+		return nil, fmt.Errorf("error starting proxy: %s", err)
+	}
+	toA, err := newProxy(fmt.Sprintf("127.0.0.1:%d", a.Port), h.Logger)
+	if err != nil {
+		toB.Close()
+		return nil, fmt.Errorf("error starting proxy: %s", err)
+	}
+
+	link := &FaultLink{A: a, B: b, toB: toB, toA: toA}
+
+	h.mutex.Lock()
+	h.faultLinks = append(h.faultLinks, link)
+	h.mutex.Unlock()
+
+	linkRE := regexp.MustCompile(
+		fmt.Sprintf(`Established link to %s\b`, regexp.QuoteMeta(b.Name)))
+	from := a.Log.Len()
+
+	if err := a.linkServerVia(b, toB.Port); err != nil {
+		return nil, fmt.Errorf("error linking %s to %s: %s", a.Name, b.Name, err)
+	}
+	if err := b.linkServerVia(a, toA.Port); err != nil {
+		return nil, fmt.Errorf("error linking %s to %s: %s", b.Name, a.Name, err)
+	}
+
+	if !waitForLog(a.Log, linkRE, from) {
+		return nil, fmt.Errorf("failed to see %s link to %s", a.Name, b.Name)
+	}
+
+	return link, nil
+}
+
+// Stop stops every server the Harness started.
+func (h *Harness) Stop() {
+	h.mutex.Lock()
+	servers := h.servers
+	h.servers = nil
+	faultLinks := h.faultLinks
+	h.faultLinks = nil
+	fakeServers := h.fakeServers
+	h.fakeServers = nil
+	h.mutex.Unlock()
+
+	for _, f := range fakeServers {
+		f.Close()
+	}
+
+	for _, link := range faultLinks {
+		link.Close()
+	}
+
+	for _, server := range servers {
+		server.Stop()
+	}
+}
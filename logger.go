@@ -0,0 +1,167 @@
+package boxcat
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// LogLevel is how important a log entry is.
+type LogLevel int
+
+const (
+	// LevelDebug is for IRC traffic.
+	LevelDebug LogLevel = iota
+
+	// LevelInfo is for output from catbox and what the harness is doing, such
+	// as building catbox.
+	LevelInfo
+
+	// LevelError is for problems, such as catbox exiting or a proxy failing
+	// to connect.
+	LevelError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+// LogEntry is something to log.
+type LogEntry struct {
+	Time  time.Time
+	Level LogLevel
+
+	// Source is what the entry is about, such as "client alice",
+	// "irc1 stderr", or "proxy 40000".
+	Source string
+
+	Message string
+}
+
+func (e LogEntry) String() string {
+	return e.Source + ": " + e.Message
+}
+
+// Logger receives log entries from clients, servers, and proxies.
+// Implementations must be safe to use from multiple goroutines.
+type Logger interface {
+	Log(LogEntry)
+}
+
+// LoggerFunc lets a function be a Logger.
+type LoggerFunc func(LogEntry)
+
+// Log calls f.
+func (f LoggerFunc) Log(e LogEntry) {
+	f(e)
+}
+
+// logf logs a formatted message.
+func logf(l Logger, level LogLevel, source, format string,
+	args ...interface{}) {
+	l.Log(LogEntry{
+		Time:    time.Now(),
+		Level:   level,
+		Source:  source,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// StdLogger logs using the standard log package. This is the default for
+// clients and servers started outside of a Harness.
+func StdLogger() Logger {
+	return LoggerFunc(func(e LogEntry) {
+		log.Print(e.String())
+	})
+}
+
+// DiscardLogger drops everything.
+func DiscardLogger() Logger {
+	return LoggerFunc(func(LogEntry) {})
+}
+
+// TBLogger logs to the test's output with Logf. The output only shows if the
+// test fails or runs verbosely, and stays with its test when tests run in
+// parallel.
+//
+// Logging after a test completes panics, so we drop entries once the test's
+// cleanup runs. Create the logger before anything that logs during cleanup,
+// such as a Harness.
+func TBLogger(tb testing.TB) Logger {
+	mutex := &sync.Mutex{}
+	done := false
+	tb.Cleanup(func() {
+		mutex.Lock()
+		defer mutex.Unlock()
+		done = true
+	})
+
+	return LoggerFunc(func(e LogEntry) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if done {
+			return
+		}
+		tb.Logf("%s %s", e.Time.Format("15:04:05.000"), e)
+	})
+}
+
+// jsonLogEntry is how JSONLogger formats an entry.
+type jsonLogEntry struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Source  string    `json:"source"`
+	Message string    `json:"message"`
+}
+
+// JSONLogger writes each entry to w as a line of JSON.
+func JSONLogger(w io.Writer) Logger {
+	mutex := &sync.Mutex{}
+	encoder := json.NewEncoder(w)
+
+	return LoggerFunc(func(e LogEntry) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		_ = encoder.Encode(jsonLogEntry{
+			Time:    e.Time,
+			Level:   e.Level.String(),
+			Source:  e.Source,
+			Message: e.Message,
+		})
+	})
+}
+
+// FilterLogger passes entries at or above the level to l. If there are
+// sources, we only pass entries whose source starts with one of them. For
+// example, "client alice" passes only alice's traffic.
+func FilterLogger(l Logger, level LogLevel, sources ...string) Logger {
+	return LoggerFunc(func(e LogEntry) {
+		if e.Level < level {
+			return
+		}
+		if len(sources) == 0 {
+			l.Log(e)
+			return
+		}
+		for _, source := range sources {
+			if strings.HasPrefix(e.Source, source) {
+				l.Log(e)
+				return
+			}
+		}
+	})
+}
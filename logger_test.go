@@ -0,0 +1,57 @@
+package boxcat
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestFilterLogger(t *testing.T) {
+	var got []string
+	l := FilterLogger(LoggerFunc(func(e LogEntry) {
+		got = append(got, e.String())
+	}), LevelInfo, "client alice", "irc1")
+
+	logf(l, LevelDebug, "client alice", "sent: PING x")
+	logf(l, LevelInfo, "client alice", "hi")
+	logf(l, LevelInfo, "client bob", "hi")
+	logf(l, LevelError, "irc1 stderr", "oops")
+
+	want := []string{"client alice: hi", "irc1 stderr: oops"}
+	if len(got) != len(want) {
+		t.Fatalf("logged %q, wanted %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("logged %q, wanted %q", got, want)
+		}
+	}
+}
+
+func TestJSONLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := JSONLogger(&buf)
+
+	when := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	l.Log(LogEntry{
+		Time:    when,
+		Level:   LevelDebug,
+		Source:  "client alice",
+		Message: "read: PING x",
+	})
+
+	var entry jsonLogEntry
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("error decoding %q: %s", buf.String(), err)
+	}
+	want := jsonLogEntry{
+		Time:    when,
+		Level:   "debug",
+		Source:  "client alice",
+		Message: "read: PING x",
+	}
+	if entry != want {
+		t.Fatalf("logged %+v, wanted %+v", entry, want)
+	}
+}
@@ -0,0 +1,187 @@
+package boxcat
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+)
+
+// LogLine is a line a catbox logged.
+type LogLine struct {
+	// Time is when we read the line.
+	Time time.Time
+
+	// Source is where the line came from. stdout or stderr.
+	Source string
+
+	Text string
+}
+
+func (l LogLine) String() string {
+	return fmt.Sprintf("%s %s: %s", l.Time.Format("15:04:05.000"), l.Source,
+		l.Text)
+}
+
+// LogRecorder keeps every line a catbox logs for the life of the process.
+//
+// Positions in the log act as cursors. Len tells you the current position and
+// you can wait for a line matching some pattern at or after any position.
+type LogRecorder struct {
+	name  string
+	lines []LogLine
+
+	// changed is closed whenever we add a line or close the recorder. We then
+	// replace it with a new channel. This lets waiters wake up.
+	changed chan struct{}
+
+	// closed is true once the process's output ended. We'll see no more lines.
+	closed bool
+
+	mutex *sync.Mutex
+}
+
+func newLogRecorder(name string) *LogRecorder {
+	return &LogRecorder{
+		name:    name,
+		changed: make(chan struct{}),
+		mutex:   &sync.Mutex{},
+	}
+}
+
+// add records a line.
+func (r *LogRecorder) add(source, text string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.lines = append(r.lines, LogLine{
+		Time:   time.Now(),
+		Source: source,
+		Text:   text,
+	})
+	r.notify()
+}
+
+// close indicates there will be no more lines.
+func (r *LogRecorder) close() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.closed = true
+	r.notify()
+}
+
+// notify wakes up waiters. The caller must hold the lock.
+func (r *LogRecorder) notify() {
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// Len returns the number of lines recorded so far. Use it as a cursor to
+// look for lines logged after this point.
+func (r *LogRecorder) Len() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.lines)
+}
+
+// Lines retrieves a copy of every line recorded so far.
+func (r *LogRecorder) Lines() []LogLine {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	lines := make([]LogLine, len(r.lines))
+	copy(lines, r.lines)
+	return lines
+}
+
+// Wait waits for a line matching the regexp at or after position from.
+//
+// We return the position of the line along with it. Passing the position
+// plus one as from to a later call continues after it.
+//
+// We give up when the context is done or when the process's output ends.
+func (r *LogRecorder) Wait(
+	ctx context.Context,
+	re *regexp.Regexp,
+	from int,
+) (int, LogLine, error) {
+	for {
+		r.mutex.Lock()
+		for i := from; i < len(r.lines); i++ {
+			if re.MatchString(r.lines[i].Text) {
+				line := r.lines[i]
+				r.mutex.Unlock()
+				return i, line, nil
+			}
+		}
+		if from < len(r.lines) {
+			from = len(r.lines)
+		}
+		closed := r.closed
+		changed := r.changed
+		r.mutex.Unlock()
+
+		if closed {
+			return -1, LogLine{}, fmt.Errorf(
+				"%s: output ended without a line matching %s", r.name, re)
+		}
+
+		select {
+		case <-ctx.Done():
+			return -1, LogLine{}, fmt.Errorf(
+				"%s: error waiting for line matching %s: %s", r.name, re, ctx.Err())
+		case <-changed:
+		}
+	}
+}
+
+// ExpectNone checks that no line at or after position from matches the
+// regexp, waiting for the window to pass. If one does, we return an error
+// with the line.
+//
+// We also return an error if the output ends before the window passes, such
+// as because the process crashed.
+func (r *LogRecorder) ExpectNone(
+	re *regexp.Regexp,
+	from int,
+	window time.Duration,
+) error {
+	ctx, cancel := context.WithTimeout(context.Background(), window)
+	defer cancel()
+
+	_, line, err := r.Wait(ctx, re, from)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil
+		}
+		return err
+	}
+	return fmt.Errorf("%s: logged line matching %s: %s", r.name, re, line.Text)
+}
+
+// Dump writes every line recorded so far to the writer.
+func (r *LogRecorder) Dump(w io.Writer) error {
+	for _, line := range r.Lines() {
+		if _, err := fmt.Fprintf(w, "%s %s\n", r.name, line); err != nil {
+			return fmt.Errorf("error writing log line: %s", err)
+		}
+	}
+	return nil
+}
+
+// DumpOnFailure logs every line recorded so far to the test output if the
+// test failed. It is useful to defer.
+func (r *LogRecorder) DumpOnFailure(t testing.TB) {
+	if !t.Failed() {
+		return
+	}
+
+	t.Logf("%s: full log:", r.name)
+	for _, line := range r.Lines() {
+		t.Logf("%s %s", r.name, line)
+	}
+}
@@ -0,0 +1,72 @@
+package boxcat
+
+import (
+	"bytes"
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogRecorder(t *testing.T) {
+	r := newLogRecorder("irc.example.org")
+	r.add("stderr", "catbox started")
+	r.add("stderr", "Established link to irc2.example.org.")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	linkRE := regexp.MustCompile(`Established link to (\S+)`)
+
+	// A second wait sees the same line as the first.
+	for i := 0; i < 2; i++ {
+		pos, line, err := r.Wait(ctx, linkRE, 0)
+		if err != nil {
+			t.Fatalf("error waiting for line: %s", err)
+		}
+		if pos != 1 || line.Source != "stderr" {
+			t.Fatalf("got line %d %s, wanted line 1 from stderr", pos, line)
+		}
+	}
+
+	// Waiting from a later position only sees later lines.
+	cursor := r.Len()
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		r.add("stdout", "Established link to irc3.example.org.")
+	}()
+	pos, line, err := r.Wait(ctx, linkRE, cursor)
+	if err != nil {
+		t.Fatalf("error waiting for line: %s", err)
+	}
+	if pos != 2 || !strings.Contains(line.Text, "irc3") {
+		t.Fatalf("got line %d %s, wanted line 2 about irc3", pos, line)
+	}
+
+	if err := r.ExpectNone(linkRE, r.Len(), 10*time.Millisecond); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := r.ExpectNone(linkRE, 0, 10*time.Millisecond); err == nil {
+		t.Fatalf("expected error about link line")
+	}
+
+	buf := &bytes.Buffer{}
+	if err := r.Dump(buf); err != nil {
+		t.Fatalf("error dumping: %s", err)
+	}
+	if n := strings.Count(buf.String(), "\n"); n != 3 {
+		t.Fatalf("dumped %d lines, wanted 3", n)
+	}
+
+	// Once closed, waits for lines that are not there end right away.
+	r.close()
+	if _, _, err := r.Wait(context.Background(), regexp.MustCompile(`panic`),
+		0); err == nil {
+		t.Fatalf("expected error waiting on closed recorder")
+	}
+	if err := r.ExpectNone(regexp.MustCompile(`panic`), 0,
+		time.Second); err == nil {
+		t.Fatalf("expected error expecting none on closed recorder")
+	}
+}
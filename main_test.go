@@ -0,0 +1,17 @@
+package boxcat
+
+import (
+	"log"
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+
+	if err := CleanBuilds(); err != nil {
+		log.Printf("%s", err)
+	}
+
+	os.Exit(code)
+}
@@ -0,0 +1,224 @@
+package boxcat
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/horgh/irc"
+)
+
+// Matcher decides whether a message is one we are waiting for.
+//
+// Matchers can be combined with AllOf, AnyOf, and Sequence.
+type Matcher interface {
+	// Match reports whether the message satisfies the matcher.
+	Match(m TaggedMessage) bool
+
+	// String describes the matcher. We use it in error messages.
+	String() string
+}
+
+// matchFunc is a Matcher built from a description and a function.
+type matchFunc struct {
+	desc string
+	f    func(TaggedMessage) bool
+}
+
+func (m matchFunc) Match(msg TaggedMessage) bool { return m.f(msg) }
+
+func (m matchFunc) String() string { return m.desc }
+
+// MatchFunc creates a Matcher from an arbitrary function. desc describes what
+// it matches.
+func MatchFunc(desc string, f func(TaggedMessage) bool) Matcher {
+	return matchFunc{desc: desc, f: f}
+}
+
+// Command matches messages with the given command. Commands are compared
+// case insensitively.
+func Command(command string) Matcher {
+	return matchFunc{
+		desc: fmt.Sprintf("command %s", command),
+		f: func(m TaggedMessage) bool {
+			return strings.EqualFold(m.Command, command)
+		},
+	}
+}
+
+// Prefix matches messages whose prefix matches the glob. The glob may contain
+// '*' to match any number of characters and '?' to match exactly one.
+func Prefix(glob string) Matcher {
+	re := globToRegexp(glob)
+	return matchFunc{
+		desc: fmt.Sprintf("prefix %s", glob),
+		f: func(m TaggedMessage) bool {
+			return re.MatchString(m.Prefix)
+		},
+	}
+}
+
+// SourceNick matches messages from the given nick. Nicks are compared case
+// insensitively.
+func SourceNick(nick string) Matcher {
+	return matchFunc{
+		desc: fmt.Sprintf("source nick %s", nick),
+		f: func(m TaggedMessage) bool {
+			return strings.EqualFold(m.SourceNick(), nick)
+		},
+	}
+}
+
+// Param matches messages where the parameter at index i is exactly value.
+func Param(i int, value string) Matcher {
+	return matchFunc{
+		desc: fmt.Sprintf("param %d = %q", i, value),
+		f: func(m TaggedMessage) bool {
+			return i < len(m.Params) && m.Params[i] == value
+		},
+	}
+}
+
+// ParamRE matches messages where the parameter at index i matches the
+// regular expression.
+func ParamRE(i int, re *regexp.Regexp) Matcher {
+	return matchFunc{
+		desc: fmt.Sprintf("param %d =~ %s", i, re),
+		f: func(m TaggedMessage) bool {
+			return i < len(m.Params) && re.MatchString(m.Params[i])
+		},
+	}
+}
+
+// Params matches messages that have exactly the given parameters.
+func Params(params ...string) Matcher {
+	return matchFunc{
+		desc: fmt.Sprintf("params %q", params),
+		f: func(m TaggedMessage) bool {
+			if len(m.Params) != len(params) {
+				return false
+			}
+			for i := range params {
+				if m.Params[i] != params[i] {
+					return false
+				}
+			}
+			return true
+		},
+	}
+}
+
+// Tag matches messages with the tag set to the value.
+func Tag(key, value string) Matcher {
+	return matchFunc{
+		desc: fmt.Sprintf("tag %s=%q", key, value),
+		f: func(m TaggedMessage) bool {
+			v, ok := m.Tag(key)
+			return ok && v == value
+		},
+	}
+}
+
+// HasTag matches messages with the tag, whatever its value.
+func HasTag(key string) Matcher {
+	return matchFunc{
+		desc: fmt.Sprintf("tag %s", key),
+		f: func(m TaggedMessage) bool {
+			_, ok := m.Tag(key)
+			return ok
+		},
+	}
+}
+
+// Message matches messages equal to want. The command is compared case
+// insensitively. If want has no prefix then we accept any prefix.
+func Message(want irc.Message) Matcher {
+	matchers := []Matcher{Command(want.Command), Params(want.Params...)}
+	if want.Prefix != "" {
+		matchers = append(matchers, Prefix(want.Prefix))
+	}
+	return AllOf(matchers...)
+}
+
+// AllOf matches messages that satisfy every one of the matchers.
+func AllOf(matchers ...Matcher) Matcher {
+	return matchFunc{
+		desc: describeMatchers("all of", matchers),
+		f: func(m TaggedMessage) bool {
+			for _, matcher := range matchers {
+				if !matcher.Match(m) {
+					return false
+				}
+			}
+			return true
+		},
+	}
+}
+
+// AnyOf matches messages that satisfy at least one of the matchers.
+func AnyOf(matchers ...Matcher) Matcher {
+	return matchFunc{
+		desc: describeMatchers("any of", matchers),
+		f: func(m TaggedMessage) bool {
+			for _, matcher := range matchers {
+				if matcher.Match(m) {
+					return true
+				}
+			}
+			return false
+		},
+	}
+}
+
+// sequence is a Matcher made up of several steps that must match messages in
+// order.
+type sequence []Matcher
+
+// Match reports whether the message matches the first step of the sequence.
+// Matching the whole sequence requires looking at several messages, which
+// Client.Expect takes care of.
+func (s sequence) Match(m TaggedMessage) bool {
+	return len(s) > 0 && s[0].Match(m)
+}
+
+func (s sequence) String() string {
+	return describeMatchers("sequence of", s)
+}
+
+// Sequence matches a series of messages in order. Other messages may arrive
+// between the ones making up the sequence. Expecting a sequence with no
+// matchers is an error.
+func Sequence(matchers ...Matcher) Matcher {
+	return sequence(matchers)
+}
+
+// steps breaks a Matcher into the matchers that must match one message each.
+func steps(m Matcher) []Matcher {
+	seq, ok := m.(sequence)
+	if !ok {
+		return []Matcher{m}
+	}
+
+	var s []Matcher
+	for _, matcher := range seq {
+		s = append(s, steps(matcher)...)
+	}
+	return s
+}
+
+func describeMatchers(kind string, matchers []Matcher) string {
+	var descs []string
+	for _, m := range matchers {
+		descs = append(descs, m.String())
+	}
+	return fmt.Sprintf("%s (%s)", kind, strings.Join(descs, ", "))
+}
+
+// globToRegexp converts an IRC style glob to an anchored, case insensitive
+// regexp.
+func globToRegexp(glob string) *regexp.Regexp {
+	re := regexp.QuoteMeta(glob)
+	re = strings.Replace(re, `\*`, `.*`, -1)
+	re = strings.Replace(re, `\?`, `.`, -1)
+	return regexp.MustCompile(`(?i)^` + re + `$`)
+}
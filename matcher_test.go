@@ -0,0 +1,178 @@
+package boxcat
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+func TestMatchers(t *testing.T) {
+	privmsg := TaggedMessage{
+		Tags: map[string]string{"msgid": "abc", "+draft/typing": ""},
+		Message: irc.Message{
+			Prefix:  "client1!~client1@127.0.0.1",
+			Command: "PRIVMSG",
+			Params:  []string{"#test", "hi there"},
+		},
+	}
+
+	tests := []struct {
+		matcher Matcher
+		want    bool
+	}{
+		{Command("PRIVMSG"), true},
+		{Command("privmsg"), true},
+		{Command("NOTICE"), false},
+		{Prefix("client1!*@127.0.0.1"), true},
+		{Prefix("CLIENT1!*"), true},
+		{Prefix("client?!*"), true},
+		{Prefix("client1"), false},
+		{SourceNick("client1"), true},
+		{SourceNick("client2"), false},
+		{Param(0, "#test"), true},
+		{Param(1, "#test"), false},
+		{Param(2, "#test"), false},
+		{ParamRE(1, regexp.MustCompile(`^hi`)), true},
+		{ParamRE(1, regexp.MustCompile(`^bye`)), false},
+		{Params("#test", "hi there"), true},
+		{Params("#test"), false},
+		{AllOf(Command("PRIVMSG"), Param(0, "#test")), true},
+		{AllOf(Command("PRIVMSG"), Param(0, "#other")), false},
+		{AnyOf(Command("NOTICE"), Command("PRIVMSG")), true},
+		{AnyOf(Command("NOTICE"), Command("JOIN")), false},
+		{Message(irc.Message{Command: "PRIVMSG",
+			Params: []string{"#test", "hi there"}}), true},
+		{Message(privmsg.Message), true},
+		{Message(irc.Message{Prefix: "client2!~client2@127.0.0.1",
+			Command: "PRIVMSG", Params: []string{"#test", "hi there"}}), false},
+		{Tag("msgid", "abc"), true},
+		{Tag("msgid", "abcd"), false},
+		{Tag("+draft/typing", ""), true},
+		{HasTag("+draft/typing"), true},
+		{HasTag("time"), false},
+		{MatchFunc("anything", func(TaggedMessage) bool { return true }), true},
+	}
+
+	for _, test := range tests {
+		got := test.matcher.Match(privmsg)
+		if got != test.want {
+			t.Errorf("%s matching %s = %t, wanted %t", test.matcher, privmsg, got,
+				test.want)
+		}
+	}
+}
+
+func TestInboxExpect(t *testing.T) {
+	ch := make(chan TaggedMessage, 10)
+	ch <- msg("NOTICE", "*", "hi")
+	ch <- msg("001", "client1", "welcome")
+	ch <- msg("JOIN", "#a")
+	ch <- msg("JOIN", "#b")
+	ch <- msg("PART", "#a")
+
+	b := newInbox(ch)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	m, err := b.expect(ctx, Command("001"))
+	if err != nil {
+		t.Fatalf("error expecting 001: %s", err)
+	}
+	if m.Command != "001" {
+		t.Fatalf("got %s, wanted 001", m)
+	}
+
+	// The sequence consumes the first JOIN and the PART following it.
+	m, err = b.expect(ctx, Sequence(Command("JOIN"), Command("PART")))
+	if err != nil {
+		t.Fatalf("error expecting sequence: %s", err)
+	}
+	if m.Command != "PART" {
+		t.Fatalf("got %s, wanted PART", m)
+	}
+
+	// We skipped past the NOTICE and a JOIN, but they are still available.
+	history := b.messages()
+	if len(history) != 2 {
+		t.Fatalf("history has %d messages, wanted 2", len(history))
+	}
+	if _, err := b.expect(ctx, Param(0, "#b")); err != nil {
+		t.Fatalf("error expecting JOIN #b: %s", err)
+	}
+	if _, err := b.expect(ctx, Command("NOTICE")); err != nil {
+		t.Fatalf("error expecting NOTICE: %s", err)
+	}
+
+	// A sequence that doesn't complete leaves the history alone.
+	ch <- msg("JOIN", "#c")
+	shortCtx, shortCancel := context.WithTimeout(context.Background(),
+		10*time.Millisecond)
+	defer shortCancel()
+	if _, err := b.expect(shortCtx, Sequence(Command("JOIN"),
+		Command("KICK"))); err == nil {
+		t.Fatalf("expected sequence to time out")
+	}
+	if len(b.messages()) != 1 {
+		t.Fatalf("history has %d messages, wanted 1", len(b.messages()))
+	}
+
+	// An empty sequence is an error rather than matching nothing.
+	for _, m := range []Matcher{Sequence(), Sequence(Sequence())} {
+		if _, err := b.expect(ctx, m); err == nil {
+			t.Fatalf("expected error expecting %s", m)
+		}
+	}
+	if len(b.messages()) != 1 {
+		t.Fatalf("history has %d messages, wanted 1", len(b.messages()))
+	}
+
+	close(ch)
+	if _, err := b.expect(ctx, Command("QUIT")); err == nil {
+		t.Fatalf("expected error once the channel closed")
+	}
+}
+
+func TestInboxExpectNone(t *testing.T) {
+	ch := make(chan TaggedMessage, 10)
+	ch <- msg("NOTICE", "*", "hi")
+
+	b := newInbox(ch)
+	ctx := context.Background()
+
+	if err := b.expectNone(ctx, Command("PRIVMSG"),
+		10*time.Millisecond); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// We saw the NOTICE while waiting so it is in the history now. It counts.
+	if err := b.expectNone(ctx, Command("NOTICE"),
+		10*time.Millisecond); err == nil {
+		t.Fatalf("expected error about NOTICE in history")
+	}
+
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		ch <- msg("PRIVMSG", "#test", "hi")
+	}()
+	if err := b.expectNone(ctx, Command("PRIVMSG"), time.Second); err == nil {
+		t.Fatalf("expected error about PRIVMSG")
+	}
+
+	// The PRIVMSG is still available.
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	if _, err := b.expect(ctx, Command("PRIVMSG")); err != nil {
+		t.Fatalf("error expecting PRIVMSG: %s", err)
+	}
+}
+
+// msg creates a message without tags or a prefix.
+func msg(command string, params ...string) TaggedMessage {
+	return TaggedMessage{
+		Message: irc.Message{Command: command, Params: params},
+	}
+}
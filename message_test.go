@@ -1,80 +1,103 @@
 package boxcat
 
 import (
-	"fmt"
-	"log"
 	"testing"
-	"time"
 
 	"github.com/horgh/irc"
 )
 
 // Test one client sending a message to another client.
 func TestPRIVMSG(t *testing.T) {
-	catbox, err := harnessCatbox("irc.example.org")
+	t.Parallel()
+
+	h := NewHarness(t)
+
+	catbox, err := h.StartServer(ServerOptions{Name: "irc.example.org"})
 	if err != nil {
 		t.Fatalf("error harnessing catbox: %s", err)
 	}
-	defer catbox.stop()
 
-	client1 := NewClient("client1", "127.0.0.1", catbox.Port)
-	recvChan1, sendChan1, _, err := client1.Start()
+	client1 := h.NewClient("client1", catbox)
+	_, sendChan1, _, err := client1.Start()
 	if err != nil {
 		t.Fatalf("error starting client: %s", err)
 	}
 	defer client1.Stop()
 
-	client2 := NewClient("client2", "127.0.0.1", catbox.Port)
-	recvChan2, _, _, err := client2.Start()
-	if err != nil {
+	client2 := h.NewClient("client2", catbox)
+	if _, _, _, err := client2.Start(); err != nil {
 		t.Fatalf("error starting client: %s", err)
 	}
 	defer client2.Stop()
 
-	if waitForMessage(t, recvChan1, irc.Message{Command: irc.ReplyWelcome},
-		"welcome from %s", client1.GetNick()) == nil {
-		t.Fatalf("client1 did not get welcome")
-	}
-	if waitForMessage(t, recvChan2, irc.Message{Command: irc.ReplyWelcome},
-		"welcome from %s", client2.GetNick()) == nil {
-		t.Fatalf("client2 did not get welcome")
-	}
+	expect(t, client1, Command(irc.ReplyWelcome))
+	expect(t, client2, Command(irc.ReplyWelcome))
 
 	sendChan1 <- irc.Message{
 		Command: "PRIVMSG",
 		Params:  []string{client2.GetNick(), "hi there"},
 	}
 
-	if waitForMessage(
-		t,
-		recvChan2,
-		irc.Message{
-			Command: "PRIVMSG",
-			Params:  []string{client2.GetNick(), "hi there"},
-		},
-		"%s received PRIVMSG from %s", client1.GetNick(), client2.GetNick(),
-	) == nil {
-		t.Fatalf("client1 did not receive message from client2")
-	}
+	expect(t, client2, AllOf(
+		SourceNick(client1.GetNick()),
+		Command("PRIVMSG"),
+		Params(client2.GetNick(), "hi there"),
+	))
+
+	// The server must not echo the message back to the sender.
+	expectNone(t, client1, Command("PRIVMSG"))
 }
 
-func waitForMessage(
-	t *testing.T,
-	ch <-chan irc.Message,
-	want irc.Message,
-	format string,
-	a ...interface{},
-) *irc.Message {
-	for {
-		select {
-		case <-time.After(10 * time.Second):
-			t.Logf("timeout waiting for message: %s", want)
-			return nil
-		case got := <-ch:
-			if got.Command == want.Command {
-				log.Printf("got command: %s", fmt.Sprintf(format, a...))
-				return &got
-			}
+// Test a message to a channel reaches only the clients in the channel.
+func TestPRIVMSGChannel(t *testing.T) {
+	t.Parallel()
+
+	h := NewHarness(t)
+
+	catbox, err := h.StartServer(ServerOptions{Name: "irc.example.org"})
+	if err != nil {
+		t.Fatalf("error harnessing catbox: %s", err)
+	}
+
+	var clients []*Client
+	var sendChans []chan<- irc.Message
+	for _, nick := range []string{"client1", "client2", "client3"} {
+		client := h.NewClient(nick, catbox)
+		_, sendChan, _, err := client.Start()
+		if err != nil {
+			t.Fatalf("error starting client: %s", err)
 		}
+		defer client.Stop()
+
+		expect(t, client, Command(irc.ReplyWelcome))
+
+		clients = append(clients, client)
+		sendChans = append(sendChans, sendChan)
 	}
+
+	// client1 and client2 join. client3 stays outside.
+	for i := 0; i < 2; i++ {
+		sendChans[i] <- irc.Message{
+			Command: "JOIN",
+			Params:  []string{"#test"},
+		}
+		expect(t, clients[i], AllOf(
+			SourceNick(clients[i].GetNick()),
+			Command("JOIN"),
+			Params("#test"),
+		))
+	}
+
+	sendChans[0] <- irc.Message{
+		Command: "PRIVMSG",
+		Params:  []string{"#test", "hi there"},
+	}
+
+	expect(t, clients[1], AllOf(
+		SourceNick(clients[0].GetNick()),
+		Command("PRIVMSG"),
+		Params("#test", "hi there"),
+	))
+	expectNone(t, clients[0], Command("PRIVMSG"))
+	expectNone(t, clients[2], Command("PRIVMSG"))
 }
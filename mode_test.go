@@ -14,94 +14,53 @@ import (
 // Also test that the TS gets propagated between servers and a client on
 // another server gets the same TS
 func TestMODETS(t *testing.T) {
-	catbox1, err := harnessCatbox("irc1.example.org")
-	if err != nil {
-		t.Fatalf("error harnessing catbox: %s", err)
-	}
-	defer catbox1.stop()
-
-	catbox2, err := harnessCatbox("irc2.example.org")
-	if err != nil {
-		t.Fatalf("error harnessing catbox: %s", err)
-	}
-	defer catbox2.stop()
+	t.Parallel()
 
-	if err := catbox1.linkServer(catbox2); err != nil {
-		t.Fatalf("error linking catbox1 to catbox2: %s", err)
-	}
-	if err := catbox2.linkServer(catbox1); err != nil {
-		t.Fatalf("error linking catbox2 to catbox1: %s", err)
-	}
+	h := NewHarness(t)
 
-	linkRE := regexp.MustCompile(`Established link to irc2\.`)
-	if !waitForLog(catbox1.LogChan, linkRE) {
-		t.Fatalf("failed to see servers link")
+	network, err := h.StartTopology(Chain(2))
+	if err != nil {
+		t.Fatalf("error starting servers: %s", err)
 	}
+	catbox1, catbox2 := network.Servers[0], network.Servers[1]
 
-	client1 := NewClient("client1", "127.0.0.1", catbox1.Port)
-	recvChan1, sendChan1, _, err := client1.Start()
+	client1 := h.NewClient("client1", catbox1)
+	_, sendChan1, _, err := client1.Start()
 	if err != nil {
 		t.Fatalf("error starting client: %s", err)
 	}
 	defer client1.Stop()
 
-	if waitForMessage(t, recvChan1, irc.Message{Command: irc.ReplyWelcome},
-		"welcome from %s", client1.GetNick()) == nil {
-		t.Fatalf("client1 did not get welcome")
-	}
+	expect(t, client1, Command(irc.ReplyWelcome))
 
 	sendChan1 <- irc.Message{
 		Command: "JOIN",
 		Params:  []string{"#test"},
 	}
-	if waitForMessage(
-		t,
-		recvChan1,
-		irc.Message{
-			Command: "JOIN",
-			Params:  []string{"#test"},
-		},
-		"%s received JOIN #test", client1.GetNick(),
-	) == nil {
-		t.Fatalf("client1 did not receive JOIN message")
-	}
+	expect(t, client1, AllOf(
+		SourceNick(client1.GetNick()),
+		Command("JOIN"),
+		Params("#test"),
+	))
 
 	sendChan1 <- irc.Message{
 		Command: "MODE",
 		Params:  []string{"#test"},
 	}
-	creationTimeMessage := waitForMessage(
-		t,
-		recvChan1,
-		irc.Message{
-			Command: "329",
-		},
-		"%s received 329 response after MODE command", client1.GetNick(),
-	)
-	if creationTimeMessage == nil {
-		t.Fatalf("client1 did not receive 329 response")
-	}
+	creationTimeMessage := expect(t, client1, AllOf(
+		Prefix(catbox1.Name),
+		Command("329"),
+		Param(0, client1.GetNick()),
+		Param(1, "#test"),
+		ParamRE(2, regexp.MustCompile(`^\d+$`)),
+	))
 
-	creationTimeString := ""
-	creationTime := time.Time{}
-	if len(creationTimeMessage.Params) >= 3 {
-		ct, err := strconv.ParseInt(creationTimeMessage.Params[2], 10, 64)
-		if err != nil {
-			t.Fatalf("error parsing 329 response unixtime: %s", err)
-		}
-		creationTimeString = creationTimeMessage.Params[2]
-		creationTime = time.Unix(ct, 0)
+	creationTimeString := creationTimeMessage.Params[2]
+	ct, err := strconv.ParseInt(creationTimeString, 10, 64)
+	if err != nil {
+		t.Fatalf("error parsing 329 response unixtime: %s", err)
 	}
-
-	messageIsEqual(
-		t,
-		creationTimeMessage,
-		&irc.Message{
-			Prefix:  catbox1.Name,
-			Command: "329",
-			Params:  []string{client1.GetNick(), "#test", creationTimeString},
-		},
-	)
+	creationTime := time.Unix(ct, 0)
 
 	if time.Now().Sub(creationTime) > 30*time.Second {
 		t.Fatalf("channel creation time is too far in the past: %s", creationTime)
@@ -109,57 +68,35 @@ func TestMODETS(t *testing.T) {
 
 	// Try a client on the other server and ensure they get the same time.
 
-	client2 := NewClient("client2", "127.0.0.1", catbox2.Port)
-	recvChan2, sendChan2, _, err := client2.Start()
+	client2 := h.NewClient("client2", catbox2)
+	_, sendChan2, _, err := client2.Start()
 	if err != nil {
 		t.Fatalf("error starting client: %s", err)
 	}
 	defer client2.Stop()
 
-	if waitForMessage(t, recvChan2, irc.Message{Command: irc.ReplyWelcome},
-		"welcome from %s", client2.GetNick()) == nil {
-		t.Fatalf("client2 did not get welcome")
-	}
+	expect(t, client2, Command(irc.ReplyWelcome))
 
 	sendChan2 <- irc.Message{
 		Command: "JOIN",
 		Params:  []string{"#test"},
 	}
-	if waitForMessage(
-		t,
-		recvChan2,
-		irc.Message{
-			Command: "JOIN",
-			Params:  []string{"#test"},
-		},
-		"%s received JOIN #test", client2.GetNick(),
-	) == nil {
-		t.Fatalf("client2 did not receive JOIN message")
-	}
+	expect(t, client2, AllOf(
+		SourceNick(client2.GetNick()),
+		Command("JOIN"),
+		Params("#test"),
+	))
 
 	sendChan2 <- irc.Message{
 		Command: "MODE",
 		Params:  []string{"#test"},
 	}
-	creationTimeMessage2 := waitForMessage(
-		t,
-		recvChan2,
-		irc.Message{
-			Command: "329",
-		},
-		"%s received 329 response after MODE command", client2.GetNick(),
-	)
-	if creationTimeMessage == nil {
-		t.Fatalf("client2 did not receive 329 response")
-	}
+	expect(t, client2, Message(irc.Message{
+		Prefix:  catbox2.Name,
+		Command: "329",
+		Params:  []string{client2.GetNick(), "#test", creationTimeString},
+	}))
 
-	messageIsEqual(
-		t,
-		creationTimeMessage2,
-		&irc.Message{
-			Prefix:  catbox2.Name,
-			Command: "329",
-			Params:  []string{client2.GetNick(), "#test", creationTimeString},
-		},
-	)
+	// Beyond the TS, the servers agree on everything else about #test.
+	checkConsistency(t, h, "#test")
 }
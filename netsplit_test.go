@@ -0,0 +1,75 @@
+package boxcat
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// Test clients see each other quit when their servers split, and rejoin when
+// the servers link again.
+func TestNetsplit(t *testing.T) {
+	t.Parallel()
+
+	h := NewHarness(t)
+
+	catbox1, err := h.StartServer(ServerOptions{Name: "irc1.example.org"})
+	if err != nil {
+		t.Fatalf("error harnessing catbox: %s", err)
+	}
+	catbox2, err := h.StartServer(ServerOptions{Name: "irc2.example.org"})
+	if err != nil {
+		t.Fatalf("error harnessing catbox: %s", err)
+	}
+
+	link, err := h.LinkWithFaults(catbox1, catbox2)
+	if err != nil {
+		t.Fatalf("error linking servers: %s", err)
+	}
+
+	client1 := h.NewClient("client1", catbox1)
+	_, sendChan1, _, err := client1.Start()
+	if err != nil {
+		t.Fatalf("error starting client: %s", err)
+	}
+	defer client1.Stop()
+
+	client2 := h.NewClient("client2", catbox2)
+	_, sendChan2, _, err := client2.Start()
+	if err != nil {
+		t.Fatalf("error starting client: %s", err)
+	}
+	defer client2.Stop()
+
+	expect(t, client1, Command(irc.ReplyWelcome))
+	expect(t, client2, Command(irc.ReplyWelcome))
+
+	sendChan1 <- irc.Message{Command: "JOIN", Params: []string{"#test"}}
+	expect(t, client1, AllOf(SourceNick(client1.GetNick()), Command("JOIN")))
+
+	sendChan2 <- irc.Message{Command: "JOIN", Params: []string{"#test"}}
+	expect(t, client1, AllOf(SourceNick(client2.GetNick()), Command("JOIN")))
+
+	// Slow the link. Messages still get through.
+	link.SetDelay(BothWays, 200*time.Millisecond, 50*time.Millisecond)
+	sendChan2 <- irc.Message{
+		Command: "PRIVMSG",
+		Params:  []string{"#test", "slowly"},
+	}
+	expect(t, client1, AllOf(Command("PRIVMSG"), Params("#test", "slowly")))
+
+	link.Split()
+	expect(t, client1, AllOf(SourceNick(client2.GetNick()), Command("QUIT")))
+
+	from := catbox1.Log.Len()
+	link.Heal()
+	if !waitForLog(catbox1.Log, regexp.MustCompile(
+		`Established link to irc2\.`), from) {
+		t.Fatalf("failed to see servers link again")
+	}
+	expect(t, client1, AllOf(SourceNick(client2.GetNick()), Command("JOIN")))
+
+	checkConsistency(t, h, "#test")
+}
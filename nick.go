@@ -0,0 +1,175 @@
+package boxcat
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+
+	"github.com/horgh/irc"
+)
+
+// NickFallback is how a Client picks another nick if the server says the one
+// it tried is in use while registering.
+type NickFallback int
+
+const (
+	// NickSuffix appends '_' to the nick. This is the default.
+	NickSuffix NickFallback = iota
+
+	// NickIncrement appends 'a' to the nick until it is as long as allowed,
+	// then increments its characters in turn. For example, client1 becomes
+	// client1a.
+	NickIncrement
+
+	// NickRandom appends random digits to the nick, replacing its end if it is
+	// as long as allowed.
+	NickRandom
+
+	// NickNoFallback means we do not try another nick. Registering fails
+	// instead.
+	NickNoFallback
+)
+
+// defaultMaxNickLength is the longest nick we choose when falling back. It
+// matches catbox's default.
+const defaultMaxNickLength = 9
+
+// maxNickAttempts is how many nicks we try when registering before we give
+// up.
+const maxNickAttempts = 20
+
+// SetNickFallback sets how the client picks another nick if its nick is in
+// use when it registers. Call it before Start.
+//
+// maxLength is the longest nick the server allows. If it is zero we use 9.
+func (c *Client) SetNickFallback(policy NickFallback, maxLength int) {
+	c.nickFallback = policy
+	if maxLength > 0 {
+		c.maxNickLength = maxLength
+	}
+}
+
+// handleRegistrationNick deals with the server's response to our nick while
+// we register. We try another nick if ours is in use (433), and fail if the
+// server rejects it (432) or we run out of nicks to try. After we register
+// these numerics are only replies to NICK commands so we leave them alone.
+//
+// Once we are welcomed (001) we take the nick the server tells us we have.
+func (c *Client) handleRegistrationNick(m TaggedMessage) error {
+	if m.Command == irc.ReplyWelcome {
+		c.mutex.Lock()
+		c.registered = true
+		if len(m.Params) > 0 {
+			c.nick = m.Params[0]
+		}
+		c.mutex.Unlock()
+		return nil
+	}
+
+	if m.Command != "432" && m.Command != "433" {
+		return nil
+	}
+
+	c.mutex.Lock()
+	if c.registered {
+		c.mutex.Unlock()
+		return nil
+	}
+
+	if m.Command == "432" {
+		nick := c.nick
+		c.mutex.Unlock()
+		return fmt.Errorf("server rejected nick %s as erroneous: %s", nick,
+			lastParam(m))
+	}
+
+	inUse := c.nick
+	if c.nickAttempts+1 >= maxNickAttempts {
+		c.mutex.Unlock()
+		return fmt.Errorf("nick %s is in use and we tried %d nicks", inUse,
+			maxNickAttempts)
+	}
+
+	nick, err := fallbackNick(c.nickFallback, inUse, c.maxNickLength)
+	if err != nil {
+		c.mutex.Unlock()
+		return fmt.Errorf("nick %s is in use: %s", inUse, err)
+	}
+	c.nick = nick
+	c.nickAttempts++
+	c.mutex.Unlock()
+
+	if err := c.writeMessage(irc.Message{
+		Command: "NICK",
+		Params:  []string{nick},
+	}); err != nil {
+		return fmt.Errorf("error sending NICK: %s", err)
+	}
+	return nil
+}
+
+// trackNick updates our nick if the message shows it changed.
+func (c *Client) trackNick(m TaggedMessage) {
+	if m.Command != "NICK" || len(m.Params) == 0 {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if strings.EqualFold(m.SourceNick(), c.nick) {
+		c.nick = m.Params[0]
+	}
+}
+
+// fallbackNick picks the next nick to try according to the policy.
+func fallbackNick(policy NickFallback, nick string,
+	maxLength int) (string, error) {
+	switch policy {
+	case NickSuffix:
+		if len(nick) >= maxLength {
+			return "", fmt.Errorf("nick is too long to add a suffix")
+		}
+		return nick + "_", nil
+	case NickIncrement:
+		return incrementNick(nick, maxLength)
+	case NickRandom:
+		suffix := fmt.Sprintf("%03d", rand.Intn(1000))
+		if len(nick)+len(suffix) > maxLength {
+			if maxLength <= len(suffix) {
+				return "", fmt.Errorf("maximum nick length is too short")
+			}
+			nick = nick[:maxLength-len(suffix)]
+		}
+		return nick + suffix, nil
+	case NickNoFallback:
+		return "", fmt.Errorf("nick fallback is disabled")
+	default:
+		return "", fmt.Errorf("unknown nick fallback policy: %d", policy)
+	}
+}
+
+// incrementNick appends 'a' to the nick until it is maxLength long. After
+// that it increments the first character that is less than 'z'.
+func incrementNick(nick string, maxLength int) (string, error) {
+	if len(nick) < maxLength {
+		return nick + "a", nil
+	}
+
+	for i := 0; i < maxLength; i++ {
+		if nick[i] < 'z' {
+			return nick[0:i] + string(nick[i]+1) + nick[i+1:maxLength], nil
+		}
+	}
+
+	return "", fmt.Errorf("exhausted nicks")
+}
+
+// lastParam retrieves the last parameter of the message, or blank if there
+// is none. For numerics this is usually the human readable text.
+func lastParam(m TaggedMessage) string {
+	if len(m.Params) == 0 {
+		return ""
+	}
+	return m.Params[len(m.Params)-1]
+}
@@ -0,0 +1,141 @@
+package boxcat
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFallbackNick(t *testing.T) {
+	tests := []struct {
+		policy    NickFallback
+		nick      string
+		maxLength int
+		want      string
+		err       bool
+	}{
+		{NickSuffix, "client1", 9, "client1_", false},
+		{NickSuffix, "client1__", 9, "", true},
+		{NickIncrement, "client1", 9, "client1a", false},
+		{NickIncrement, "client1aa", 9, "dlient1aa", false},
+		{NickIncrement, "zzz", 3, "", true},
+		{NickNoFallback, "client1", 9, "", true},
+	}
+
+	for _, test := range tests {
+		got, err := fallbackNick(test.policy, test.nick, test.maxLength)
+		if err != nil {
+			if !test.err {
+				t.Errorf("fallbackNick(%d, %s) = error %s", test.policy, test.nick,
+					err)
+			}
+			continue
+		}
+		if test.err {
+			t.Errorf("fallbackNick(%d, %s) = %s, wanted error", test.policy,
+				test.nick, got)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("fallbackNick(%d, %s) = %s, wanted %s", test.policy,
+				test.nick, got, test.want)
+		}
+	}
+
+	re := regexp.MustCompile(`^client\d{3}$`)
+	for i := 0; i < 10; i++ {
+		got, err := fallbackNick(NickRandom, "client123", 9)
+		if err != nil {
+			t.Fatalf("fallbackNick(random) = error %s", err)
+		}
+		if !re.MatchString(got) {
+			t.Fatalf("fallbackNick(random) = %s", got)
+		}
+	}
+}
+
+// Test the client picks another nick when its nick is in use while
+// registering, and that GetNick reflects the nick it ends up with.
+func TestClientNickInUse(t *testing.T) {
+	server := newTestServer(t)
+	defer server.close()
+
+	client := server.newClient("client1")
+	client.SetNickFallback(NickIncrement, 0)
+
+	server.serve(
+		server.accept,
+		server.expecting("NICK client1", "USER client1 0 * client1"),
+		server.sending(
+			":irc.example.org 433 * client1 :Nickname is already in use"),
+		server.expecting("NICK client1a"),
+		server.sending(
+			":irc.example.org 433 * client1a :Nickname is already in use"),
+		server.expecting("NICK client1aa"),
+		server.sending(":irc.example.org 001 client1aa :Welcome"),
+	)
+
+	if _, _, _, err := client.Start(); err != nil {
+		t.Fatalf("error starting client: %s", err)
+	}
+	defer client.Stop()
+	server.wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := client.Expect(ctx, Command("001")); err != nil {
+		t.Fatalf("error waiting for welcome: %s", err)
+	}
+	if client.GetNick() != "client1aa" {
+		t.Fatalf("nick is %s, wanted client1aa", client.GetNick())
+	}
+
+	// Once registered, 433 is a reply to NICK and we don't fall back.
+	if err := server.send(
+		":irc.example.org 433 client1aa client2 :Nickname is already in use",
+		":client1aa!u@h NICK client3",
+	); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if _, err := client.Expect(ctx, Command("NICK")); err != nil {
+		t.Fatalf("error waiting for NICK: %s", err)
+	}
+	if client.GetNick() != "client3" {
+		t.Fatalf("nick is %s, wanted client3", client.GetNick())
+	}
+}
+
+// Test the client reports an error if the server rejects its nick.
+func TestClientErroneousNick(t *testing.T) {
+	server := newTestServer(t)
+	defer server.close()
+
+	client := server.newClient("client1")
+
+	server.serve(
+		server.accept,
+		server.expecting("NICK client1", "USER client1 0 * client1"),
+		server.sending(":irc.example.org 432 * client1 :Erroneous nickname"),
+	)
+
+	if _, _, _, err := client.Start(); err != nil {
+		t.Fatalf("error starting client: %s", err)
+	}
+	defer client.Stop()
+	server.wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := client.Expect(ctx, Command("001"))
+	if err == nil {
+		t.Fatalf("expected error waiting for welcome")
+	}
+	if !strings.Contains(err.Error(), "erroneous") {
+		t.Fatalf("error does not describe the problem: %s", err)
+	}
+	if client.Err() == nil {
+		t.Fatalf("client has no error")
+	}
+}
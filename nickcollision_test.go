@@ -0,0 +1,421 @@
+package boxcat
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// Test how catbox resolves a nick collision with a user introduced by another
+// server, using a fake server so we choose the timestamps.
+//
+// The users have different user@hosts, so under the TS rules the one with
+// the older nick TS keeps the nick and the other is killed. If the TSes are
+// the same, both are killed.
+func TestNickCollisionTS(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		// tsOffset is added to the local user's TS to get the remote user's.
+		tsOffset    int64
+		localKilled bool
+		fakeKilled  bool
+	}{
+		{"remote older", -100, true, false},
+		{"remote newer", 100, false, true},
+		{"same TS", 0, true, true},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			h := NewHarness(t)
+
+			catbox, err := h.StartServer(ServerOptions{Name: "irc.example.org"})
+			if err != nil {
+				t.Fatalf("error starting catbox: %s", err)
+			}
+
+			local := h.NewClient("alice", catbox)
+			local.SetNickFallback(NickNoFallback, 0)
+			if _, _, _, err := local.Start(); err != nil {
+				t.Fatalf("error starting client: %s", err)
+			}
+			defer local.Stop()
+			expect(t, local, Command(irc.ReplyWelcome))
+
+			// Link after the client registers so the burst tells us its UID and
+			// TS.
+			fake, err := h.ConnectFakeServer(catbox, FakeServerOptions{
+				Name: "fake.example.org",
+			})
+			if err != nil {
+				t.Fatalf("error linking fake server: %s", err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), expectTimeout)
+			defer cancel()
+
+			// UID <nick> <hops> <TS> <modes> <username> <host> <IP> <UID> ...
+			uid, err := fake.Expect(ctx, AllOf(Command("UID"), Param(0, "alice")))
+			if err != nil {
+				t.Fatalf("%s", err)
+			}
+			if len(uid.Params) < 8 {
+				t.Fatalf("malformed UID: %s", uid)
+			}
+			localUID := uid.Params[7]
+			localTS, err := strconv.ParseInt(uid.Params[2], 10, 64)
+			if err != nil {
+				t.Fatalf("error parsing TS: %s", err)
+			}
+
+			fakeUID, err := fake.UID(FakeUser{
+				Nick:     "alice",
+				TS:       localTS + test.tsOffset,
+				RealName: "fake alice",
+			})
+			if err != nil {
+				t.Fatalf("error sending UID: %s", err)
+			}
+
+			killed := AllOf(Command("KILL"), Param(0, fakeUID))
+			if test.fakeKilled {
+				if _, err := fake.Expect(ctx, killed); err != nil {
+					t.Fatalf("%s", err)
+				}
+			} else {
+				if err := fake.ExpectNone(killed, noMessageWindow); err != nil {
+					t.Fatalf("%s", err)
+				}
+			}
+
+			if test.localKilled {
+				expect(t, local, AnyOf(Command("KILL"), Command("ERROR")))
+				// catbox tells the rest of the network its user is gone.
+				if _, err := fake.Expect(ctx, AnyOf(
+					AllOf(Command("KILL"), Param(0, localUID)),
+					AllOf(Prefix(localUID), Command("QUIT")),
+				)); err != nil {
+					t.Fatalf("%s", err)
+				}
+			} else {
+				expectNone(t, local, AnyOf(Command("KILL"), Command("ERROR")))
+			}
+
+			// catbox agrees on who has the nick now.
+			observer := h.NewClient("observer", catbox)
+			if _, _, _, err := observer.Start(); err != nil {
+				t.Fatalf("error starting client: %s", err)
+			}
+			defer observer.Stop()
+			expect(t, observer, Command(irc.ReplyWelcome))
+
+			if err := observer.Send(msg("WHOIS", "alice")); err != nil {
+				t.Fatalf("error sending WHOIS: %s", err)
+			}
+			// 311 <us> <nick> <username> <host> * :<real name>
+			switch {
+			case !test.localKilled:
+				expect(t, observer, AllOf(Command("311"), Param(1, "alice"),
+					Param(5, "alice")))
+			case !test.fakeKilled:
+				expect(t, observer, AllOf(Command("311"), Param(1, "alice"),
+					Param(5, "fake alice")))
+			default:
+				expect(t, observer, AllOf(Command("401"), Param(1, "alice")))
+			}
+		})
+	}
+}
+
+// Test clients registering the same nick on two linked servers at the same
+// time. cmd/connstress does this for longer with many more clients.
+//
+// We delay traffic between the servers so both clients always register
+// before either server hears about the other. A fake server linked to each
+// catbox tells us the TS of the user it introduced. From those we work out
+// which clients the TS rules say must be killed, and check those and only
+// those are, and that both servers agree on who has the nick.
+func TestNickCollisionRace(t *testing.T) {
+	t.Parallel()
+
+	h := NewHarness(t)
+
+	catbox1, err := h.StartServer(ServerOptions{Name: "irc1.example.org"})
+	if err != nil {
+		t.Fatalf("error starting catbox: %s", err)
+	}
+	catbox2, err := h.StartServer(ServerOptions{Name: "irc2.example.org"})
+	if err != nil {
+		t.Fatalf("error starting catbox: %s", err)
+	}
+	servers := []*Catbox{catbox1, catbox2}
+
+	link, err := h.LinkWithFaults(catbox1, catbox2)
+	if err != nil {
+		t.Fatalf("error linking servers: %s", err)
+	}
+
+	var fakes []*FakeServer
+	for i, server := range servers {
+		fake, err := h.ConnectFakeServer(server, FakeServerOptions{
+			Name: fmt.Sprintf("fake%d.example.org", i+1),
+			SID:  fmt.Sprintf("%dZZ", 8+i),
+		})
+		if err != nil {
+			t.Fatalf("error linking fake server: %s", err)
+		}
+		fakes = append(fakes, fake)
+	}
+
+	// Everyone left joins the channel so we can check the servers agree on it
+	// at the end.
+	const channel = "#race"
+
+	var watchers []*Client
+	var clients []*Client
+	defer func() {
+		for _, client := range append(watchers, clients...) {
+			client.Stop()
+		}
+	}()
+	for i, server := range servers {
+		watcher := h.NewClient(fmt.Sprintf("watch%d", i+1), server)
+		if _, _, _, err := watcher.Start(); err != nil {
+			t.Fatalf("error starting client: %s", err)
+		}
+		watchers = append(watchers, watcher)
+		expect(t, watcher, Command(irc.ReplyWelcome))
+		if err := watcher.Send(msg("JOIN", channel)); err != nil {
+			t.Fatalf("error joining: %s", err)
+		}
+		expect(t, watcher, AllOf(Command("366"), Param(1, channel)))
+	}
+
+	link.SetDelay(BothWays, 500*time.Millisecond, 0)
+
+	for round := 0; round < 5; round++ {
+		nick := fmt.Sprintf("racer%d", round)
+
+		racers := []*Client{
+			h.NewClient(nick, catbox1),
+			h.NewClient(nick, catbox2),
+		}
+		started := make([]bool, len(racers))
+		var wg sync.WaitGroup
+		for i, racer := range racers {
+			racer.SetNickFallback(NickNoFallback, 0)
+
+			wg.Add(1)
+			go func(i int, racer *Client) {
+				defer wg.Done()
+				// Registering fails if the other server wins quickly. Then only
+				// one client is in the race.
+				_, _, _, err := racer.Start()
+				started[i] = err == nil
+			}(i, racer)
+		}
+		wg.Wait()
+
+		for i, racer := range racers {
+			if started[i] {
+				clients = append(clients, racer)
+				_ = racer.Send(msg("JOIN", channel))
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), expectTimeout)
+
+		// Each server introduces its own user to its fake server straight
+		// away. The UID starts with the server's SID.
+		intros := make([]introduction, len(racers))
+		for i, fake := range fakes {
+			if !started[i] {
+				continue
+			}
+			uid, err := fake.Expect(ctx, AllOf(
+				Command("UID"),
+				Param(0, nick),
+				ParamRE(7, regexp.MustCompile(`^`+regexp.QuoteMeta(fake.PeerSID))),
+			))
+			if err != nil {
+				cancel()
+				t.Fatalf("round %d: %s", round, err)
+			}
+			intros[i], err = parseIntroduction(uid)
+			if err != nil {
+				cancel()
+				t.Fatalf("round %d: %s", round, err)
+			}
+		}
+		cancel()
+
+		lost := []bool{false, false}
+		if started[0] && started[1] {
+			lost[0], lost[1] = collisionLosers(intros[0], intros[1])
+		}
+
+		want := ""
+		for i, racer := range racers {
+			if !started[i] {
+				continue
+			}
+			err := racer.ExpectNone(AnyOf(Command("KILL"), Command("ERROR")),
+				2*time.Second)
+			killed := err != nil || racer.Err() != nil
+			if killed != lost[i] {
+				t.Fatalf("round %d: client on %s (TS %d) killed = %t, wanted %t "+
+					"(TSes %d and %d)", round, servers[i].Name, intros[i].ts, killed,
+					lost[i], intros[0].ts, intros[1].ts)
+			}
+			if !killed {
+				want = servers[i].Name
+			}
+		}
+
+		// The servers agree on who has the nick.
+		deadline := time.Now().Add(expectTimeout)
+		for {
+			got1 := whoisServer(t, watchers[0], nick)
+			got2 := whoisServer(t, watchers[1], nick)
+			if got1 == want && got2 == want {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("round %d: %s says %s is on %q, %s says %q, wanted %q",
+					round, catbox1.Name, nick, got1, catbox2.Name, got2, want)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	link.SetDelay(BothWays, 0, 0)
+
+	for _, server := range servers {
+		expectServerAlive(t, h, server)
+	}
+	checkConsistency(t, h, channel)
+}
+
+// introduction is a user a server introduced with UID.
+type introduction struct {
+	ts       int64
+	username string
+	host     string
+}
+
+// parseIntroduction reads a UID message.
+//
+// UID <nick> <hops> <TS> <modes> <username> <host> <IP> <UID> :<real name>
+func parseIntroduction(m TaggedMessage) (introduction, error) {
+	if len(m.Params) < 8 {
+		return introduction{}, fmt.Errorf("malformed UID: %s", m)
+	}
+	ts, err := strconv.ParseInt(m.Params[2], 10, 64)
+	if err != nil {
+		return introduction{}, fmt.Errorf("error parsing TS: %s", err)
+	}
+	return introduction{
+		ts:       ts,
+		username: m.Params[4],
+		host:     m.Params[5],
+	}, nil
+}
+
+// collisionLosers applies the TS6 rules to two users with the same nick. It
+// says whether each must lose the nick.
+//
+// If the TSes are the same, both lose. If the users have the same user@host,
+// the older loses since it is probably a client that is reconnecting.
+// Otherwise the newer loses.
+func collisionLosers(a, b introduction) (bool, bool) {
+	if a.ts == b.ts {
+		return true, true
+	}
+	aOlder := a.ts < b.ts
+	if a.username == b.username && a.host == b.host {
+		return aOlder, !aOlder
+	}
+	return !aOlder, aOlder
+}
+
+func TestCollisionLosers(t *testing.T) {
+	alice := introduction{ts: 100, username: "alice", host: "a.example.org"}
+	bob := introduction{ts: 200, username: "bob", host: "b.example.org"}
+	aliceLater := introduction{ts: 200, username: "alice", host: "a.example.org"}
+
+	tests := []struct {
+		a, b         introduction
+		aLost, bLost bool
+	}{
+		{alice, bob, false, true},
+		{bob, alice, true, false},
+		{alice, aliceLater, true, false},
+		{aliceLater, bob, true, true},
+	}
+
+	for _, test := range tests {
+		aLost, bLost := collisionLosers(test.a, test.b)
+		if aLost != test.aLost || bLost != test.bLost {
+			t.Errorf("collisionLosers(%+v, %+v) = %t, %t, wanted %t, %t", test.a,
+				test.b, aLost, bLost, test.aLost, test.bLost)
+		}
+	}
+}
+
+// whoisServer asks the client's server which server the user is on. We
+// return a blank string if there is no such user.
+func whoisServer(t *testing.T, c *Client, nick string) string {
+	// We follow the WHOIS with a PING and read everything up to its PONG. The
+	// server replies in order, so this takes all of this WHOIS's replies and
+	// none are left to answer a later one.
+	token := fmt.Sprintf("whois-%d", time.Now().UnixNano())
+	if err := c.Send(msg("WHOIS", nick)); err != nil {
+		t.Fatalf("error sending WHOIS: %s", err)
+	}
+	if err := c.Send(msg("PING", token)); err != nil {
+		t.Fatalf("error sending PING: %s", err)
+	}
+
+	pong := AllOf(Command("PONG"), MatchFunc("token "+token,
+		func(m TaggedMessage) bool {
+			return len(m.Params) > 0 && m.Params[len(m.Params)-1] == token
+		}))
+	reply := MatchFunc("WHOIS reply about "+nick, func(m TaggedMessage) bool {
+		return len(m.Command) == 3 && len(m.Params) > 1 && m.Params[1] == nick
+	})
+
+	server := ""
+	for {
+		m := expect(t, c, AnyOf(pong, reply))
+		if m.Command == "PONG" {
+			return server
+		}
+		// 312 <us> <nick> <server> :<server info>
+		if m.Command == "312" && len(m.Params) > 2 {
+			server = m.Params[2]
+		}
+	}
+}
+
+// expectServerAlive checks a new client can register on the server. It fails
+// the test if not.
+func expectServerAlive(t *testing.T, h *Harness, server *Catbox) {
+	client := h.NewClient("alive", server)
+	client.SetNickFallback(NickIncrement, 0)
+	if _, _, _, err := client.Start(); err != nil {
+		t.Fatalf("%s: error starting client: %s", server.Name, err)
+	}
+	defer client.Stop()
+	expect(t, client, Command(irc.ReplyWelcome))
+}
@@ -0,0 +1,538 @@
+package boxcat
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Direction is a direction traffic flows through a Proxy.
+type Direction int
+
+const (
+	// Upstream is traffic from the side that connected to the proxy to the
+	// proxy's target.
+	Upstream Direction = 1 << iota
+
+	// Downstream is traffic from the target back to the side that connected.
+	Downstream
+
+	// BothDirections is traffic in both directions.
+	BothDirections = Upstream | Downstream
+)
+
+// faults holds the faults we inject into one direction.
+type faults struct {
+	delay          time.Duration
+	jitter         time.Duration
+	bytesPerSecond int
+	paused         bool
+	blackhole      bool
+}
+
+// Proxy is a TCP proxy that forwards connections to a target. You can inject
+// faults into the traffic going through it while it runs.
+type Proxy struct {
+	// Port is the port the proxy listens on at 127.0.0.1.
+	Port uint16
+
+	target   string
+	listener net.Listener
+
+	// upstream and downstream hold the faults for each direction.
+	upstream   faults
+	downstream faults
+
+	// logger receives problems forwarding connections.
+	logger Logger
+
+	// refuse means we close new connections right away.
+	refuse bool
+
+	conns  map[*proxyConn]struct{}
+	closed bool
+
+	// cond lets paused traffic wait for changes to the faults.
+	cond  *sync.Cond
+	mutex *sync.Mutex
+	wg    *sync.WaitGroup
+}
+
+// proxyConn is a connection going through the proxy.
+type proxyConn struct {
+	client   net.Conn
+	upstream net.Conn
+	done     chan struct{}
+	once     *sync.Once
+}
+
+// chunk is data read from one side waiting to be written to the other.
+type chunk struct {
+	data      []byte
+	deliverAt time.Time
+}
+
+// NewProxy starts a proxy that forwards connections to the target address.
+// It logs problems using the standard log package.
+//
+// You must call Close to stop it.
+func NewProxy(target string) (*Proxy, error) {
+	return newProxy(target, StdLogger())
+}
+
+// newProxy starts a proxy that logs to the logger.
+func newProxy(target string, logger Logger) (*Proxy, error) {
+	ln, port, err := getRandomPort()
+	if err != nil {
+		return nil, err
+	}
+
+	mutex := &sync.Mutex{}
+	p := &Proxy{
+		Port:     port,
+		target:   target,
+		listener: ln,
+		logger:   logger,
+		conns:    map[*proxyConn]struct{}{},
+		cond:     sync.NewCond(mutex),
+		mutex:    mutex,
+		wg:       &sync.WaitGroup{},
+	}
+
+	p.wg.Add(1)
+	go p.accept()
+
+	return p, nil
+}
+
+func (p *Proxy) accept() {
+	defer p.wg.Done()
+
+	for {
+		client, err := p.listener.Accept()
+		if err != nil {
+			p.mutex.Lock()
+			closed := p.closed
+			p.mutex.Unlock()
+			if !closed {
+				logf(p.logger, LevelError, fmt.Sprintf("proxy %d", p.Port),
+					"error accepting: %s", err)
+			}
+			return
+		}
+
+		p.mutex.Lock()
+		refuse := p.refuse || p.closed
+		p.mutex.Unlock()
+		if refuse {
+			_ = client.Close()
+			continue
+		}
+
+		upstream, err := net.DialTimeout("tcp", p.target, 10*time.Second)
+		if err != nil {
+			logf(p.logger, LevelError, fmt.Sprintf("proxy %d", p.Port),
+				"error dialing %s: %s", p.target, err)
+			_ = client.Close()
+			continue
+		}
+
+		conn := &proxyConn{
+			client:   client,
+			upstream: upstream,
+			done:     make(chan struct{}),
+			once:     &sync.Once{},
+		}
+
+		p.mutex.Lock()
+		if p.closed {
+			p.mutex.Unlock()
+			_ = client.Close()
+			_ = upstream.Close()
+			return
+		}
+		p.conns[conn] = struct{}{}
+		p.mutex.Unlock()
+
+		p.wg.Add(2)
+		go p.pipe(conn, Upstream, client, upstream)
+		go p.pipe(conn, Downstream, upstream, client)
+	}
+}
+
+// pipe copies traffic in one direction of a connection, applying faults.
+func (p *Proxy) pipe(conn *proxyConn, dir Direction, src, dst net.Conn) {
+	defer p.wg.Done()
+	defer p.closeConn(conn)
+
+	chunks := make(chan chunk, 1024)
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer close(chunks)
+
+		var lastDeliverAt time.Time
+		for {
+			buf := make([]byte, 32*1024)
+			n, err := src.Read(buf)
+			if n > 0 {
+				f := p.faults(dir)
+				deliverAt := time.Now().Add(f.delay)
+				if f.jitter > 0 {
+					deliverAt = deliverAt.Add(
+						time.Duration(rand.Int63n(int64(f.jitter))))
+				}
+				// Jitter must not reorder the stream.
+				if deliverAt.Before(lastDeliverAt) {
+					deliverAt = lastDeliverAt
+				}
+				lastDeliverAt = deliverAt
+
+				select {
+				case chunks <- chunk{data: buf[:n], deliverAt: deliverAt}:
+				case <-conn.done:
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	for c := range chunks {
+		if !p.sleepUntil(conn, c.deliverAt) {
+			return
+		}
+
+		if !p.waitWhilePaused(conn, dir) {
+			return
+		}
+
+		f := p.faults(dir)
+		if f.blackhole {
+			continue
+		}
+
+		if err := p.write(conn, dst, c.data, f.bytesPerSecond); err != nil {
+			return
+		}
+	}
+}
+
+// sleepUntil waits until the time. It returns false if the connection closes
+// first.
+func (p *Proxy) sleepUntil(conn *proxyConn, t time.Time) bool {
+	d := time.Until(t)
+	if d <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-conn.done:
+		return false
+	}
+}
+
+// waitWhilePaused waits while the direction is paused. It returns false if
+// the connection closes.
+func (p *Proxy) waitWhilePaused(conn *proxyConn, dir Direction) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for p.faultsLocked(dir).paused {
+		select {
+		case <-conn.done:
+			return false
+		default:
+		}
+		p.cond.Wait()
+	}
+
+	select {
+	case <-conn.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// write writes the data, limiting it to bytesPerSecond if that is set.
+func (p *Proxy) write(
+	conn *proxyConn,
+	dst net.Conn,
+	data []byte,
+	bytesPerSecond int,
+) error {
+	if bytesPerSecond <= 0 {
+		_, err := dst.Write(data)
+		return err
+	}
+
+	// Write in slices sized for a tenth of a second.
+	sliceSize := bytesPerSecond / 10
+	if sliceSize < 1 {
+		sliceSize = 1
+	}
+
+	for len(data) > 0 {
+		n := sliceSize
+		if n > len(data) {
+			n = len(data)
+		}
+
+		// Wait for the time it takes to send the slice at this rate before
+		// writing it.
+		wait := time.Duration(n) * time.Second / time.Duration(bytesPerSecond)
+		if !p.sleepUntil(conn, time.Now().Add(wait)) {
+			return fmt.Errorf("connection closed")
+		}
+
+		if _, err := dst.Write(data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+
+	return nil
+}
+
+// closeConn closes both sides of a connection.
+func (p *Proxy) closeConn(conn *proxyConn) {
+	conn.once.Do(func() {
+		close(conn.done)
+		_ = conn.client.Close()
+		_ = conn.upstream.Close()
+
+		p.mutex.Lock()
+		delete(p.conns, conn)
+		p.cond.Broadcast()
+		p.mutex.Unlock()
+	})
+}
+
+// faults retrieves a copy of the faults for a direction.
+func (p *Proxy) faults(dir Direction) faults {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return *p.faultsLocked(dir)
+}
+
+// faultsLocked retrieves the faults for a single direction. The caller must
+// hold the lock.
+func (p *Proxy) faultsLocked(dir Direction) *faults {
+	if dir == Downstream {
+		return &p.downstream
+	}
+	return &p.upstream
+}
+
+// update changes the faults for the directions.
+func (p *Proxy) update(dirs Direction, f func(*faults)) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if dirs&Upstream != 0 {
+		f(&p.upstream)
+	}
+	if dirs&Downstream != 0 {
+		f(&p.downstream)
+	}
+	p.cond.Broadcast()
+}
+
+// SetDelay delays traffic by delay plus a random amount up to jitter.
+// Traffic stays in order.
+func (p *Proxy) SetDelay(dirs Direction, delay, jitter time.Duration) {
+	p.update(dirs, func(f *faults) {
+		f.delay = delay
+		f.jitter = jitter
+	})
+}
+
+// SetBandwidth limits traffic to the number of bytes per second. Zero means
+// no limit.
+func (p *Proxy) SetBandwidth(dirs Direction, bytesPerSecond int) {
+	p.update(dirs, func(f *faults) {
+		f.bytesPerSecond = bytesPerSecond
+	})
+}
+
+// Pause holds traffic until Resume. Nothing is lost.
+func (p *Proxy) Pause(dirs Direction) {
+	p.update(dirs, func(f *faults) {
+		f.paused = true
+	})
+}
+
+// Resume sends traffic held by Pause and lets traffic flow again.
+func (p *Proxy) Resume(dirs Direction) {
+	p.update(dirs, func(f *faults) {
+		f.paused = false
+	})
+}
+
+// Blackhole discards traffic if on is true. The connection stays open.
+func (p *Proxy) Blackhole(dirs Direction, on bool) {
+	p.update(dirs, func(f *faults) {
+		f.blackhole = on
+	})
+}
+
+// Refuse closes new connections right away if on is true.
+func (p *Proxy) Refuse(on bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.refuse = on
+}
+
+// Reset clears all faults.
+func (p *Proxy) Reset() {
+	p.update(BothDirections, func(f *faults) {
+		*f = faults{}
+	})
+	p.Refuse(false)
+}
+
+// Drop closes every connection going through the proxy.
+func (p *Proxy) Drop() {
+	p.mutex.Lock()
+	var conns []*proxyConn
+	for conn := range p.conns {
+		conns = append(conns, conn)
+	}
+	p.mutex.Unlock()
+
+	for _, conn := range conns {
+		p.closeConn(conn)
+	}
+}
+
+// Close stops the proxy and closes its connections.
+func (p *Proxy) Close() {
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		return
+	}
+	p.closed = true
+	p.mutex.Unlock()
+
+	_ = p.listener.Close()
+	p.Drop()
+	p.wg.Wait()
+}
+
+// LinkDirection is a direction traffic flows over a FaultLink.
+type LinkDirection int
+
+const (
+	// AToB is traffic from server A to server B.
+	AToB LinkDirection = 1 << iota
+
+	// BToA is traffic from server B to server A.
+	BToA
+
+	// BothWays is traffic in both directions.
+	BothWays = AToB | BToA
+)
+
+// FaultLink is a link between two servers that goes through proxies so that
+// we can inject faults into it.
+//
+// Each server connects to the other through its own proxy, so we need two.
+type FaultLink struct {
+	A *Catbox
+	B *Catbox
+
+	// toB carries connections A makes to B. toA carries connections B makes to
+	// A.
+	toB *Proxy
+	toA *Proxy
+}
+
+// proxyDirections maps link directions to the directions of each proxy.
+func (l *FaultLink) proxyDirections(dirs LinkDirection) (Direction, Direction) {
+	var toB, toA Direction
+	if dirs&AToB != 0 {
+		toB |= Upstream
+		toA |= Downstream
+	}
+	if dirs&BToA != 0 {
+		toB |= Downstream
+		toA |= Upstream
+	}
+	return toB, toA
+}
+
+// SetDelay delays traffic by delay plus a random amount up to jitter.
+func (l *FaultLink) SetDelay(dirs LinkDirection, delay, jitter time.Duration) {
+	toB, toA := l.proxyDirections(dirs)
+	l.toB.SetDelay(toB, delay, jitter)
+	l.toA.SetDelay(toA, delay, jitter)
+}
+
+// SetBandwidth limits traffic to the number of bytes per second. Zero means
+// no limit.
+func (l *FaultLink) SetBandwidth(dirs LinkDirection, bytesPerSecond int) {
+	toB, toA := l.proxyDirections(dirs)
+	l.toB.SetBandwidth(toB, bytesPerSecond)
+	l.toA.SetBandwidth(toA, bytesPerSecond)
+}
+
+// Pause holds traffic until Resume.
+func (l *FaultLink) Pause(dirs LinkDirection) {
+	toB, toA := l.proxyDirections(dirs)
+	l.toB.Pause(toB)
+	l.toA.Pause(toA)
+}
+
+// Resume lets traffic held by Pause flow again.
+func (l *FaultLink) Resume(dirs LinkDirection) {
+	toB, toA := l.proxyDirections(dirs)
+	l.toB.Resume(toB)
+	l.toA.Resume(toA)
+}
+
+// Blackhole discards traffic if on is true. The connection stays open, so the
+// servers only notice through ping timeouts.
+func (l *FaultLink) Blackhole(dirs LinkDirection, on bool) {
+	toB, toA := l.proxyDirections(dirs)
+	l.toB.Blackhole(toB, on)
+	l.toA.Blackhole(toA, on)
+}
+
+// Drop closes the connection between the servers. They may reconnect.
+func (l *FaultLink) Drop() {
+	l.toB.Drop()
+	l.toA.Drop()
+}
+
+// Split closes the connection between the servers and stops them from
+// reconnecting until Heal.
+func (l *FaultLink) Split() {
+	l.toB.Refuse(true)
+	l.toA.Refuse(true)
+	l.Drop()
+}
+
+// Heal undoes Split and clears all other faults. The servers reconnect on
+// their own.
+func (l *FaultLink) Heal() {
+	l.toB.Reset()
+	l.toA.Reset()
+}
+
+// Close stops the proxies.
+func (l *FaultLink) Close() {
+	l.toB.Close()
+	l.toA.Close()
+}
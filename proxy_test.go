@@ -0,0 +1,149 @@
+package boxcat
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startEchoServer starts a server that echoes back whatever it receives.
+func startEchoServer(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp4", "127.0.0.1:")
+	if err != nil {
+		t.Fatalf("error listening: %s", err)
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+
+	return ln
+}
+
+// sendLine sends a line and waits up to timeout for it to come back. It
+// returns how long that took.
+func sendLine(
+	conn net.Conn,
+	r *bufio.Reader,
+	line string,
+	timeout time.Duration,
+) (time.Duration, error) {
+	start := time.Now()
+	if _, err := fmt.Fprintf(conn, "%s\n", line); err != nil {
+		return 0, err
+	}
+
+	if err := conn.SetReadDeadline(start.Add(timeout)); err != nil {
+		return 0, err
+	}
+	got, err := r.ReadString('\n')
+	if err != nil {
+		return 0, err
+	}
+	if got != line+"\n" {
+		return 0, fmt.Errorf("got %q, wanted %q", got, line)
+	}
+	return time.Since(start), nil
+}
+
+func TestProxy(t *testing.T) {
+	ln := startEchoServer(t)
+	defer func() {
+		_ = ln.Close()
+	}()
+
+	proxy, err := NewProxy(ln.Addr().String())
+	if err != nil {
+		t.Fatalf("error starting proxy: %s", err)
+	}
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", proxy.Port))
+	if err != nil {
+		t.Fatalf("error dialing proxy: %s", err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	r := bufio.NewReader(conn)
+
+	if _, err := sendLine(conn, r, "hello", time.Second); err != nil {
+		t.Fatalf("error sending through proxy: %s", err)
+	}
+
+	proxy.SetDelay(Upstream, 100*time.Millisecond, 0)
+	took, err := sendLine(conn, r, "delayed", time.Second)
+	if err != nil {
+		t.Fatalf("error sending with delay: %s", err)
+	}
+	if took < 100*time.Millisecond {
+		t.Fatalf("delayed line took %s, wanted at least 100ms", took)
+	}
+	proxy.Reset()
+
+	// While paused nothing arrives. Once resumed, the held line does.
+	proxy.Pause(Downstream)
+	if _, err := sendLine(conn, r, "paused", 50*time.Millisecond); err == nil {
+		t.Fatalf("received line while paused")
+	}
+	proxy.Resume(Downstream)
+	if err := conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("error setting deadline: %s", err)
+	}
+	line, err := r.ReadString('\n')
+	if err != nil || line != "paused\n" {
+		t.Fatalf("got %q (%v), wanted paused line after resume", line, err)
+	}
+
+	proxy.Blackhole(Upstream, true)
+	if _, err := sendLine(conn, r, "lost", 50*time.Millisecond); err == nil {
+		t.Fatalf("received line while blackholed")
+	}
+	proxy.Blackhole(Upstream, false)
+	if _, err := sendLine(conn, r, "found", time.Second); err != nil {
+		t.Fatalf("error sending after blackhole: %s", err)
+	}
+
+	proxy.SetBandwidth(Upstream, 100)
+	took, err = sendLine(conn, r, "0123456789012345678", 2*time.Second)
+	if err != nil {
+		t.Fatalf("error sending with bandwidth limit: %s", err)
+	}
+	if took < 150*time.Millisecond {
+		t.Fatalf("throttled line took %s, wanted at least 150ms", took)
+	}
+	proxy.Reset()
+
+	proxy.Drop()
+	if err := conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("error setting deadline: %s", err)
+	}
+	if _, err := r.ReadString('\n'); err != io.EOF {
+		t.Fatalf("read error = %v, wanted EOF after drop", err)
+	}
+
+	proxy.Refuse(true)
+	conn2, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", proxy.Port))
+	if err != nil {
+		t.Fatalf("error dialing proxy: %s", err)
+	}
+	defer func() {
+		_ = conn2.Close()
+	}()
+	if _, err := sendLine(conn2, bufio.NewReader(conn2), "refused",
+		time.Second); err == nil {
+		t.Fatalf("received line while refusing")
+	}
+}
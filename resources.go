@@ -0,0 +1,305 @@
+package boxcat
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clockTicks is how many clock ticks there are per second in /proc. This is
+// USER_HZ, which is 100 on every Linux we care about. Finding it properly
+// needs sysconf.
+const clockTicks = 100
+
+// ResourceSample is what a process was using at one time.
+//
+// /proc doesn't know about goroutines. A goroutine leak usually shows up in
+// RSS, and a connection leak in FDs.
+type ResourceSample struct {
+	Time time.Time
+
+	// RSS is the resident set size in bytes.
+	RSS int64
+
+	// FDs is how many file descriptors the process has open.
+	FDs int
+
+	Threads int
+
+	// CPUTime is the user and system CPU time the process has used.
+	CPUTime time.Duration
+}
+
+func (s ResourceSample) String() string {
+	return fmt.Sprintf("%s rss=%dKiB fds=%d threads=%d cpu=%s",
+		s.Time.Format("15:04:05.000"), s.RSS/1024, s.FDs, s.Threads, s.CPUTime)
+}
+
+// SampleProcess reads what the process is using from /proc. This only works
+// on Linux.
+func SampleProcess(pid int) (ResourceSample, error) {
+	sample := ResourceSample{Time: time.Now()}
+
+	buf, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return ResourceSample{}, fmt.Errorf("error reading stat: %s", err)
+	}
+	if err := parseProcStat(string(buf), &sample); err != nil {
+		return ResourceSample{}, err
+	}
+
+	fds, err := ioutil.ReadDir(fmt.Sprintf("/proc/%d/fd", pid))
+	if err != nil {
+		return ResourceSample{}, fmt.Errorf("error reading fds: %s", err)
+	}
+	sample.FDs = len(fds)
+
+	return sample, nil
+}
+
+// parseProcStat fills in the sample from the contents of /proc/<pid>/stat.
+// See proc(5).
+func parseProcStat(stat string, sample *ResourceSample) error {
+	// The second field is the command name in parentheses. It may contain
+	// spaces and parentheses itself, so start after the last ).
+	end := strings.LastIndex(stat, ")")
+	if end == -1 {
+		return fmt.Errorf("malformed stat: %s", stat)
+	}
+	// fields[0] is field 3, the state.
+	fields := strings.Fields(stat[end+1:])
+	if len(fields) < 22 {
+		return fmt.Errorf("malformed stat: %s", stat)
+	}
+
+	field := func(n int) (int64, error) {
+		v, err := strconv.ParseInt(fields[n-3], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("error parsing stat field %d: %s", n, err)
+		}
+		return v, nil
+	}
+
+	utime, err := field(14)
+	if err != nil {
+		return err
+	}
+	stime, err := field(15)
+	if err != nil {
+		return err
+	}
+	threads, err := field(20)
+	if err != nil {
+		return err
+	}
+	rss, err := field(24)
+	if err != nil {
+		return err
+	}
+
+	sample.CPUTime = time.Duration(utime+stime) * time.Second / clockTicks
+	sample.Threads = int(threads)
+	sample.RSS = rss * int64(os.Getpagesize())
+	return nil
+}
+
+// ResourceMonitor samples what a process uses at an interval and keeps the
+// samples. Use Catbox.Monitor to create one.
+type ResourceMonitor struct {
+	pid int
+
+	// samples has the baseline first.
+	samples []ResourceSample
+	err     error
+
+	stop     chan struct{}
+	stopOnce *sync.Once
+	done     chan struct{}
+	mutex    *sync.Mutex
+}
+
+// Monitor starts sampling what the catbox process uses every interval. We
+// take the first sample, the baseline, before returning. We stop when you
+// call Stop on the monitor or when the process exits.
+func (c *Catbox) Monitor(interval time.Duration) (*ResourceMonitor, error) {
+	return monitorProcess(c.Command.Process.Pid, interval, c.Done())
+}
+
+// monitorProcess starts a ResourceMonitor. We stop once exited is closed.
+func monitorProcess(
+	pid int,
+	interval time.Duration,
+	exited <-chan struct{},
+) (*ResourceMonitor, error) {
+	m := &ResourceMonitor{
+		pid:      pid,
+		stop:     make(chan struct{}),
+		stopOnce: &sync.Once{},
+		done:     make(chan struct{}),
+		mutex:    &sync.Mutex{},
+	}
+
+	if _, err := m.Sample(); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		defer close(m.done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-m.stop:
+				return
+			case <-exited:
+				return
+			case <-ticker.C:
+				if _, err := m.Sample(); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	return m, nil
+}
+
+// Sample takes a sample now and records it.
+func (m *ResourceMonitor) Sample() (ResourceSample, error) {
+	sample, err := SampleProcess(m.pid)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if err != nil {
+		m.err = err
+		return ResourceSample{}, err
+	}
+	m.samples = append(m.samples, sample)
+	return sample, nil
+}
+
+// Stop stops sampling. We keep the samples we have.
+func (m *ResourceMonitor) Stop() {
+	m.stopOnce.Do(func() {
+		close(m.stop)
+	})
+	<-m.done
+}
+
+// Samples retrieves a copy of the samples in the order we took them.
+func (m *ResourceMonitor) Samples() []ResourceSample {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]ResourceSample(nil), m.samples...)
+}
+
+// Baseline retrieves the first sample.
+func (m *ResourceMonitor) Baseline() ResourceSample {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.samples[0]
+}
+
+// Peak retrieves the highest value of each measurement across the samples.
+// Its Time is when we took the last sample.
+func (m *ResourceMonitor) Peak() ResourceSample {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var peak ResourceSample
+	for _, s := range m.samples {
+		peak.Time = s.Time
+		if s.RSS > peak.RSS {
+			peak.RSS = s.RSS
+		}
+		if s.FDs > peak.FDs {
+			peak.FDs = s.FDs
+		}
+		if s.Threads > peak.Threads {
+			peak.Threads = s.Threads
+		}
+		if s.CPUTime > peak.CPUTime {
+			peak.CPUTime = s.CPUTime
+		}
+	}
+	return peak
+}
+
+// Err retrieves the error that stopped us sampling, if there was one. Once
+// the process exits we fail to sample it.
+func (m *ResourceMonitor) Err() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.err
+}
+
+// String formats the samples, one per line.
+func (m *ResourceMonitor) String() string {
+	var lines []string
+	for _, s := range m.Samples() {
+		lines = append(lines, s.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// WaitFor samples the process until ok accepts a sample. If the context is
+// done first, we return an error with the description and the samples.
+//
+// For example, to wait for RSS to drop below 50 MiB:
+//
+//	err := m.WaitFor(ctx, "RSS below 50 MiB", func(s ResourceSample) bool {
+//		return s.RSS < 50*1024*1024
+//	})
+func (m *ResourceMonitor) WaitFor(
+	ctx context.Context,
+	description string,
+	ok func(ResourceSample) bool,
+) error {
+	for {
+		sample, err := m.Sample()
+		if err != nil {
+			return fmt.Errorf("error waiting for %s: %s", description, err)
+		}
+		if ok(sample) {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("gave up waiting for %s: %s\nsamples:\n%s",
+				description, ctx.Err(), m)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// WaitForFDs waits until the process has at most n file descriptors open.
+func (m *ResourceMonitor) WaitForFDs(ctx context.Context, n int) error {
+	return m.WaitFor(ctx, fmt.Sprintf("at most %d FDs", n),
+		func(s ResourceSample) bool {
+			return s.FDs <= n
+		})
+}
+
+// WaitForBaselineFDs waits until the process has no more file descriptors
+// open than it did in the baseline. For example, use this after all clients
+// disconnect to check the server closed their sockets.
+func (m *ResourceMonitor) WaitForBaselineFDs(ctx context.Context) error {
+	return m.WaitForFDs(ctx, m.Baseline().FDs)
+}
+
+// WaitForThreads waits until the process has at most n threads.
+func (m *ResourceMonitor) WaitForThreads(ctx context.Context, n int) error {
+	return m.WaitFor(ctx, fmt.Sprintf("at most %d threads", n),
+		func(s ResourceSample) bool {
+			return s.Threads <= n
+		})
+}
@@ -0,0 +1,148 @@
+package boxcat
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+func TestParseProcStat(t *testing.T) {
+	// The command name has a space and a ) in it to make sure we find the end
+	// of it properly.
+	stat := "1234 (cat box) x) S 1 1234 1234 0 -1 4194560 500 0 0 0 " +
+		"150 50 0 0 20 0 7 0 100 1000000 256 18446744073709551615"
+
+	var sample ResourceSample
+	if err := parseProcStat(stat, &sample); err != nil {
+		t.Fatalf("error parsing: %s", err)
+	}
+
+	if sample.CPUTime != 2*time.Second {
+		t.Errorf("CPUTime = %s, wanted 2s", sample.CPUTime)
+	}
+	if sample.Threads != 7 {
+		t.Errorf("Threads = %d, wanted 7", sample.Threads)
+	}
+	if want := int64(256 * os.Getpagesize()); sample.RSS != want {
+		t.Errorf("RSS = %d, wanted %d", sample.RSS, want)
+	}
+
+	if err := parseProcStat("1234 (catbox) S 1 2 3", &sample); err == nil {
+		t.Errorf("expected error parsing truncated stat")
+	}
+}
+
+// Test monitoring our own process.
+func TestMonitorProcess(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("/proc is only on Linux")
+	}
+
+	exited := make(chan struct{})
+	m, err := monitorProcess(os.Getpid(), 10*time.Millisecond, exited)
+	if err != nil {
+		t.Fatalf("error monitoring: %s", err)
+	}
+	defer m.Stop()
+
+	baseline := m.Baseline()
+	if baseline.RSS <= 0 || baseline.FDs <= 0 || baseline.Threads <= 0 {
+		t.Fatalf("implausible baseline: %s", baseline)
+	}
+
+	var files []*os.File
+	for i := 0; i < 5; i++ {
+		fh, err := os.Open(os.Args[0])
+		if err != nil {
+			t.Fatalf("error opening file: %s", err)
+		}
+		files = append(files, fh)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := m.WaitFor(ctx, "more FDs", func(s ResourceSample) bool {
+		return s.FDs >= baseline.FDs+len(files)
+	}); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	for _, fh := range files {
+		_ = fh.Close()
+	}
+
+	if err := m.WaitForBaselineFDs(ctx); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if peak := m.Peak(); peak.FDs < baseline.FDs+len(files) {
+		t.Errorf("peak FDs = %d, wanted at least %d", peak.FDs,
+			baseline.FDs+len(files))
+	}
+
+	// We stop sampling on our own once the process exits.
+	close(exited)
+	<-m.done
+	n := len(m.Samples())
+	time.Sleep(50 * time.Millisecond)
+	if len(m.Samples()) != n {
+		t.Errorf("still sampling after the process exited")
+	}
+}
+
+// Test catbox closes the sockets of clients that disconnect.
+func TestClientFDsReleased(t *testing.T) {
+	t.Parallel()
+
+	h := NewHarness(t)
+
+	catbox, err := h.StartServer(ServerOptions{Name: "irc.example.org"})
+	if err != nil {
+		t.Fatalf("error starting catbox: %s", err)
+	}
+
+	m, err := catbox.Monitor(100 * time.Millisecond)
+	if err != nil {
+		t.Fatalf("error monitoring catbox: %s", err)
+	}
+	defer m.Stop()
+
+	var clients []*Client
+	defer func() {
+		for _, client := range clients {
+			client.Stop()
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		client := h.NewClient(fmt.Sprintf("client%d", i), catbox)
+		if _, _, _, err := client.Start(); err != nil {
+			t.Fatalf("error starting client: %s", err)
+		}
+		clients = append(clients, client)
+		expect(t, client, Command(irc.ReplyWelcome))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), expectTimeout)
+	defer cancel()
+
+	if sample, err := m.Sample(); err != nil {
+		t.Fatalf("%s", err)
+	} else if sample.FDs < m.Baseline().FDs+len(clients) {
+		t.Fatalf("catbox has %d FDs open with %d clients, baseline %d",
+			sample.FDs, len(clients), m.Baseline().FDs)
+	}
+
+	for _, client := range clients {
+		client.Stop()
+	}
+	clients = nil
+
+	if err := m.WaitForBaselineFDs(ctx); err != nil {
+		t.Fatalf("%s", err)
+	}
+}
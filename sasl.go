@@ -0,0 +1,227 @@
+package boxcat
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/horgh/irc"
+)
+
+// SASLMechanism is a SASL mechanism we can authenticate with.
+type SASLMechanism string
+
+const (
+	// SASLPlain authenticates with a username and password.
+	SASLPlain SASLMechanism = "PLAIN"
+
+	// SASLExternal authenticates with the client certificate we present over
+	// TLS. See UseTLS and CertificateAuthority.IssueClientCertificate.
+	SASLExternal SASLMechanism = "EXTERNAL"
+)
+
+// saslChunkSize is the maximum length of an AUTHENTICATE payload. Longer
+// payloads are split across several messages.
+const saslChunkSize = 400
+
+// SASLConfig holds how a Client authenticates.
+type SASLConfig struct {
+	Mechanism SASLMechanism
+
+	// Username and Password are for PLAIN.
+	Username string
+	Password string
+
+	// AuthorizationID is the identity to act as. It is optional. Usually it is
+	// blank meaning the identity we authenticate as.
+	AuthorizationID string
+}
+
+// SASLOutcome describes how authentication ended.
+type SASLOutcome int
+
+const (
+	// SASLSuccess means we authenticated (903).
+	SASLSuccess SASLOutcome = iota
+
+	// SASLFailed means the server rejected our credentials (904).
+	SASLFailed
+
+	// SASLTooLong means our payload was too long (905).
+	SASLTooLong
+
+	// SASLAborted means authentication was aborted (906).
+	SASLAborted
+
+	// SASLAlready means we had already authenticated (907).
+	SASLAlready
+)
+
+func (o SASLOutcome) String() string {
+	switch o {
+	case SASLSuccess:
+		return "success"
+	case SASLFailed:
+		return "failed"
+	case SASLTooLong:
+		return "too long"
+	case SASLAborted:
+		return "aborted"
+	case SASLAlready:
+		return "already authenticated"
+	default:
+		return fmt.Sprintf("unknown outcome %d", o)
+	}
+}
+
+// saslOutcomes maps the numerics ending authentication to their outcome.
+var saslOutcomes = map[string]SASLOutcome{
+	"903": SASLSuccess,
+	"904": SASLFailed,
+	"905": SASLTooLong,
+	"906": SASLAborted,
+	"907": SASLAlready,
+}
+
+// SASLResult holds the result of authenticating.
+type SASLResult struct {
+	Outcome SASLOutcome
+
+	// Numeric is the numeric that ended authentication, such as 903.
+	Numeric string
+
+	// Message is the human readable text of that numeric.
+	Message string
+
+	// Account is the account we are logged in to. The server tells us in 900
+	// (RPL_LOGGEDIN). It is blank if we did not see that.
+	Account string
+
+	// Mechanisms holds the mechanisms the server supports if it told us in
+	// 908 (RPL_SASLMECHS).
+	Mechanisms []string
+}
+
+// UseSASL makes the client authenticate using SASL when it registers. Call it
+// before Start. It implies NegotiateCaps.
+//
+// Failing to authenticate does not stop the client from registering. Check
+// the outcome with GetSASLResult.
+func (c *Client) UseSASL(config SASLConfig) {
+	c.negotiateCaps = true
+	c.sasl = &config
+}
+
+// GetSASLResult retrieves the result of authenticating. It returns false if
+// we did not authenticate, such as if the server does not offer sasl.
+func (c *Client) GetSASLResult() (SASLResult, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.saslResult == nil {
+		return SASLResult{}, false
+	}
+	return *c.saslResult, true
+}
+
+// authenticate runs SASL authentication. The server must have ACKed sasl. We
+// return once the server tells us the outcome.
+func (c *Client) authenticate(read *[]TaggedMessage) error {
+	payload, err := c.sasl.payload()
+	if err != nil {
+		return err
+	}
+
+	if err := c.writeMessage(irc.Message{
+		Command: "AUTHENTICATE",
+		Params:  []string{string(c.sasl.Mechanism)},
+	}); err != nil {
+		return fmt.Errorf("error starting authentication: %s", err)
+	}
+
+	result := SASLResult{}
+	sentPayload := false
+
+	for {
+		m, err := c.readRegistrationMessage(read)
+		if err != nil {
+			return err
+		}
+
+		if m.Command == "AUTHENTICATE" && len(m.Params) > 0 && m.Params[0] == "+" {
+			if sentPayload {
+				continue
+			}
+			sentPayload = true
+			for _, chunk := range saslChunks(payload) {
+				if err := c.writeMessage(irc.Message{
+					Command: "AUTHENTICATE",
+					Params:  []string{chunk},
+				}); err != nil {
+					return fmt.Errorf("error sending authentication payload: %s", err)
+				}
+			}
+			continue
+		}
+
+		// RPL_LOGGEDIN: <nick> <nick>!<ident>@<host> <account> :You are now
+		// logged in as <user>
+		if m.Command == "900" && len(m.Params) > 2 {
+			result.Account = m.Params[2]
+			continue
+		}
+
+		// RPL_SASLMECHS: <nick> <mechanisms> :are available SASL mechanisms
+		if m.Command == "908" && len(m.Params) > 1 {
+			result.Mechanisms = strings.Split(m.Params[1], ",")
+			continue
+		}
+
+		outcome, ok := saslOutcomes[m.Command]
+		if !ok {
+			continue
+		}
+
+		result.Outcome = outcome
+		result.Numeric = m.Command
+		result.Message = lastParam(m)
+
+		c.mutex.Lock()
+		c.saslResult = &result
+		c.mutex.Unlock()
+		return nil
+	}
+}
+
+// payload builds the unencoded payload for the mechanism.
+func (s SASLConfig) payload() ([]byte, error) {
+	switch s.Mechanism {
+	case SASLPlain:
+		return []byte(s.AuthorizationID + "\x00" + s.Username + "\x00" +
+			s.Password), nil
+	case SASLExternal:
+		return []byte(s.AuthorizationID), nil
+	default:
+		return nil, fmt.Errorf("unsupported SASL mechanism: %s", s.Mechanism)
+	}
+}
+
+// saslChunks encodes the payload and splits it into AUTHENTICATE parameters.
+//
+// Each chunk is at most saslChunkSize bytes. If the last chunk is exactly
+// that long, or if the payload is empty, we follow with "+" so the server
+// knows the payload is complete.
+func saslChunks(payload []byte) []string {
+	encoded := base64.StdEncoding.EncodeToString(payload)
+
+	var chunks []string
+	for len(encoded) >= saslChunkSize {
+		chunks = append(chunks, encoded[:saslChunkSize])
+		encoded = encoded[saslChunkSize:]
+	}
+
+	if encoded == "" {
+		return append(chunks, "+")
+	}
+	return append(chunks, encoded)
+}
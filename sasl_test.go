@@ -0,0 +1,142 @@
+package boxcat
+
+import (
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSASLChunks(t *testing.T) {
+	tests := []struct {
+		payloadLength int
+		chunkLengths  []int
+	}{
+		{0, []int{1}},
+		{3, []int{4}},
+		// 300 bytes encode to exactly 400.
+		{300, []int{400, 1}},
+		{301, []int{400, 4}},
+		{600, []int{400, 400, 1}},
+	}
+
+	for _, test := range tests {
+		payload := []byte(strings.Repeat("a", test.payloadLength))
+		chunks := saslChunks(payload)
+
+		var lengths []int
+		for _, chunk := range chunks {
+			lengths = append(lengths, len(chunk))
+		}
+		if !reflect.DeepEqual(lengths, test.chunkLengths) {
+			t.Errorf("saslChunks(%d bytes) lengths = %v, wanted %v",
+				test.payloadLength, lengths, test.chunkLengths)
+			continue
+		}
+
+		if chunks[len(chunks)-1] == "+" {
+			chunks = chunks[:len(chunks)-1]
+		}
+		decoded, err := base64.StdEncoding.DecodeString(strings.Join(chunks, ""))
+		if err != nil {
+			t.Errorf("error decoding chunks: %s", err)
+			continue
+		}
+		if string(decoded) != string(payload) {
+			t.Errorf("chunks decode to %q, wanted %q", decoded, payload)
+		}
+	}
+}
+
+func TestClientSASLPlain(t *testing.T) {
+	// The password is long enough that the payload needs two chunks.
+	password := strings.Repeat("p", 300)
+	encoded := base64.StdEncoding.EncodeToString(
+		[]byte("\x00client1\x00" + password))
+
+	server := newTestServer(t)
+	defer server.close()
+
+	client := server.newClient("client1")
+	client.UseSASL(SASLConfig{
+		Mechanism: SASLPlain,
+		Username:  "client1",
+		Password:  password,
+	})
+
+	server.serve(
+		server.accept,
+		server.expecting("CAP LS 302", "NICK client1", "USER client1 0 * client1"),
+		server.sending(":irc.example.org CAP * LS :sasl=PLAIN,EXTERNAL"),
+		server.expecting("CAP REQ sasl"),
+		server.sending(":irc.example.org CAP client1 ACK sasl"),
+		server.expecting("AUTHENTICATE PLAIN"),
+		server.sending("AUTHENTICATE +"),
+		server.expecting(
+			"AUTHENTICATE "+encoded[:400],
+			"AUTHENTICATE "+encoded[400:],
+		),
+		server.sending(
+			":irc.example.org 900 client1 client1!client1@127.0.0.1 acct "+
+				":You are now logged in as acct",
+			":irc.example.org 903 client1 :SASL authentication successful",
+		),
+		server.expecting("CAP END"),
+		server.sending(":irc.example.org 001 client1 :Welcome"),
+	)
+
+	if _, _, _, err := client.Start(); err != nil {
+		t.Fatalf("error starting client: %s", err)
+	}
+	defer client.Stop()
+	server.wait()
+
+	result, ok := client.GetSASLResult()
+	if !ok {
+		t.Fatalf("no SASL result")
+	}
+	if result.Outcome != SASLSuccess || result.Numeric != "903" ||
+		result.Account != "acct" {
+		t.Fatalf("unexpected SASL result: %+v", result)
+	}
+}
+
+func TestClientSASLExternalFailure(t *testing.T) {
+	server := newTestServer(t)
+	defer server.close()
+
+	client := server.newClient("client1")
+	client.UseSASL(SASLConfig{Mechanism: SASLExternal})
+
+	server.serve(
+		server.accept,
+		server.expecting("CAP LS 302", "NICK client1", "USER client1 0 * client1"),
+		server.sending(":irc.example.org CAP * LS :sasl"),
+		server.expecting("CAP REQ sasl"),
+		server.sending(":irc.example.org CAP client1 ACK sasl"),
+		server.expecting("AUTHENTICATE EXTERNAL"),
+		server.sending("AUTHENTICATE +"),
+		server.expecting("AUTHENTICATE +"),
+		server.sending(
+			":irc.example.org 908 client1 PLAIN :are available SASL mechanisms",
+			":irc.example.org 904 client1 :SASL authentication failed",
+		),
+		server.expecting("CAP END"),
+		server.sending(":irc.example.org 001 client1 :Welcome"),
+	)
+
+	if _, _, _, err := client.Start(); err != nil {
+		t.Fatalf("error starting client: %s", err)
+	}
+	defer client.Stop()
+	server.wait()
+
+	result, ok := client.GetSASLResult()
+	if !ok {
+		t.Fatalf("no SASL result")
+	}
+	if result.Outcome != SASLFailed || result.Numeric != "904" ||
+		!reflect.DeepEqual(result.Mechanisms, []string{"PLAIN"}) {
+		t.Fatalf("unexpected SASL result: %+v", result)
+	}
+}
@@ -0,0 +1,486 @@
+package boxcat
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/horgh/irc"
+)
+
+// Scenario is a scripted IRC session. It describes servers, links, clients,
+// what they send and what they expect to see, and faults to inject.
+//
+// A scenario is a text file with one step per line. Blank lines and lines
+// starting with # are ignored. The steps are:
+//
+//	server <name> [tls]
+//	link <server> <server> [faulty]
+//	client <nick> <server>
+//	send <nick> <IRC message>
+//	expect <nick> <IRC message>
+//	expect-none <nick> <IRC message>
+//	fault <server> <server> <fault> [arguments]
+//	consistent [channel...]
+//	quit <nick> [message]
+//	sleep <duration>
+//	timeout <duration>
+//
+// Steps and their arguments are separated by spaces or tabs. The message in
+// send, expect, and expect-none and the message in quit are the rest of the
+// line as is. Server names should look like host names, such as
+// irc1.example.org.
+//
+// A client waits to be welcomed before the next step. expect waits for the
+// client to receive a matching message. If the message has a prefix it is a
+// glob, so ":bob!*" matches any message from bob. We only compare the
+// parameters given, so "QUIT" matches a QUIT with any reason. expect-none
+// checks no matching message arrives for a second.
+//
+// link waits for the servers to link. With faulty they link through proxies
+// so you can use fault. The faults are delay <duration> [jitter], bandwidth
+// <bytes per second>, pause, resume, blackhole, unblackhole, drop, split and
+// heal. heal waits for the servers to link again.
+//
+// consistent checks the servers agree on the state of the network and the
+// channels. See CheckConsistency.
+//
+// timeout sets how long later steps wait. It starts as 10 seconds.
+type Scenario struct {
+	// Name identifies the scenario, such as its file name.
+	Name string
+
+	Steps []ScenarioStep
+}
+
+// ScenarioStep is one line of a scenario.
+type ScenarioStep struct {
+	// Line is the line number in the scenario, starting from 1.
+	Line int
+
+	// Command is the step's name, such as expect.
+	Command string
+
+	// Args holds the words after the command. For send, expect, and
+	// expect-none, the second argument is the rest of the line.
+	Args []string
+}
+
+func (s ScenarioStep) String() string {
+	return fmt.Sprintf("line %d: %s %s", s.Line, s.Command,
+		strings.Join(s.Args, " "))
+}
+
+// scenarioArgs holds how many arguments each step takes, at least and at
+// most. -1 means any number.
+var scenarioArgs = map[string][2]int{
+	"server":      {1, 2},
+	"link":        {2, 3},
+	"client":      {2, 2},
+	"send":        {2, 2},
+	"expect":      {2, 2},
+	"expect-none": {2, 2},
+	"fault":       {3, 5},
+	"consistent":  {0, -1},
+	"quit":        {1, 2},
+	"sleep":       {1, 1},
+	"timeout":     {1, 1},
+}
+
+// ParseScenarioFile reads a scenario from a file.
+func ParseScenarioFile(path string) (*Scenario, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening scenario: %s", err)
+	}
+	defer func() {
+		_ = fh.Close()
+	}()
+
+	return ParseScenario(path, fh)
+}
+
+// ParseScenario reads a scenario. We check each step is one we know and has
+// the right number of arguments.
+func ParseScenario(name string, r io.Reader) (*Scenario, error) {
+	scenario := &Scenario{Name: name}
+
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		step, err := parseScenarioStep(lineNumber, line)
+		if err != nil {
+			return nil, fmt.Errorf("%s: line %d: %s", name, lineNumber, err)
+		}
+		scenario.Steps = append(scenario.Steps, step)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading scenario: %s", err)
+	}
+
+	return scenario, nil
+}
+
+func parseScenarioStep(lineNumber int, line string) (ScenarioStep, error) {
+	fields := strings.Fields(line)
+	step := ScenarioStep{Line: lineNumber, Command: fields[0]}
+
+	limits, ok := scenarioArgs[step.Command]
+	if !ok {
+		return ScenarioStep{}, fmt.Errorf("unknown step: %s", step.Command)
+	}
+
+	switch step.Command {
+	case "send", "expect", "expect-none":
+		// The message is the rest of the line.
+		step.Args = splitFields(line, 2)[1:]
+		if len(step.Args) == 2 {
+			if _, err := scenarioMessage(step.Args[1]); err != nil {
+				return ScenarioStep{}, err
+			}
+		}
+	case "quit":
+		step.Args = splitFields(line, 2)[1:]
+	default:
+		step.Args = append(step.Args, fields[1:]...)
+	}
+
+	if len(step.Args) < limits[0] ||
+		(limits[1] != -1 && len(step.Args) > limits[1]) {
+		return ScenarioStep{}, fmt.Errorf("wrong number of arguments for %s",
+			step.Command)
+	}
+
+	switch step.Command {
+	case "sleep", "timeout":
+		if _, err := time.ParseDuration(step.Args[0]); err != nil {
+			return ScenarioStep{}, fmt.Errorf("invalid duration: %s", err)
+		}
+	case "server":
+		if len(step.Args) == 2 && step.Args[1] != "tls" {
+			return ScenarioStep{}, fmt.Errorf("unknown server option: %s",
+				step.Args[1])
+		}
+	case "link":
+		if len(step.Args) == 3 && step.Args[2] != "faulty" {
+			return ScenarioStep{}, fmt.Errorf("unknown link option: %s",
+				step.Args[2])
+		}
+	}
+
+	return step, nil
+}
+
+// splitFields splits the first n fields separated by whitespace from the line.
+// If there is more, the rest of the line is the last element. It keeps its
+// spacing apart from at its start and end.
+func splitFields(line string, n int) []string {
+	var fields []string
+	rest := strings.TrimSpace(line)
+	for i := 0; i < n && rest != ""; i++ {
+		end := strings.IndexFunc(rest, unicode.IsSpace)
+		if end == -1 {
+			return append(fields, rest)
+		}
+		fields = append(fields, rest[:end])
+		rest = strings.TrimLeftFunc(rest[end:], unicode.IsSpace)
+	}
+	if rest != "" {
+		fields = append(fields, rest)
+	}
+	return fields
+}
+
+// scenarioMessage parses an IRC message from a scenario line.
+func scenarioMessage(s string) (TaggedMessage, error) {
+	m, err := ParseTaggedMessage(s + "\r\n")
+	if err != nil && err != irc.ErrTruncated {
+		return TaggedMessage{}, fmt.Errorf("invalid message: %s", err)
+	}
+	return m, nil
+}
+
+// scenarioMatcher matches messages like the one from an expect step.
+func scenarioMatcher(want TaggedMessage) Matcher {
+	matchers := []Matcher{Command(want.Command)}
+	if want.Prefix != "" {
+		matchers = append(matchers, Prefix(want.Prefix))
+	}
+	for i, param := range want.Params {
+		matchers = append(matchers, Param(i, param))
+	}
+	return AllOf(matchers...)
+}
+
+// scenarioRun holds what a running scenario has started.
+type scenarioRun struct {
+	h       *Harness
+	timeout time.Duration
+	servers map[string]*Catbox
+	clients map[string]*Client
+	links   map[string]*FaultLink
+}
+
+// Run runs the scenario's steps in order against servers it starts with the
+// Harness. We stop at the first step that fails and return an error saying
+// which.
+//
+// The clients are stopped when we return. The servers are left to the
+// Harness.
+func (s *Scenario) Run(h *Harness) error {
+	run := &scenarioRun{
+		h:       h,
+		timeout: expectTimeout,
+		servers: map[string]*Catbox{},
+		clients: map[string]*Client{},
+		links:   map[string]*FaultLink{},
+	}
+	defer func() {
+		for _, client := range run.clients {
+			client.Stop()
+		}
+	}()
+
+	for _, step := range s.Steps {
+		if err := run.step(step); err != nil {
+			return fmt.Errorf("%s: %s: %s", s.Name, step, err)
+		}
+	}
+
+	return nil
+}
+
+func (r *scenarioRun) step(step ScenarioStep) error {
+	args := step.Args
+
+	switch step.Command {
+	case "server":
+		if _, ok := r.servers[args[0]]; ok {
+			return fmt.Errorf("server %s already exists", args[0])
+		}
+		server, err := r.h.StartServer(ServerOptions{
+			Name: args[0],
+			TLS:  len(args) == 2,
+		})
+		if err != nil {
+			return err
+		}
+		r.servers[args[0]] = server
+		return nil
+	case "link":
+		a, b, err := r.serverPair(args[0], args[1])
+		if err != nil {
+			return err
+		}
+		if len(args) == 3 {
+			link, err := r.h.LinkWithFaults(a, b)
+			if err != nil {
+				return err
+			}
+			r.links[linkKey(a.Name, b.Name)] = link
+			return nil
+		}
+		return r.h.Link(a, b)
+	case "client":
+		return r.startClient(args[0], args[1])
+	case "send":
+		client, err := r.client(args[0])
+		if err != nil {
+			return err
+		}
+		m, err := scenarioMessage(args[1])
+		if err != nil {
+			return err
+		}
+		return client.Send(m)
+	case "expect":
+		client, err := r.client(args[0])
+		if err != nil {
+			return err
+		}
+		m, err := scenarioMessage(args[1])
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+		defer cancel()
+		_, err = client.Expect(ctx, scenarioMatcher(m))
+		return err
+	case "expect-none":
+		client, err := r.client(args[0])
+		if err != nil {
+			return err
+		}
+		m, err := scenarioMessage(args[1])
+		if err != nil {
+			return err
+		}
+		return client.ExpectNone(scenarioMatcher(m), noMessageWindow)
+	case "fault":
+		return r.fault(args[0], args[1], args[2], args[3:])
+	case "consistent":
+		ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+		defer cancel()
+		report, err := r.h.CheckConsistency(ctx, args...)
+		if err != nil {
+			return err
+		}
+		if !report.OK() {
+			return fmt.Errorf("%s", report)
+		}
+		return nil
+	case "quit":
+		client, err := r.client(args[0])
+		if err != nil {
+			return err
+		}
+		quit := irc.Message{Command: "QUIT"}
+		if len(args) == 2 {
+			quit.Params = []string{args[1]}
+		}
+		if err := client.Send(TaggedMessage{Message: quit}); err != nil {
+			return err
+		}
+		client.Stop()
+		delete(r.clients, args[0])
+		return nil
+	case "sleep":
+		d, _ := time.ParseDuration(args[0])
+		time.Sleep(d)
+		return nil
+	case "timeout":
+		r.timeout, _ = time.ParseDuration(args[0])
+		return nil
+	default:
+		return fmt.Errorf("unknown step")
+	}
+}
+
+func (r *scenarioRun) startClient(nick, serverName string) error {
+	if _, ok := r.clients[nick]; ok {
+		return fmt.Errorf("client %s already exists", nick)
+	}
+	server, ok := r.servers[serverName]
+	if !ok {
+		return fmt.Errorf("unknown server: %s", serverName)
+	}
+
+	client := r.h.NewClient(nick, server)
+	if _, _, _, err := client.Start(); err != nil {
+		return err
+	}
+	r.clients[nick] = client
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	_, err := client.Expect(ctx, Command(irc.ReplyWelcome))
+	return err
+}
+
+func (r *scenarioRun) fault(a, b, fault string, args []string) error {
+	link, ok := r.links[linkKey(a, b)]
+	if !ok {
+		return fmt.Errorf("servers %s and %s have no faulty link", a, b)
+	}
+
+	var durations []time.Duration
+	if fault == "delay" {
+		for _, arg := range args {
+			d, err := time.ParseDuration(arg)
+			if err != nil {
+				return fmt.Errorf("invalid duration: %s", err)
+			}
+			durations = append(durations, d)
+		}
+		if len(durations) == 0 || len(durations) > 2 {
+			return fmt.Errorf("delay takes a delay and an optional jitter")
+		}
+	} else if fault != "bandwidth" && len(args) != 0 {
+		return fmt.Errorf("%s takes no arguments", fault)
+	}
+
+	switch fault {
+	case "delay":
+		jitter := time.Duration(0)
+		if len(durations) == 2 {
+			jitter = durations[1]
+		}
+		link.SetDelay(BothWays, durations[0], jitter)
+	case "bandwidth":
+		if len(args) != 1 {
+			return fmt.Errorf("bandwidth takes bytes per second")
+		}
+		bytesPerSecond, err := strconv.Atoi(args[0])
+		if err != nil {
+			return fmt.Errorf("invalid bandwidth: %s", err)
+		}
+		link.SetBandwidth(BothWays, bytesPerSecond)
+	case "pause":
+		link.Pause(BothWays)
+	case "resume":
+		link.Resume(BothWays)
+	case "blackhole":
+		link.Blackhole(BothWays, true)
+	case "unblackhole":
+		link.Blackhole(BothWays, false)
+	case "drop":
+		link.Drop()
+	case "split":
+		link.Split()
+	case "heal":
+		linkRE := regexp.MustCompile(fmt.Sprintf(`Established link to %s\b`,
+			regexp.QuoteMeta(link.B.Name)))
+		from := link.A.Log.Len()
+		link.Heal()
+		if !waitForLog(link.A.Log, linkRE, from) {
+			return fmt.Errorf("failed to see %s link to %s again", link.A.Name,
+				link.B.Name)
+		}
+	default:
+		return fmt.Errorf("unknown fault: %s", fault)
+	}
+	return nil
+}
+
+func (r *scenarioRun) client(nick string) (*Client, error) {
+	client, ok := r.clients[nick]
+	if !ok {
+		return nil, fmt.Errorf("unknown client: %s", nick)
+	}
+	return client, nil
+}
+
+func (r *scenarioRun) serverPair(a, b string) (*Catbox, *Catbox, error) {
+	serverA, ok := r.servers[a]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown server: %s", a)
+	}
+	serverB, ok := r.servers[b]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown server: %s", b)
+	}
+	return serverA, serverB, nil
+}
+
+// linkKey identifies a link between two servers whichever order they're
+// given in.
+func linkKey(a, b string) string {
+	if a > b {
+		a, b = b, a
+	}
+	return a + " " + b
+}
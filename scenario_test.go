@@ -0,0 +1,113 @@
+package boxcat
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseScenario(t *testing.T) {
+	input := `# A comment.
+server irc1.example.org tls
+
+link irc1.example.org irc2.example.org faulty
+send alice PRIVMSG #test :hi  there
+expect	alice  :bob!* QUIT
+quit alice gone  for now
+send	bob	PRIVMSG alice :a	b 	
+consistent
+`
+	scenario, err := ParseScenario("test", strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("error parsing scenario: %s", err)
+	}
+
+	want := []ScenarioStep{
+		{Line: 2, Command: "server",
+			Args: []string{"irc1.example.org", "tls"}},
+		{Line: 4, Command: "link",
+			Args: []string{"irc1.example.org", "irc2.example.org", "faulty"}},
+		{Line: 5, Command: "send",
+			Args: []string{"alice", "PRIVMSG #test :hi  there"}},
+		{Line: 6, Command: "expect", Args: []string{"alice", ":bob!* QUIT"}},
+		{Line: 7, Command: "quit", Args: []string{"alice", "gone  for now"}},
+		{Line: 8, Command: "send",
+			Args: []string{"bob", "PRIVMSG alice :a\tb"}},
+		{Line: 9, Command: "consistent"},
+	}
+	if !reflect.DeepEqual(scenario.Steps, want) {
+		t.Fatalf("steps = %+v, wanted %+v", scenario.Steps, want)
+	}
+}
+
+func TestParseScenarioErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{"bogus irc1", "line 1: unknown step: bogus"},
+		{"\nserver", "line 2: wrong number of arguments for server"},
+		{"server irc1 ssl", "line 1: unknown server option: ssl"},
+		{"link irc1 irc2 slow", "line 1: unknown link option: slow"},
+		{"send alice", "line 1: wrong number of arguments for send"},
+		{"sleep soon", "line 1: invalid duration"},
+	}
+
+	for _, test := range tests {
+		_, err := ParseScenario("test", strings.NewReader(test.input))
+		if err == nil {
+			t.Errorf("ParseScenario(%q) succeeded, wanted error", test.input)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.err) {
+			t.Errorf("ParseScenario(%q) error = %q, wanted %q", test.input, err,
+				test.err)
+		}
+	}
+}
+
+func TestScenarioMatcher(t *testing.T) {
+	want, err := scenarioMessage(":bob!* QUIT")
+	if err != nil {
+		t.Fatalf("error parsing message: %s", err)
+	}
+	matcher := scenarioMatcher(want)
+
+	m := msg("QUIT", "Ping timeout")
+	m.Prefix = "bob!~bob@127.0.0.1"
+	if !matcher.Match(m) {
+		t.Errorf("%s did not match %s", matcher, m)
+	}
+
+	m.Prefix = "carol!~carol@127.0.0.1"
+	if matcher.Match(m) {
+		t.Errorf("%s matched %s", matcher, m)
+	}
+}
+
+// Run each scenario in testdata/scenarios.
+func TestScenarios(t *testing.T) {
+	t.Parallel()
+
+	paths, err := filepath.Glob(filepath.Join("testdata", "scenarios",
+		"*.scenario"))
+	if err != nil {
+		t.Fatalf("error finding scenarios: %s", err)
+	}
+
+	for _, path := range paths {
+		path := path
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			t.Parallel()
+
+			scenario, err := ParseScenarioFile(path)
+			if err != nil {
+				t.Fatalf("%s", err)
+			}
+			if err := scenario.Run(NewHarness(t)); err != nil {
+				t.Fatalf("%s", err)
+			}
+		})
+	}
+}
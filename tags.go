@@ -0,0 +1,215 @@
+package boxcat
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/horgh/irc"
+)
+
+// MaxTagsLength is the maximum length of the tags section of a message. It
+// includes the leading '@' and the trailing space. The rest of the message
+// has its own budget of irc.MaxLineLength bytes.
+//
+// See https://ircv3.net/specs/extensions/message-tags
+const MaxTagsLength = 8191
+
+// TaggedMessage is an IRC message that may have IRCv3 message tags.
+type TaggedMessage struct {
+	// Tags holds the message's tags with their values unescaped. A tag without
+	// a value has a blank value.
+	Tags map[string]string
+
+	irc.Message
+}
+
+// ParseTaggedMessage parses a protocol message that may have tags. The line
+// should include the trailing CRLF.
+//
+// As with irc.ParseMessage, if the message without its tags is too long we
+// truncate it and return irc.ErrTruncated along with the message.
+func ParseTaggedMessage(line string) (TaggedMessage, error) {
+	if !strings.HasPrefix(line, "@") {
+		m, err := irc.ParseMessage(line)
+		return TaggedMessage{Message: m}, err
+	}
+
+	idx := strings.Index(line, " ")
+	if idx == -1 {
+		return TaggedMessage{}, fmt.Errorf("malformed message. Tags only")
+	}
+
+	// Include the space.
+	if idx+1 > MaxTagsLength {
+		return TaggedMessage{}, fmt.Errorf("tags are too long: %d bytes", idx+1)
+	}
+
+	tags, err := parseTags(line[1:idx])
+	if err != nil {
+		return TaggedMessage{}, err
+	}
+
+	// There may be several spaces between the tags and the rest.
+	rest := strings.TrimLeft(line[idx:], " ")
+
+	m, err := irc.ParseMessage(rest)
+	if err != nil && err != irc.ErrTruncated {
+		return TaggedMessage{}, err
+	}
+
+	return TaggedMessage{Tags: tags, Message: m}, err
+}
+
+// parseTags parses the tags section of a message without the leading '@'.
+func parseTags(s string) (map[string]string, error) {
+	tags := map[string]string{}
+	for _, tag := range strings.Split(s, ";") {
+		if tag == "" {
+			continue
+		}
+
+		key := tag
+		value := ""
+		if idx := strings.Index(tag, "="); idx != -1 {
+			key = tag[:idx]
+			value = unescapeTagValue(tag[idx+1:])
+		}
+
+		if !isValidTagKey(key) {
+			return nil, fmt.Errorf("invalid tag key: %q", key)
+		}
+
+		// If a key is repeated, the last value wins.
+		tags[key] = value
+	}
+	return tags, nil
+}
+
+// isValidTagKey checks the key is made up of an optional client prefix ('+'),
+// an optional vendor followed by '/', and a name of letters, digits and
+// hyphens.
+func isValidTagKey(key string) bool {
+	key = strings.TrimPrefix(key, "+")
+	if idx := strings.LastIndex(key, "/"); idx != -1 {
+		if idx == 0 {
+			return false
+		}
+		key = key[idx+1:]
+	}
+
+	if key == "" {
+		return false
+	}
+
+	for _, c := range key {
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+			(c >= '0' && c <= '9') || c == '-' {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// Encode encodes the message with its tags. The line includes the trailing
+// CRLF.
+//
+// Tags are written in key order so that the encoding is stable.
+//
+// If the tags are too long we return an error. If the rest of the message is
+// too long we truncate it and return irc.ErrTruncated along with the line.
+func (m TaggedMessage) Encode() (string, error) {
+	buf, err := m.Message.Encode()
+	if err != nil && err != irc.ErrTruncated {
+		return "", err
+	}
+
+	if len(m.Tags) == 0 {
+		return buf, err
+	}
+
+	var tags []string
+	for _, key := range sortedKeys(m.Tags) {
+		if !isValidTagKey(key) {
+			return "", fmt.Errorf("invalid tag key: %q", key)
+		}
+		if m.Tags[key] == "" {
+			tags = append(tags, key)
+			continue
+		}
+		tags = append(tags, key+"="+escapeTagValue(m.Tags[key]))
+	}
+
+	tagsSection := "@" + strings.Join(tags, ";") + " "
+	if len(tagsSection) > MaxTagsLength {
+		return "", fmt.Errorf("tags are too long: %d bytes", len(tagsSection))
+	}
+
+	return tagsSection + buf, err
+}
+
+// String describes the message including its tags.
+func (m TaggedMessage) String() string {
+	if len(m.Tags) == 0 {
+		return m.Message.String()
+	}
+
+	var tags []string
+	for _, key := range sortedKeys(m.Tags) {
+		tags = append(tags, fmt.Sprintf("%s=%q", key, m.Tags[key]))
+	}
+	return fmt.Sprintf("Tags [%s] %s", strings.Join(tags, " "), m.Message)
+}
+
+// Tag retrieves the value of a tag and whether the message has it.
+func (m TaggedMessage) Tag(key string) (string, bool) {
+	value, ok := m.Tags[key]
+	return value, ok
+}
+
+var tagEscapes = strings.NewReplacer(
+	`\`, `\\`,
+	";", `\:`,
+	" ", `\s`,
+	"\r", `\r`,
+	"\n", `\n`,
+)
+
+func escapeTagValue(s string) string {
+	return tagEscapes.Replace(s)
+}
+
+// unescapeTagValue reverses escapeTagValue. A backslash before any other
+// character is dropped, as is a backslash at the end of the value.
+func unescapeTagValue(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+
+		i++
+		if i == len(s) {
+			break
+		}
+
+		switch s[i] {
+		case ':':
+			b.WriteByte(';')
+		case 's':
+			b.WriteByte(' ')
+		case 'r':
+			b.WriteByte('\r')
+		case 'n':
+			b.WriteByte('\n')
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
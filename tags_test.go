@@ -0,0 +1,196 @@
+package boxcat
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+func TestParseTaggedMessage(t *testing.T) {
+	tests := []struct {
+		input   string
+		tags    map[string]string
+		message irc.Message
+		err     bool
+	}{
+		{
+			input: ":irc.example.org NOTICE * :hi\r\n",
+			message: irc.Message{Prefix: "irc.example.org", Command: "NOTICE",
+				Params: []string{"*", "hi"}},
+		},
+		{
+			input: "@time=2020-01-01T00:00:00.000Z;msgid=abc :client1!u@h " +
+				"PRIVMSG #test :hi there\r\n",
+			tags: map[string]string{"time": "2020-01-01T00:00:00.000Z",
+				"msgid": "abc"},
+			message: irc.Message{Prefix: "client1!u@h", Command: "PRIVMSG",
+				Params: []string{"#test", "hi there"}},
+		},
+		{
+			input:   "@+draft/typing;label= TAGMSG #test\r\n",
+			tags:    map[string]string{"+draft/typing": "", "label": ""},
+			message: irc.Message{Command: "TAGMSG", Params: []string{"#test"}},
+		},
+		{
+			input: `@a=semi\:colon;b=sp\sace;c=back\\slash;d=\r\n;e=\x;f=end\` +
+				" PING x\r\n",
+			tags: map[string]string{"a": "semi;colon", "b": "sp ace",
+				"c": `back\slash`, "d": "\r\n", "e": "x", "f": "end"},
+			message: irc.Message{Command: "PING", Params: []string{"x"}},
+		},
+		{
+			input:   "@a=1;a=2  PING x\r\n",
+			tags:    map[string]string{"a": "2"},
+			message: irc.Message{Command: "PING", Params: []string{"x"}},
+		},
+		{input: "@a=1\r\n", err: true},
+		{input: "@a!=1 PING x\r\n", err: true},
+		{input: "@=1 PING x\r\n", err: true},
+		{input: "@" + strings.Repeat("a", MaxTagsLength) + " PING x\r\n",
+			err: true},
+	}
+
+	for _, test := range tests {
+		m, err := ParseTaggedMessage(test.input)
+		if err != nil {
+			if !test.err {
+				t.Errorf("ParseTaggedMessage(%q) = error %s", test.input, err)
+			}
+			continue
+		}
+		if test.err {
+			t.Errorf("ParseTaggedMessage(%q) = %s, wanted error", test.input, m)
+			continue
+		}
+
+		if len(test.tags) == 0 && len(m.Tags) != 0 ||
+			len(test.tags) != 0 && !reflect.DeepEqual(m.Tags, test.tags) {
+			t.Errorf("ParseTaggedMessage(%q) tags = %v, wanted %v", test.input,
+				m.Tags, test.tags)
+		}
+		if !reflect.DeepEqual(m.Message, test.message) {
+			t.Errorf("ParseTaggedMessage(%q) = %s, wanted %s", test.input,
+				m.Message, test.message)
+		}
+	}
+}
+
+func TestEncodeTaggedMessage(t *testing.T) {
+	m := TaggedMessage{
+		Tags: map[string]string{
+			"label":         "a;b c\\d\r\n",
+			"+draft/typing": "active",
+			"msgid":         "",
+		},
+		Message: irc.Message{Command: "TAGMSG", Params: []string{"#test"}},
+	}
+
+	buf, err := m.Encode()
+	if err != nil {
+		t.Fatalf("error encoding: %s", err)
+	}
+
+	want := `@+draft/typing=active;label=a\:b\sc\\d\r\n;msgid TAGMSG #test` +
+		"\r\n"
+	if buf != want {
+		t.Fatalf("Encode() = %q, wanted %q", buf, want)
+	}
+
+	parsed, err := ParseTaggedMessage(buf)
+	if err != nil {
+		t.Fatalf("error parsing: %s", err)
+	}
+	if !reflect.DeepEqual(parsed, m) {
+		t.Fatalf("round trip gave %s, wanted %s", parsed, m)
+	}
+
+	// Tags have their own length budget. A body at the maximum length is fine
+	// with tags in front of it.
+	long := TaggedMessage{
+		Tags: map[string]string{"label": strings.Repeat("x", 4000)},
+		Message: irc.Message{
+			Command: "PRIVMSG",
+			Params:  []string{"#test", strings.Repeat("y", 490)},
+		},
+	}
+	buf, err = long.Encode()
+	if err != nil {
+		t.Fatalf("error encoding long message: %s", err)
+	}
+	parsed, err = ParseTaggedMessage(buf)
+	if err != nil {
+		t.Fatalf("error parsing long message: %s", err)
+	}
+	if !reflect.DeepEqual(parsed, long) {
+		t.Fatalf("long round trip gave %s, wanted %s", parsed, long)
+	}
+
+	tooLong := TaggedMessage{
+		Tags:    map[string]string{"label": strings.Repeat("x", MaxTagsLength)},
+		Message: irc.Message{Command: "PING", Params: []string{"x"}},
+	}
+	if _, err := tooLong.Encode(); err == nil {
+		t.Fatalf("expected error encoding too long tags")
+	}
+
+	badKey := TaggedMessage{
+		Tags:    map[string]string{"a b": "c"},
+		Message: irc.Message{Command: "PING", Params: []string{"x"}},
+	}
+	if _, err := badKey.Encode(); err == nil {
+		t.Fatalf("expected error encoding invalid key")
+	}
+}
+
+// Test a Client sends tags and receives them.
+func TestClientTags(t *testing.T) {
+	server := newTestServer(t)
+	defer server.close()
+
+	client := server.newClient("client1")
+
+	server.serve(
+		server.accept,
+		server.expecting("NICK client1", "USER client1 0 * client1"),
+	)
+
+	if _, _, _, err := client.Start(); err != nil {
+		t.Fatalf("error starting client: %s", err)
+	}
+	defer client.Stop()
+	server.wait()
+
+	if err := client.Send(TaggedMessage{
+		Tags:    map[string]string{"label": "1"},
+		Message: irc.Message{Command: "PING", Params: []string{"x"}},
+	}); err != nil {
+		t.Fatalf("error sending: %s", err)
+	}
+
+	line, err := server.r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("error reading: %s", err)
+	}
+	if line != "@label=1 PING x\r\n" {
+		t.Fatalf("server read %q, wanted tagged PING", line)
+	}
+
+	if err := server.send("@label=1;time=2020-01-01T00:00:00.000Z " +
+		":irc.example.org PONG irc.example.org x"); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	m, err := client.Expect(ctx, AllOf(Command("PONG"), Tag("label", "1")))
+	if err != nil {
+		t.Fatalf("error waiting for PONG: %s", err)
+	}
+	if v, _ := m.Tag("time"); v != "2020-01-01T00:00:00.000Z" {
+		t.Fatalf("PONG time tag = %q", v)
+	}
+}
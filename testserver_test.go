@@ -0,0 +1,231 @@
+package boxcat
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// testServer is a scripted IRC server for testing Client without catbox. It
+// accepts a single connection.
+//
+// Its helpers return errors rather than failing the test, since only the
+// test's goroutine may call Fatalf. Run the server's side of a conversation
+// with serve and check how it went with wait.
+type testServer struct {
+	t        *testing.T
+	listener net.Listener
+	r        *bufio.Reader
+
+	// done is closed when the steps given to serve finish. err is the error
+	// that stopped them, if any.
+	done chan struct{}
+	err  error
+
+	// mutex protects conn. The test closes it while the steps may be using
+	// it.
+	mutex *sync.Mutex
+	conn  net.Conn
+}
+
+func newTestServer(t *testing.T) *testServer {
+	ln, err := net.Listen("tcp4", "127.0.0.1:")
+	if err != nil {
+		t.Fatalf("error listening: %s", err)
+	}
+	s := &testServer{t: t, listener: ln, mutex: &sync.Mutex{}}
+
+	// If the test fails before it waits, such as because the client saw us
+	// close the connection, report why the steps stopped.
+	t.Cleanup(func() {
+		s.close()
+		if s.done == nil {
+			return
+		}
+		<-s.done
+		if s.err != nil {
+			t.Errorf("server: %s", s.err)
+		}
+	})
+
+	return s
+}
+
+func (s *testServer) port() uint16 {
+	return uint16(s.listener.Addr().(*net.TCPAddr).Port)
+}
+
+// newClient creates a client for the server that logs to the test.
+func (s *testServer) newClient(nick string) *Client {
+	c := NewClient(nick, "127.0.0.1", s.port())
+	c.SetLogger(TBLogger(s.t))
+	return c
+}
+
+// run runs the steps in order. We stop at the first that fails and return
+// its error.
+func (s *testServer) run(steps ...func() error) error {
+	for _, step := range steps {
+		if err := step(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serve runs the steps in a goroutine. If one fails we skip the rest and
+// close the connection so the client isn't left waiting for us.
+func (s *testServer) serve(steps ...func() error) {
+	s.done = make(chan struct{})
+	go func() {
+		defer close(s.done)
+		if err := s.run(steps...); err != nil {
+			s.err = err
+			s.close()
+		}
+	}()
+}
+
+// wait waits for the steps given to serve to finish. The test fails if one
+// of them failed. Call it from the test's goroutine.
+func (s *testServer) wait() {
+	<-s.done
+	if err := s.err; err != nil {
+		s.err = nil
+		s.t.Fatalf("server: %s", err)
+	}
+}
+
+// accept waits for the client to connect.
+func (s *testServer) accept() error {
+	conn, err := s.listener.Accept()
+	if err != nil {
+		return fmt.Errorf("error accepting: %s", err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.conn = conn
+	s.r = bufio.NewReader(conn)
+	return nil
+}
+
+// read reads a message from the client.
+func (s *testServer) read() (irc.Message, error) {
+	deadline := time.Now().Add(5 * time.Second)
+	if err := s.conn.SetReadDeadline(deadline); err != nil {
+		return irc.Message{}, fmt.Errorf("error setting deadline: %s", err)
+	}
+	line, err := s.r.ReadString('\n')
+	if err != nil {
+		return irc.Message{}, fmt.Errorf("error reading: %s", err)
+	}
+	m, err := irc.ParseMessage(line)
+	if err != nil {
+		return irc.Message{}, fmt.Errorf("error parsing %q: %s", line, err)
+	}
+	return m, nil
+}
+
+// expect reads messages from the client and checks they are the given
+// lines.
+func (s *testServer) expect(lines ...string) error {
+	for _, line := range lines {
+		m, err := s.read()
+		if err != nil {
+			return fmt.Errorf("error waiting for %q: %s", line, err)
+		}
+		buf, err := m.Encode()
+		if err != nil {
+			return fmt.Errorf("error encoding: %s", err)
+		}
+		if got := strings.TrimRight(buf, "\r\n"); got != line {
+			return fmt.Errorf("client sent %q, wanted %q", got, line)
+		}
+	}
+	return nil
+}
+
+// send sends lines to the client.
+func (s *testServer) send(lines ...string) error {
+	for _, line := range lines {
+		if _, err := fmt.Fprintf(s.conn, "%s\r\n", line); err != nil {
+			return fmt.Errorf("error writing: %s", err)
+		}
+	}
+	return nil
+}
+
+// expecting makes a step for serve that calls expect.
+func (s *testServer) expecting(lines ...string) func() error {
+	return func() error {
+		return s.expect(lines...)
+	}
+}
+
+// sending makes a step for serve that calls send.
+func (s *testServer) sending(lines ...string) func() error {
+	return func() error {
+		return s.send(lines...)
+	}
+}
+
+func (s *testServer) close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.conn != nil {
+		_ = s.conn.Close()
+	}
+	_ = s.listener.Close()
+}
+
+// tempDir creates a temporary directory that we remove once the test
+// completes.
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "boxcat-test-")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %s", err)
+	}
+	t.Cleanup(func() {
+		_ = os.RemoveAll(dir)
+	})
+	return dir
+}
+
+// fakeCatboxSource writes a Go program to stand in for catbox's source. Use
+// the directory as BuildConfig.SourceDir.
+func fakeCatboxSource(t *testing.T, mainGo string) string {
+	dir := tempDir(t)
+
+	files := map[string]string{
+		"go.mod":  "module example.org/catbox\n",
+		"main.go": mainGo,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content),
+			0644); err != nil {
+			t.Fatalf("error writing %s: %s", name, err)
+		}
+	}
+	return dir
+}
+
+// fakeCatboxScript writes a shell script to stand in for catbox. Use it as
+// BuildConfig.Binary. Scripts that pretend to start must log what catbox
+// does: "<date> <time> catbox started".
+func fakeCatboxScript(t *testing.T, script string) string {
+	path := filepath.Join(tempDir(t), "catbox")
+	if err := ioutil.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatalf("error writing script: %s", err)
+	}
+	return path
+}
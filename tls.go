@@ -0,0 +1,229 @@
+package boxcat
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"time"
+)
+
+// CertificateAuthority is a throwaway certificate authority. Use it to issue
+// certificates for catbox's TLS listener and for clients.
+type CertificateAuthority struct {
+	Certificate *x509.Certificate
+
+	// CertificatePEM is the CA's certificate in PEM form.
+	CertificatePEM []byte
+
+	key *ecdsa.PrivateKey
+}
+
+// IssuedCertificate is a certificate a CertificateAuthority issued.
+type IssuedCertificate struct {
+	// Certificate holds the certificate and key ready for a tls.Config.
+	Certificate tls.Certificate
+
+	CertificatePEM []byte
+	KeyPEM         []byte
+
+	// Fingerprint is the hex encoded SHA-256 fingerprint of the certificate.
+	// Servers use it to identify clients (CertFP). Clients can pin it with
+	// PinnedTLSConfig.
+	Fingerprint string
+}
+
+// certificateLifetime is how long certificates we issue are valid for.
+const certificateLifetime = 24 * time.Hour
+
+// NewCertificateAuthority creates a CertificateAuthority with a new key.
+func NewCertificateAuthority() (*CertificateAuthority, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("error generating key: %s", err)
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "boxcat test CA"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(certificateLifetime),
+		KeyUsage:     x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template,
+		&key.PublicKey, key)
+	if err != nil {
+		return nil, fmt.Errorf("error creating CA certificate: %s", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing CA certificate: %s", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	return &CertificateAuthority{
+		Certificate:    cert,
+		CertificatePEM: certPEM,
+		key:            key,
+	}, nil
+}
+
+// CertPool creates a pool holding the CA's certificate.
+func (ca *CertificateAuthority) CertPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Certificate)
+	return pool
+}
+
+// ClientTLSConfig creates a config for a Client that trusts the CA. If
+// clientCert is not nil, the client presents it.
+func (ca *CertificateAuthority) ClientTLSConfig(
+	clientCert *IssuedCertificate,
+) *tls.Config {
+	config := &tls.Config{RootCAs: ca.CertPool()}
+	if clientCert != nil {
+		config.Certificates = []tls.Certificate{clientCert.Certificate}
+	}
+	return config
+}
+
+// PinnedTLSConfig creates a config for a Client that trusts only a server
+// whose certificate has the given SHA-256 fingerprint. This is how clients
+// trust self-signed certificates. The fingerprint is hex encoded, like
+// IssuedCertificate.Fingerprint, and may have colons between the bytes.
+//
+// We don't check who issued the certificate or the names it is for.
+func PinnedTLSConfig(fingerprint string) *tls.Config {
+	want := strings.ToLower(strings.Replace(fingerprint, ":", "", -1))
+
+	return &tls.Config{
+		// We do our own verification.
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte,
+			_ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return fmt.Errorf("server presented no certificate")
+			}
+			sum := sha256.Sum256(rawCerts[0])
+			if got := hex.EncodeToString(sum[:]); got != want {
+				return fmt.Errorf("certificate fingerprint %s does not match %s",
+					got, want)
+			}
+			return nil
+		},
+	}
+}
+
+// IssueServerCertificate issues a certificate for a server. hosts holds the
+// hostnames and IPs it is valid for.
+func (ca *CertificateAuthority) IssueServerCertificate(
+	hosts ...string,
+) (*IssuedCertificate, error) {
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("at least one host is required")
+	}
+
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: hosts[0]},
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+			continue
+		}
+		template.DNSNames = append(template.DNSNames, host)
+	}
+
+	return ca.issue(template)
+}
+
+// IssueClientCertificate issues a certificate a client can present to
+// identify itself.
+func (ca *CertificateAuthority) IssueClientCertificate(
+	commonName string,
+) (*IssuedCertificate, error) {
+	return ca.issue(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: commonName},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+}
+
+// issue signs a certificate from the template with a new key.
+func (ca *CertificateAuthority) issue(
+	template *x509.Certificate,
+) (*IssuedCertificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("error generating key: %s", err)
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(certificateLifetime)
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Certificate,
+		&key.PublicKey, ca.key)
+	if err != nil {
+		return nil, fmt.Errorf("error creating certificate: %s", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding key: %s", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY",
+		Bytes: keyDER})
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("error loading certificate: %s", err)
+	}
+
+	fingerprint := sha256.Sum256(der)
+
+	return &IssuedCertificate{
+		Certificate:    cert,
+		CertificatePEM: certPEM,
+		KeyPEM:         keyPEM,
+		Fingerprint:    hex.EncodeToString(fingerprint[:]),
+	}, nil
+}
+
+func randomSerial() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("error generating serial number: %s", err)
+	}
+	return serial, nil
+}
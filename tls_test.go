@@ -0,0 +1,240 @@
+package boxcat
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// Test a Client connects over TLS, verifies the server against our CA, and
+// presents a client certificate the server verifies.
+func TestClientTLS(t *testing.T) {
+	ca, err := NewCertificateAuthority()
+	if err != nil {
+		t.Fatalf("error creating CA: %s", err)
+	}
+
+	serverCert, err := ca.IssueServerCertificate("irc.example.org", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("error issuing server certificate: %s", err)
+	}
+
+	clientCert, err := ca.IssueClientCertificate("client1")
+	if err != nil {
+		t.Fatalf("error issuing client certificate: %s", err)
+	}
+
+	ln, err := tls.Listen("tcp4", "127.0.0.1:", &tls.Config{
+		Certificates: []tls.Certificate{serverCert.Certificate},
+		ClientCAs:    ca.CertPool(),
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	if err != nil {
+		t.Fatalf("error listening: %s", err)
+	}
+	defer func() {
+		_ = ln.Close()
+	}()
+
+	// The server welcomes clients with the CN of their certificate.
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go welcomeTLSClient(conn.(*tls.Conn))
+		}
+	}()
+
+	port := uint16(ln.Addr().(*net.TCPAddr).Port)
+
+	// Without trusting the CA we can't connect.
+	untrusting := NewClient("client1", "127.0.0.1", port)
+	untrusting.SetLogger(TBLogger(t))
+	untrusting.UseTLS(&tls.Config{})
+	if _, _, _, err := untrusting.Start(); err == nil {
+		untrusting.Stop()
+		t.Fatalf("expected error connecting without trusting CA")
+	}
+
+	client := NewClient("client1", "127.0.0.1", port)
+	client.SetLogger(TBLogger(t))
+	client.UseTLS(ca.ClientTLSConfig(clientCert))
+	if _, _, _, err := client.Start(); err != nil {
+		t.Fatalf("error starting client: %s", err)
+	}
+	defer client.Stop()
+
+	state, ok := client.GetTLSConnectionState()
+	if !ok {
+		t.Fatalf("client is not using TLS")
+	}
+	if len(state.PeerCertificates) == 0 ||
+		state.PeerCertificates[0].Subject.CommonName != "irc.example.org" {
+		t.Fatalf("unexpected server certificate")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := client.Expect(ctx, AllOf(
+		Command(irc.ReplyWelcome),
+		Param(1, "Welcome client1"),
+	)); err != nil {
+		t.Fatalf("error waiting for welcome: %s", err)
+	}
+}
+
+// Test a Client only connects to a server whose certificate matches the
+// pinned fingerprint.
+func TestClientTLSPinned(t *testing.T) {
+	ca, err := NewCertificateAuthority()
+	if err != nil {
+		t.Fatalf("error creating CA: %s", err)
+	}
+
+	serverCert, err := ca.IssueServerCertificate("irc.example.org", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("error issuing server certificate: %s", err)
+	}
+	otherCert, err := ca.IssueServerCertificate("irc.example.org", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("error issuing server certificate: %s", err)
+	}
+
+	ln, err := tls.Listen("tcp4", "127.0.0.1:", &tls.Config{
+		Certificates: []tls.Certificate{serverCert.Certificate},
+	})
+	if err != nil {
+		t.Fatalf("error listening: %s", err)
+	}
+	defer func() {
+		_ = ln.Close()
+	}()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() {
+					_ = conn.Close()
+				}()
+				if err := conn.(*tls.Conn).Handshake(); err != nil {
+					return
+				}
+				_, _ = ioutil.ReadAll(conn)
+			}()
+		}
+	}()
+
+	port := uint16(ln.Addr().(*net.TCPAddr).Port)
+
+	mismatched := NewClient("client1", "127.0.0.1", port)
+	mismatched.SetLogger(TBLogger(t))
+	mismatched.UseTLS(PinnedTLSConfig(otherCert.Fingerprint))
+	if _, _, _, err := mismatched.Start(); err == nil {
+		mismatched.Stop()
+		t.Fatalf("expected error connecting with a mismatched pin")
+	}
+
+	// Pins often have colons and are upper case.
+	var pin []string
+	for i := 0; i < len(serverCert.Fingerprint); i += 2 {
+		pin = append(pin, strings.ToUpper(serverCert.Fingerprint[i:i+2]))
+	}
+
+	client := NewClient("client1", "127.0.0.1", port)
+	client.SetLogger(TBLogger(t))
+	client.UseTLS(PinnedTLSConfig(strings.Join(pin, ":")))
+	if _, _, _, err := client.Start(); err != nil {
+		t.Fatalf("error starting client: %s", err)
+	}
+	client.Stop()
+}
+
+func welcomeTLSClient(conn *tls.Conn) {
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	if err := conn.Handshake(); err != nil {
+		return
+	}
+	cn := conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+
+	r := bufio.NewReader(conn)
+	for i := 0; i < 2; i++ {
+		if _, err := r.ReadString('\n'); err != nil {
+			return
+		}
+	}
+	_, _ = fmt.Fprintf(conn, ":irc.example.org 001 client1 :Welcome %s\r\n", cn)
+	_, _ = r.ReadString('\n')
+}
+
+// Test a client can connect to catbox's TLS listener.
+func TestTLS(t *testing.T) {
+	t.Parallel()
+
+	h := NewHarness(t)
+
+	catbox, err := h.StartServer(ServerOptions{
+		Name: "irc.example.org",
+		TLS:  true,
+	})
+	if err != nil {
+		t.Fatalf("error harnessing catbox: %s", err)
+	}
+
+	ca, err := h.CertificateAuthority()
+	if err != nil {
+		t.Fatalf("error retrieving CA: %s", err)
+	}
+
+	client := NewClient("client1", "127.0.0.1", catbox.TLSPort)
+	client.SetLogger(h.Logger)
+	client.UseTLS(ca.ClientTLSConfig(nil))
+	if _, _, _, err := client.Start(); err != nil {
+		t.Fatalf("error starting client: %s", err)
+	}
+	defer client.Stop()
+
+	expect(t, client, Command(irc.ReplyWelcome))
+}
+
+// Test we try another TLS port if catbox finds the one we chose is in use.
+func TestStartServerTLSPortInUse(t *testing.T) {
+	// A stand in for catbox that fails to bind the first time it runs.
+	marker := filepath.Join(tempDir(t), "ran")
+	script := fmt.Sprintf(`#!/bin/sh
+if [ ! -e %s ]; then
+	touch %s
+	echo "listen tcp 127.0.0.1:6697: bind: address already in use" >&2
+	exit 1
+fi
+echo "$(date +'%%Y/%%m/%%d %%H:%%M:%%S') catbox started" >&2
+exec sleep 60
+`, marker, marker)
+
+	h := NewHarness(t)
+	h.Build = BuildConfig{Binary: fakeCatboxScript(t, script)}
+
+	if _, err := h.StartServer(ServerOptions{
+		Name: "irc.example.org",
+		TLS:  true,
+	}); err != nil {
+		t.Fatalf("error starting catbox: %s", err)
+	}
+}
@@ -0,0 +1,345 @@
+package boxcat
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Topology describes a set of servers and how they link together.
+type Topology struct {
+	// Servers holds the server names.
+	Servers []string
+
+	// Links holds pairs of indexes into Servers. Each pair is a link.
+	Links [][2]int
+}
+
+// linkTimeout is how long we wait for servers to link.
+const linkTimeout = 30 * time.Second
+
+// serverNames creates n server names.
+func serverNames(n int) []string {
+	var names []string
+	for i := 1; i <= n; i++ {
+		names = append(names, fmt.Sprintf("irc%d.example.org", i))
+	}
+	return names
+}
+
+// Chain creates a topology with n servers linked one after another.
+func Chain(n int) Topology {
+	t := Topology{Servers: serverNames(n)}
+	for i := 1; i < n; i++ {
+		t.Links = append(t.Links, [2]int{i - 1, i})
+	}
+	return t
+}
+
+// Star creates a topology with n servers where the first is a hub that every
+// other server links to.
+func Star(n int) Topology {
+	t := Topology{Servers: serverNames(n)}
+	for i := 1; i < n; i++ {
+		t.Links = append(t.Links, [2]int{0, i})
+	}
+	return t
+}
+
+// Mesh creates a topology with n servers where every server links to every
+// other server.
+//
+// This has loops. The servers should reject the links that would create them.
+func Mesh(n int) Topology {
+	t := Topology{Servers: serverNames(n)}
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			t.Links = append(t.Links, [2]int{i, j})
+		}
+	}
+	return t
+}
+
+// Tree creates a topology with n servers arranged as a tree where each server
+// has up to fanout servers below it. The first server is the root.
+func Tree(n, fanout int) Topology {
+	t := Topology{Servers: serverNames(n)}
+	if fanout < 1 {
+		fanout = 1
+	}
+	for i := 1; i < n; i++ {
+		t.Links = append(t.Links, [2]int{(i - 1) / fanout, i})
+	}
+	return t
+}
+
+// Graph creates a topology with n servers and the given links.
+func Graph(n int, links ...[2]int) Topology {
+	return Topology{Servers: serverNames(n), Links: links}
+}
+
+// validate checks the links refer to servers that exist.
+func (t Topology) validate() error {
+	if len(t.Servers) == 0 {
+		return fmt.Errorf("topology has no servers")
+	}
+	for _, link := range t.Links {
+		for _, i := range link {
+			if i < 0 || i >= len(t.Servers) {
+				return fmt.Errorf("link %v refers to unknown server", link)
+			}
+		}
+		if link[0] == link[1] {
+			return fmt.Errorf("link %v links a server to itself", link)
+		}
+	}
+	return nil
+}
+
+// hasLoop reports whether the links form a loop.
+func (t Topology) hasLoop() bool {
+	sets := newDisjointSets(len(t.Servers))
+	for _, link := range t.Links {
+		if !sets.union(link[0], link[1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Network is a set of linked servers.
+type Network struct {
+	Topology Topology
+
+	// Servers holds the servers in the same order as Topology.Servers.
+	Servers []*Catbox
+
+	// RejectedLinks holds the links from the topology that the servers did
+	// not establish because they would make a loop.
+	RejectedLinks [][2]int
+}
+
+// Server retrieves the server with the given name. It returns nil if there
+// is none.
+func (n *Network) Server(name string) *Catbox {
+	for _, server := range n.Servers {
+		if server.Name == name {
+			return server
+		}
+	}
+	return nil
+}
+
+// StartTopology starts the servers in the topology, links them, and waits for
+// the links to be established.
+//
+// If the topology has no loops, we wait for both ends of every link. If it
+// has loops, the servers reject some links, so we instead wait until every
+// server is connected to every other one and no more links come up.
+// Network.RejectedLinks says which they rejected. Either way, we then check
+// the first server counts every server, so a link that dropped fails.
+func (h *Harness) StartTopology(t Topology) (*Network, error) {
+	if err := t.validate(); err != nil {
+		return nil, err
+	}
+
+	network := &Network{Topology: t}
+	for _, name := range t.Servers {
+		server, err := h.StartServer(ServerOptions{Name: name})
+		if err != nil {
+			return nil, fmt.Errorf("error starting %s: %s", name, err)
+		}
+		network.Servers = append(network.Servers, server)
+	}
+
+	for _, link := range t.Links {
+		a, b := network.Servers[link[0]], network.Servers[link[1]]
+		a.Config.AddServer(b.serverLink())
+		b.Config.AddServer(a.serverLink())
+	}
+
+	var cursors []int
+	for _, server := range network.Servers {
+		cursors = append(cursors, server.Log.Len())
+	}
+
+	for _, server := range network.Servers {
+		if err := server.Rehash(); err != nil {
+			return nil, fmt.Errorf("error rehashing %s: %s", server.Name, err)
+		}
+	}
+
+	deadline := time.Now().Add(linkTimeout)
+	if err := network.waitForLinks(cursors, deadline); err != nil {
+		return nil, err
+	}
+	if err := network.checkServerCount(h, deadline); err != nil {
+		return nil, err
+	}
+
+	return network, nil
+}
+
+var establishedLinkRE = regexp.MustCompile(`Established link to (\S+)`)
+
+// linkSettle is how long the established links must stay the same before we
+// decide the servers rejected the links they did not establish.
+const linkSettle = time.Second
+
+// waitForLinks waits for the servers to link. We look at log lines at or
+// after the cursors.
+//
+// We wait until each server logs establishing each of its links. If the
+// topology has loops, the servers refuse the links to servers they already
+// reach another way. We don't rely on how catbox words that. Instead, once
+// every server reaches every other one through established links and no more
+// links have come up for linkSettle, we take the links that are missing to
+// be the rejected ones. We record them in the Network.
+func (n *Network) waitForLinks(cursors []int, deadline time.Time) error {
+	hasLoop := n.Topology.hasLoop()
+
+	var last map[[2]int]bool
+	changed := time.Now()
+	for {
+		established := n.linkStates(cursors)
+		if !reflect.DeepEqual(established, last) {
+			last = established
+			changed = time.Now()
+		}
+
+		missing, networks := n.Topology.missingLinks(established)
+		if len(missing) == 0 {
+			return nil
+		}
+		if hasLoop && networks == 1 && time.Since(changed) >= linkSettle {
+			n.RejectedLinks = missing
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			var names []string
+			for _, link := range missing {
+				names = append(names, fmt.Sprintf("%s <-> %s",
+					n.Topology.Servers[link[0]], n.Topology.Servers[link[1]]))
+			}
+			return fmt.Errorf(
+				"timed out waiting for links: %s (%d separate networks)",
+				strings.Join(names, ", "), networks)
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// linkStates finds what servers logged about their links at or after the
+// cursors. The map holds a link [a, b] if server a logged establishing its
+// link to server b.
+func (n *Network) linkStates(cursors []int) map[[2]int]bool {
+	indexes := map[string]int{}
+	for i, server := range n.Servers {
+		indexes[strings.ToLower(server.Name)] = i
+	}
+
+	established := map[[2]int]bool{}
+	for i, server := range n.Servers {
+		lines := server.Log.Lines()
+		for _, line := range lines[cursors[i]:] {
+			matches := establishedLinkRE.FindStringSubmatch(line.Text)
+			if matches == nil {
+				continue
+			}
+			name := strings.ToLower(strings.TrimRight(matches[1], "."))
+			if other, ok := indexes[name]; ok {
+				established[[2]int{i, other}] = true
+			}
+		}
+	}
+	return established
+}
+
+// missingLinks finds the links that are not established on both ends. We
+// also return how many separate networks the established links make.
+func (t Topology) missingLinks(established map[[2]int]bool) ([][2]int, int) {
+	var missing [][2]int
+	sets := newDisjointSets(len(t.Servers))
+	for _, link := range t.Links {
+		a, b := link[0], link[1]
+		if established[[2]int{a, b}] && established[[2]int{b, a}] {
+			sets.union(a, b)
+			continue
+		}
+		missing = append(missing, link)
+	}
+	return missing, sets.count
+}
+
+// checkServerCount connects a client to the first server and waits until it
+// counts every server. If a link dropped after it was established, the
+// network is split and it counts fewer.
+func (n *Network) checkServerCount(h *Harness, deadline time.Time) error {
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	server := n.Servers[0]
+	client := h.NewClient("links", server)
+	client.SetNickFallback(NickIncrement, 0)
+	if _, _, _, err := client.StartContext(ctx); err != nil {
+		return fmt.Errorf("error connecting to %s: %s", server.Name, err)
+	}
+	defer client.Stop()
+
+	for {
+		_, servers, err := lusers(ctx, client)
+		if err != nil {
+			return fmt.Errorf("error counting servers on %s: %s", server.Name,
+				err)
+		}
+		if servers == len(n.Servers) {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s counts %d servers, wanted %d: %s", server.Name,
+				servers, len(n.Servers), ctx.Err())
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// disjointSets is a union-find structure over the integers 0 to n-1.
+type disjointSets struct {
+	parents []int
+	count   int
+}
+
+func newDisjointSets(n int) *disjointSets {
+	d := &disjointSets{count: n}
+	for i := 0; i < n; i++ {
+		d.parents = append(d.parents, i)
+	}
+	return d
+}
+
+func (d *disjointSets) find(i int) int {
+	for d.parents[i] != i {
+		d.parents[i] = d.parents[d.parents[i]]
+		i = d.parents[i]
+	}
+	return i
+}
+
+// union joins the sets holding a and b. It returns false if they were already
+// in the same set.
+func (d *disjointSets) union(a, b int) bool {
+	rootA, rootB := d.find(a), d.find(b)
+	if rootA == rootB {
+		return false
+	}
+	d.parents[rootA] = rootB
+	d.count--
+	return true
+}
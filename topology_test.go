@@ -0,0 +1,174 @@
+package boxcat
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/horgh/irc"
+)
+
+func TestTopologies(t *testing.T) {
+	tests := []struct {
+		name     string
+		topology Topology
+		links    [][2]int
+		loop     bool
+	}{
+		{"chain", Chain(4), [][2]int{{0, 1}, {1, 2}, {2, 3}}, false},
+		{"star", Star(4), [][2]int{{0, 1}, {0, 2}, {0, 3}}, false},
+		{"mesh", Mesh(3), [][2]int{{0, 1}, {0, 2}, {1, 2}}, true},
+		{"tree", Tree(5, 2), [][2]int{{0, 1}, {0, 2}, {1, 3}, {1, 4}}, false},
+		{"graph", Graph(3, [2]int{0, 1}, [2]int{1, 2}, [2]int{2, 0}),
+			[][2]int{{0, 1}, {1, 2}, {2, 0}}, true},
+	}
+
+	for _, test := range tests {
+		if len(test.topology.Servers) == 0 {
+			t.Errorf("%s: no servers", test.name)
+			continue
+		}
+		if err := test.topology.validate(); err != nil {
+			t.Errorf("%s: invalid: %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(test.topology.Links, test.links) {
+			t.Errorf("%s: links = %v, wanted %v", test.name, test.topology.Links,
+				test.links)
+		}
+		if test.topology.hasLoop() != test.loop {
+			t.Errorf("%s: hasLoop = %t, wanted %t", test.name,
+				test.topology.hasLoop(), test.loop)
+		}
+	}
+
+	if err := Graph(2, [2]int{0, 2}).validate(); err == nil {
+		t.Errorf("expected error about unknown server")
+	}
+}
+
+func TestLinkStates(t *testing.T) {
+	network := &Network{Topology: Mesh(3)}
+	for _, name := range network.Topology.Servers {
+		network.Servers = append(network.Servers, &Catbox{
+			Name: name,
+			Log:  newLogRecorder(name),
+		})
+	}
+
+	// irc3 establishes its link to irc2, but irc2 refuses it as it already
+	// reaches irc3 through irc1.
+	logs := [][]string{
+		{
+			"2020/01/02 03:04:05 Established link to irc2.example.org.",
+			"2020/01/02 03:04:05 Established link to irc3.example.org.",
+		},
+		{
+			"2020/01/02 03:04:05 Established link to irc1.example.org.",
+			"2020/01/02 03:04:05 Connecting to irc3.example.org",
+		},
+		{
+			"2020/01/02 03:04:05 Established link to irc1.example.org.",
+			"2020/01/02 03:04:05 Established link to irc2.example.org.",
+		},
+	}
+	for i, lines := range logs {
+		for _, line := range lines {
+			network.Servers[i].Log.add("stderr", line)
+		}
+	}
+
+	established := network.linkStates([]int{0, 0, 0})
+
+	wantEstablished := map[[2]int]bool{
+		{0, 1}: true, {0, 2}: true, {1, 0}: true, {2, 0}: true, {2, 1}: true,
+	}
+	if !reflect.DeepEqual(established, wantEstablished) {
+		t.Errorf("established = %v, wanted %v", established, wantEstablished)
+	}
+
+	missing, networks := network.Topology.missingLinks(established)
+	if want := [][2]int{{1, 2}}; !reflect.DeepEqual(missing, want) ||
+		networks != 1 {
+		t.Errorf("missing links = %v in %d networks, wanted %v in 1", missing,
+			networks, want)
+	}
+
+	// Without the link to irc3, the chain is split.
+	missing, networks = Chain(3).missingLinks(map[[2]int]bool{
+		{0, 1}: true, {1, 0}: true, {1, 2}: true,
+	})
+	if want := [][2]int{{1, 2}}; !reflect.DeepEqual(missing, want) ||
+		networks != 2 {
+		t.Errorf("missing links = %v in %d networks, wanted %v in 2", missing,
+			networks, want)
+	}
+}
+
+// Test a message crosses a chain of servers, and a mesh where the servers
+// must reject the links making loops.
+func TestTopologyPRIVMSG(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		topology Topology
+		// rejected is whether the servers must reject a link.
+		rejected bool
+	}{
+		{"chain", Chain(3), false},
+		{"mesh", Mesh(3), true},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			h := NewHarness(t)
+
+			network, err := h.StartTopology(test.topology)
+			if err != nil {
+				t.Fatalf("error starting servers: %s", err)
+			}
+
+			// Three servers need only two links. The third makes a loop.
+			if test.rejected && len(network.RejectedLinks) == 0 {
+				t.Fatalf("servers established every link of %v",
+					test.topology.Links)
+			}
+			if !test.rejected && len(network.RejectedLinks) != 0 {
+				t.Fatalf("servers rejected links %v", network.RejectedLinks)
+			}
+
+			first := network.Servers[0]
+			last := network.Servers[len(network.Servers)-1]
+
+			client1 := h.NewClient("client1", first)
+			_, sendChan1, _, err := client1.Start()
+			if err != nil {
+				t.Fatalf("error starting client: %s", err)
+			}
+			defer client1.Stop()
+
+			client2 := h.NewClient("client2", last)
+			if _, _, _, err := client2.Start(); err != nil {
+				t.Fatalf("error starting client: %s", err)
+			}
+			defer client2.Stop()
+
+			expect(t, client1, Command(irc.ReplyWelcome))
+			expect(t, client2, Command(irc.ReplyWelcome))
+
+			sendChan1 <- irc.Message{
+				Command: "PRIVMSG",
+				Params:  []string{client2.GetNick(), "hi there"},
+			}
+
+			expect(t, client2, AllOf(
+				SourceNick(client1.GetNick()),
+				Command("PRIVMSG"),
+				Params(client2.GetNick(), "hi there"),
+			))
+		})
+	}
+}
@@ -0,0 +1,425 @@
+package boxcat
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// TranscriptDirection is whether a client sent or received a line.
+type TranscriptDirection string
+
+const (
+	// Sent is a line a client sent to its server.
+	Sent TranscriptDirection = "->"
+
+	// Received is a line a client received from its server.
+	Received TranscriptDirection = "<-"
+)
+
+// TranscriptEntry is a line in a Transcript.
+type TranscriptEntry struct {
+	// Elapsed is how long after the transcript started we saw the line.
+	Elapsed time.Duration
+
+	// Client is the name the client is recorded under.
+	Client string
+
+	Direction TranscriptDirection
+
+	// Line is the line without its trailing CRLF.
+	Line string
+}
+
+// Normalizer replaces parts of lines that change from run to run, such as
+// timestamps and ports.
+type Normalizer struct {
+	RE          *regexp.Regexp
+	Replacement string
+}
+
+// DefaultNormalizers are the Normalizers a new Transcript uses.
+var DefaultNormalizers = []Normalizer{
+	// server-time tags.
+	{regexp.MustCompile(`\btime=[^; ]+`), "time=<time>"},
+	// Hosts in prefixes.
+	{regexp.MustCompile(`(![^@ ]+)@[^ ]+`), "$1@<host>"},
+	// IPv4 addresses, with or without a port.
+	{regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}(?::\d+)?\b`), "<ip>"},
+	{regexp.MustCompile(`\bport \d+\b`), "port <port>"},
+	// Unix times, such as channel creation times.
+	{regexp.MustCompile(`\b1\d{9}\b`), "<unixtime>"},
+	// Dates and times of day, such as when the server started.
+	{regexp.MustCompile(
+		`\b\d{4}-\d\d-\d\d(?:[T ][\d:.]+(?: ?(?:Z|[+-]\d\d:?\d\d))?)?`),
+		"<date>"},
+	{regexp.MustCompile(`\b\d\d?:\d\d:\d\d(?:\.\d+)?\b`), "<clock>"},
+}
+
+// Transcript records every line that clients send and receive.
+//
+// Clients record into it once you call Client.RecordTranscript. You can save
+// a transcript to a file and compare later runs against it. See CheckGolden
+// and ReplayTranscript.
+type Transcript struct {
+	// Normalizers are applied in order to each line when we compare or write
+	// out the transcript.
+	Normalizers []Normalizer
+
+	start   time.Time
+	entries []TranscriptEntry
+
+	// updated is closed and replaced each time we record a line.
+	updated chan struct{}
+
+	mutex *sync.Mutex
+}
+
+// NewTranscript creates an empty Transcript that uses the default
+// normalizers. Elapsed times are relative to now.
+func NewTranscript() *Transcript {
+	return &Transcript{
+		Normalizers: append([]Normalizer(nil), DefaultNormalizers...),
+		start:       time.Now(),
+		updated:     make(chan struct{}),
+		mutex:       &sync.Mutex{},
+	}
+}
+
+// record adds a line.
+func (t *Transcript) record(client string, dir TranscriptDirection,
+	line string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.entries = append(t.entries, TranscriptEntry{
+		Elapsed:   time.Since(t.start),
+		Client:    client,
+		Direction: dir,
+		Line:      strings.TrimRight(line, "\r\n"),
+	})
+
+	close(t.updated)
+	t.updated = make(chan struct{})
+}
+
+// Entries returns a copy of the entries in the order we saw them.
+func (t *Transcript) Entries() []TranscriptEntry {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return append([]TranscriptEntry(nil), t.entries...)
+}
+
+// count returns how many lines the client has in the given direction. We
+// also return a channel that is closed when we next record a line.
+func (t *Transcript) count(
+	client string,
+	dir TranscriptDirection,
+) (int, <-chan struct{}) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	n := 0
+	for _, e := range t.entries {
+		if e.Client == client && e.Direction == dir {
+			n++
+		}
+	}
+	return n, t.updated
+}
+
+// Normalize applies the transcript's normalizers to the line.
+func (t *Transcript) Normalize(line string) string {
+	for _, n := range t.Normalizers {
+		line = n.RE.ReplaceAllString(line, n.Replacement)
+	}
+	return line
+}
+
+// Lines returns the normalised lines without their times, for comparing.
+//
+// Lines from one client stay in order, but we group them by client. How lines
+// from different clients interleave depends on timing, so comparing that
+// would be flaky.
+func (t *Transcript) Lines() []string {
+	entries := t.Entries()
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Client < entries[j].Client
+	})
+
+	var lines []string
+	for _, e := range entries {
+		lines = append(lines, fmt.Sprintf("%s %s %s", e.Client, e.Direction,
+			t.Normalize(e.Line)))
+	}
+	return lines
+}
+
+// String formats the transcript the way we write it to a file: one line per
+// entry with the elapsed seconds, the client, the direction, and the
+// normalised line.
+func (t *Transcript) String() string {
+	var b strings.Builder
+	for _, e := range t.Entries() {
+		fmt.Fprintf(&b, "%.3f %s %s %s\n", e.Elapsed.Seconds(), e.Client,
+			e.Direction, t.Normalize(e.Line))
+	}
+	return b.String()
+}
+
+// WriteFile writes the transcript to a file.
+func (t *Transcript) WriteFile(path string) error {
+	if err := ioutil.WriteFile(path, []byte(t.String()), 0644); err != nil {
+		return fmt.Errorf("error writing transcript: %s", err)
+	}
+	return nil
+}
+
+// ReadTranscriptFile reads a transcript written by WriteFile. Its lines are
+// already normalised.
+func ReadTranscriptFile(path string) (*Transcript, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening transcript: %s", err)
+	}
+	defer func() {
+		_ = fh.Close()
+	}()
+
+	t := NewTranscript()
+	scanner := bufio.NewScanner(fh)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		fields := strings.SplitN(scanner.Text(), " ", 4)
+		if len(fields) != 4 ||
+			(fields[2] != string(Sent) && fields[2] != string(Received)) {
+			return nil, fmt.Errorf("%s: line %d: malformed transcript line", path,
+				lineNumber)
+		}
+
+		seconds, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: line %d: invalid time: %s", path,
+				lineNumber, err)
+		}
+
+		t.entries = append(t.entries, TranscriptEntry{
+			Elapsed:   time.Duration(seconds * float64(time.Second)),
+			Client:    fields[1],
+			Direction: TranscriptDirection(fields[2]),
+			Line:      fields[3],
+		})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading transcript: %s", err)
+	}
+
+	return t, nil
+}
+
+// RecordTranscript makes the client record the lines it sends and receives
+// into the transcript under the given name. Call it before starting the
+// client.
+func (c *Client) RecordTranscript(t *Transcript, name string) {
+	c.transcript = t
+	c.transcriptName = name
+}
+
+// recordLine records a line in the client's transcript if it has one.
+func (c *Client) recordLine(dir TranscriptDirection, line string) {
+	if c.transcript != nil {
+		c.transcript.record(c.transcriptName, dir, line)
+	}
+}
+
+// DiffTranscripts compares the normalised lines of two transcripts. We return
+// a blank string if they're the same. Otherwise we return a diff with lines
+// only in want prefixed with - and lines only in got prefixed with +.
+func DiffTranscripts(want, got *Transcript) string {
+	return diffLines(want.Lines(), got.Lines())
+}
+
+// diffLines makes a line diff using the longest common subsequence.
+func diffLines(a, b []string) string {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and
+	// b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var diff []string
+	differ := false
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			diff = append(diff, "  "+a[i])
+			i++
+			j++
+		case j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			diff = append(diff, "- "+a[i])
+			differ = true
+			i++
+		default:
+			diff = append(diff, "+ "+b[j])
+			differ = true
+			j++
+		}
+	}
+
+	if !differ {
+		return ""
+	}
+	return strings.Join(diff, "\n")
+}
+
+// CheckGolden compares the transcript with the golden transcript in the
+// file. The test fails if they differ.
+//
+// If the environment variable BOXCAT_UPDATE_GOLDEN is set, we write the
+// transcript to the file instead.
+func CheckGolden(tb testing.TB, path string, got *Transcript) {
+	tb.Helper()
+
+	if os.Getenv("BOXCAT_UPDATE_GOLDEN") != "" {
+		if err := got.WriteFile(path); err != nil {
+			tb.Fatalf("%s", err)
+		}
+		return
+	}
+
+	want, err := ReadTranscriptFile(path)
+	if err != nil {
+		tb.Fatalf("%s (set BOXCAT_UPDATE_GOLDEN=1 to create it)", err)
+	}
+
+	if diff := DiffTranscripts(want, got); diff != "" {
+		tb.Fatalf("transcript differs from %s:\n%s", path, diff)
+	}
+}
+
+// ReplayTranscript sends the lines the clients sent in the golden transcript
+// again and records a new transcript of what happens. Compare the two with
+// DiffTranscripts.
+//
+// newClient creates each client the first time the golden transcript
+// mentions it. We start it and discard the messages it receives, so don't
+// use Expect on it. Its lines are in the new transcript. We don't replay the
+// lines clients send on their own: those before they were welcomed
+// (registration), and PONGs. The golden lines are normalised, so we send
+// placeholders where the original lines had volatile parts.
+//
+// Before each line we wait for the client to have received as many lines as
+// it had at that point in the golden transcript. This keeps the clients in
+// step with each other. If the context is done, we stop waiting and return
+// what we have, so the diff shows what is missing.
+func ReplayTranscript(
+	ctx context.Context,
+	golden *Transcript,
+	newClient func(name string) *Client,
+) (*Transcript, error) {
+	got := NewTranscript()
+	got.Normalizers = golden.Normalizers
+
+	clients := map[string]*Client{}
+	defer func() {
+		for _, client := range clients {
+			client.Stop()
+		}
+	}()
+
+	wantReceived := map[string]int{}
+	welcomed := map[string]bool{}
+
+	for _, e := range golden.Entries() {
+		client, ok := clients[e.Client]
+		if !ok {
+			client = newClient(e.Client)
+			client.RecordTranscript(got, e.Client)
+			recvChan, _, _, err := client.StartContext(ctx)
+			if err != nil {
+				return got, fmt.Errorf("error starting %s: %s", e.Client, err)
+			}
+			clients[e.Client] = client
+
+			// The client stops reading once its receive channel is full. We
+			// count what it receives from the transcript, so throw the
+			// messages away. The channel closes when we stop the client.
+			go func() {
+				for range recvChan {
+				}
+			}()
+		}
+
+		m, err := ParseTaggedMessage(e.Line + "\r\n")
+		if err != nil && err != irc.ErrTruncated {
+			return got, fmt.Errorf("error parsing %s: %s", e.Line, err)
+		}
+
+		if e.Direction == Received {
+			wantReceived[e.Client]++
+			if m.Command == irc.ReplyWelcome {
+				welcomed[e.Client] = true
+			}
+			continue
+		}
+
+		if !welcomed[e.Client] || m.Command == "PONG" {
+			continue
+		}
+
+		waitForTranscript(ctx, got, e.Client, wantReceived[e.Client])
+		if err := client.Send(m); err != nil {
+			return got, fmt.Errorf("error sending %s: %s", e.Line, err)
+		}
+	}
+
+	for name, n := range wantReceived {
+		waitForTranscript(ctx, got, name, n)
+	}
+
+	return got, nil
+}
+
+// waitForTranscript waits until the client has received at least n lines or
+// the context is done.
+func waitForTranscript(ctx context.Context, t *Transcript, client string,
+	n int) {
+	for {
+		received, updated := t.count(client, Received)
+		if received >= n {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-updated:
+		}
+	}
+}
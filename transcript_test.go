@@ -0,0 +1,188 @@
+package boxcat
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNormalizeTranscript(t *testing.T) {
+	tests := []struct {
+		input  string
+		output string
+	}{
+		{
+			"@time=2020-01-02T03:04:05.678Z :a!~a@127.0.0.1 PRIVMSG #a :hi",
+			"@time=<time> :a!~a@<host> PRIVMSG #a :hi",
+		},
+		{
+			":irc1 329 a #a 1577934245",
+			":irc1 329 a #a <unixtime>",
+		},
+		{
+			":irc1 003 a :This server was created 2020-01-02 03:04:05 +0000",
+			":irc1 003 a :This server was created <date>",
+		},
+		{
+			":irc1 NOTICE a :Connecting to 127.0.0.1:6667 at 03:04:05",
+			":irc1 NOTICE a :Connecting to <ip> at <clock>",
+		},
+		{
+			":irc1 NOTICE a :Listening on port 41234",
+			":irc1 NOTICE a :Listening on port <port>",
+		},
+	}
+
+	transcript := NewTranscript()
+	for _, test := range tests {
+		output := transcript.Normalize(test.input)
+		if output != test.output {
+			t.Errorf("Normalize(%q) = %q, wanted %q", test.input, output,
+				test.output)
+			continue
+		}
+		if again := transcript.Normalize(output); again != output {
+			t.Errorf("Normalize(%q) = %q, wanted it unchanged", output, again)
+		}
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	if diff := diffLines([]string{"a", "b"}, []string{"a", "b"}); diff != "" {
+		t.Errorf("diff of equal lines = %q, wanted none", diff)
+	}
+
+	diff := diffLines([]string{"a", "b", "c"}, []string{"a", "x", "c", "d"})
+	want := "  a\n- b\n+ x\n  c\n+ d"
+	if diff != want {
+		t.Errorf("diff = %q, wanted %q", diff, want)
+	}
+}
+
+// Test recording a client's session, writing it out, and replaying it.
+func TestTranscriptReplay(t *testing.T) {
+	path := filepath.Join(tempDir(t), "session.transcript")
+
+	session := func(server *testServer, when string) {
+		server.serve(
+			server.accept,
+			server.expecting("NICK client1", "USER client1 0 * client1"),
+			server.sending(":irc.example.org 001 client1 :Welcome at "+when),
+			server.expecting("JOIN #test"),
+			server.sending(":client1!~client1@127.0.0.1 JOIN #test"),
+		)
+	}
+
+	// Record.
+	server := newTestServer(t)
+	session(server, "03:04:05")
+
+	recorded := NewTranscript()
+	client := server.newClient("client1")
+	client.RecordTranscript(recorded, "client1")
+	if _, _, _, err := client.Start(); err != nil {
+		t.Fatalf("error starting client: %s", err)
+	}
+	expect(t, client, Command("001"))
+	if err := client.Send(msg("JOIN", "#test")); err != nil {
+		t.Fatalf("error sending: %s", err)
+	}
+	expect(t, client, Command("JOIN"))
+	server.wait()
+	client.Stop()
+	server.close()
+
+	if err := recorded.WriteFile(path); err != nil {
+		t.Fatalf("%s", err)
+	}
+	golden, err := ReadTranscriptFile(path)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(golden.Entries()) != 5 {
+		t.Fatalf("golden transcript has %d entries, wanted 5:\n%s",
+			len(golden.Entries()), golden)
+	}
+
+	// Replay against a server that behaves the same apart from the time.
+	server = newTestServer(t)
+	defer server.close()
+	session(server, "13:14:15")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	replayed, err := ReplayTranscript(ctx, golden, func(name string) *Client {
+		return server.newClient(name)
+	})
+	if err != nil {
+		t.Fatalf("error replaying: %s", err)
+	}
+	server.wait()
+
+	if diff := DiffTranscripts(golden, replayed); diff != "" {
+		t.Fatalf("replay differs:\n%s", diff)
+	}
+}
+
+// Test replaying a transcript with more lines than fit in a client's receive
+// channel.
+func TestTranscriptReplayLong(t *testing.T) {
+	const notices = 600
+
+	lines := []string{":irc.example.org 001 client1 :Welcome"}
+	for i := 0; i < notices; i++ {
+		lines = append(lines,
+			fmt.Sprintf(":irc.example.org NOTICE client1 :line %d", i))
+	}
+
+	session := func(server *testServer) {
+		server.serve(
+			server.accept,
+			server.expecting("NICK client1", "USER client1 0 * client1"),
+			server.sending(lines...),
+			server.expecting("QUIT done"),
+		)
+	}
+
+	// Record.
+	server := newTestServer(t)
+	session(server)
+
+	golden := NewTranscript()
+	client := server.newClient("client1")
+	client.RecordTranscript(golden, "client1")
+	if _, _, _, err := client.Start(); err != nil {
+		t.Fatalf("error starting client: %s", err)
+	}
+	expect(t, client, Param(1, fmt.Sprintf("line %d", notices-1)))
+	if err := client.Send(msg("QUIT", "done")); err != nil {
+		t.Fatalf("error sending: %s", err)
+	}
+	server.wait()
+	client.Stop()
+	server.close()
+
+	// Replay. We only send the QUIT once the client received every NOTICE.
+	server = newTestServer(t)
+	defer server.close()
+	session(server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	replayed, err := ReplayTranscript(ctx, golden, func(name string) *Client {
+		return server.newClient(name)
+	})
+	if err != nil {
+		t.Fatalf("error replaying: %s", err)
+	}
+	server.wait()
+
+	if ctx.Err() != nil {
+		t.Fatalf("replay took until the deadline")
+	}
+	if diff := DiffTranscripts(golden, replayed); diff != "" {
+		t.Fatalf("replay differs:\n%s", diff)
+	}
+}
@@ -1,32 +1,50 @@
 package boxcat
 
 import (
+	"context"
 	"testing"
-
-	"github.com/horgh/irc"
+	"time"
 )
 
-func messageIsEqual(t *testing.T, got, wanted *irc.Message) {
-	if got == nil {
-		t.Fatalf("received nil message")
-	}
+// expectTimeout is how long tests wait for an expected message.
+const expectTimeout = 10 * time.Second
 
-	if got.Prefix != wanted.Prefix {
-		t.Fatalf("message prefix = %s, wanted %s", got.Prefix, wanted.Prefix)
-	}
+// noMessageWindow is how long tests watch for a message that should not
+// arrive.
+const noMessageWindow = time.Second
+
+// expect waits for the client to receive a message matching the matcher. It
+// fails the test if none arrives.
+func expect(t *testing.T, c *Client, m Matcher) TaggedMessage {
+	ctx, cancel := context.WithTimeout(context.Background(), expectTimeout)
+	defer cancel()
 
-	if got.Command != wanted.Command {
-		t.Fatalf("message command = %s, wanted %s", got.Command, wanted.Command)
+	msg, err := c.Expect(ctx, m)
+	if err != nil {
+		t.Fatalf("client %s: %s", c.GetNick(), err)
 	}
+	return msg
+}
 
-	if len(got.Params) != len(wanted.Params) {
-		t.Fatalf("message number of params = %d, wanted %d", len(got.Params),
-			len(wanted.Params))
+// expectNone checks that the client does not receive a message matching the
+// matcher. It fails the test if one arrives.
+func expectNone(t *testing.T, c *Client, m Matcher) {
+	if err := c.ExpectNone(m, noMessageWindow); err != nil {
+		t.Fatalf("client %s: %s", c.GetNick(), err)
 	}
+}
 
-	for i := range wanted.Params {
-		if got.Params[i] != wanted.Params[i] {
-			t.Fatalf("param %d = %s, wanted %s", i, got.Params[i], wanted.Params[i])
-		}
+// checkConsistency checks the harness's servers agree on the state of the
+// network and the channels. It fails the test if they don't.
+func checkConsistency(t *testing.T, h *Harness, channels ...string) {
+	ctx, cancel := context.WithTimeout(context.Background(), expectTimeout)
+	defer cancel()
+
+	report, err := h.CheckConsistency(ctx, channels...)
+	if err != nil {
+		t.Fatalf("error checking consistency: %s", err)
+	}
+	if !report.OK() {
+		t.Fatalf("%s", report)
 	}
 }